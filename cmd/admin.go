@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/acrlabs/prom2parquet/pkg/parquet"
+)
+
+const writersAPIPath = "/api/v1/writers"
+
+// writerInfo is what the admin API reports about each writer; the recently-finalized files are only included in the
+// per-writer view.
+type writerInfo struct {
+	Name         string            `json:"name"`
+	Directory    string            `json:"directory"`
+	Metric       string            `json:"metric"`
+	Labels       map[string]string `json:"labels,omitempty"`
+	LastReceived time.Time         `json:"lastReceived"`
+	QueueLength  int               `json:"queueLength"`
+
+	parquet.WriterStatus
+}
+
+type writersResponse struct {
+	Writers []writerInfo `json:"writers"`
+}
+
+// listWriters returns the status of every open writer
+func (self *promserver) listWriters(w http.ResponseWriter, _ *http.Request) {
+	self.m.RLock()
+	resp := writersResponse{Writers: make([]writerInfo, 0, len(self.writers))}
+	for chName, mw := range self.writers {
+		info := self.writerInfo(chName, mw)
+		info.RecentFiles = nil
+		resp.Writers = append(resp.Writers, info)
+	}
+	self.m.RUnlock()
+
+	sort.Slice(resp.Writers, func(i, j int) bool { return resp.Writers[i].Name < resp.Writers[j].Name })
+	writeJSON(w, resp)
+}
+
+// getWriter returns the status of a single writer, identified by the name that listWriters reports for it
+func (self *promserver) getWriter(w http.ResponseWriter, req *http.Request) {
+	name := req.PathValue("name")
+
+	self.m.RLock()
+	defer self.m.RUnlock()
+	for chName, mw := range self.writers {
+		if self.displayName(chName) == name {
+			writeJSON(w, self.writerInfo(chName, mw))
+			return
+		}
+	}
+	http.Error(w, fmt.Sprintf("no open writer named %s", name), http.StatusNotFound)
+}
+
+func (self *promserver) writerInfo(chName string, mw *metricWriter) writerInfo {
+	dir, metric := splitWriterName(chName)
+	info := writerInfo{
+		Name:         self.displayName(chName),
+		Directory:    dir,
+		Metric:       metric,
+		Labels:       self.partitionLabels(chName),
+		LastReceived: mw.idleSince().UTC(),
+		QueueLength:  len(mw.ch),
+	}
+	if mw.writer != nil {
+		info.WriterStatus = mw.writer.Status()
+	}
+	return info
+}
+
+// partitionLabels returns the values of the path template labels that are part of the writer's name
+func (self *promserver) partitionLabels(chName string) map[string]string {
+	_, values, ok := strings.Cut(chName, partitionSep)
+	if !ok || self.opts.layout == nil {
+		return nil
+	}
+
+	labels := map[string]string{}
+	parts := strings.Split(values, partitionSep)
+	for i, l := range self.opts.layout.Labels() {
+		if i < len(parts) {
+			labels[l] = parts[i]
+		}
+	}
+	return labels
+}
+
+// displayName is a human-readable version of the writer's name: the directory and metric name, followed by the path
+// template labels (if any) in selector syntax, e.g., `prefix/metric{namespace="default"}`
+func (self *promserver) displayName(chName string) string {
+	base, _, _ := strings.Cut(chName, partitionSep)
+	labels := self.partitionLabels(chName)
+	if len(labels) == 0 {
+		return base
+	}
+
+	pairs := []string{}
+	for _, l := range self.opts.layout.Labels() {
+		if v, ok := labels[l]; ok {
+			pairs = append(pairs, fmt.Sprintf("%s=%q", l, v))
+		}
+	}
+	return base + "{" + strings.Join(pairs, ",") + "}"
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", jsonContentType)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("could not write JSON response: %v", err)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/xitongsys/parquet-go-source/mem"
+
+	"github.com/acrlabs/prom2parquet/pkg/backends"
+	"github.com/acrlabs/prom2parquet/pkg/parquet"
+)
+
+func TestWritersAPI(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	mem.SetInMemFileFs(&fs)
+
+	layout, err := parquet.NewPathTemplate(`{{.Metric}}/namespace={{.Label "namespace"}}/{{.Timestamp}}.parquet`)
+	assert.Nil(t, err)
+
+	srv := newServer(&options{backend: backends.Memory, backendRoot: "/test", flushInterval: time.Hour, layout: layout})
+	defer closeWriters(t, srv)
+
+	for _, ns := range []string{"kube-system", "default"} {
+		_, _, err := srv.sendTimeseries(context.TODO(), "", []prompb.TimeSeries{{
+			Labels: []prompb.Label{
+				{Name: model.MetricNameLabel, Value: metricName},
+				{Name: prefixLabelKey, Value: testPrefix},
+				{Name: "namespace", Value: ns},
+			},
+			Samples: []prompb.Sample{{Value: 1.0, Timestamp: 1000}},
+		}})
+		assert.Nil(t, err)
+	}
+
+	w := httptest.NewRecorder()
+	srv.httpserv.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, writersAPIPath, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var list writersResponse
+	assert.Nil(t, json.NewDecoder(w.Body).Decode(&list))
+	assert.Len(t, list.Writers, 2)
+	assert.Equal(t, channelName+`{namespace="default"}`, list.Writers[0].Name)
+	assert.Equal(t, testPrefix, list.Writers[0].Directory)
+	assert.Equal(t, metricName, list.Writers[0].Metric)
+	assert.Equal(t, map[string]string{"namespace": "default"}, list.Writers[0].Labels)
+	assert.Equal(t, channelName+`{namespace="kube-system"}`, list.Writers[1].Name)
+
+	assert.Empty(t, rotateWriters(context.TODO(), srv.writers).Errors)
+
+	w = httptest.NewRecorder()
+	path := writersAPIPath + "/" + url.PathEscape(list.Writers[0].Name)
+	srv.httpserv.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var info writerInfo
+	assert.Nil(t, json.NewDecoder(w.Body).Decode(&info))
+	assert.Equal(t, list.Writers[0].Name, info.Name)
+	assert.Len(t, info.RecentFiles, 1)
+	assert.True(t, strings.HasPrefix(info.RecentFiles[0].Name, metricName+"/namespace=default/"))
+	assert.Equal(t, time.UnixMilli(1000).UTC(), *info.LastSampleTime)
+
+	w = httptest.NewRecorder()
+	srv.httpserv.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, writersAPIPath+"/nope", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
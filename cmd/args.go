@@ -1,6 +1,8 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"sort"
 	"strings"
 	"time"
@@ -8,6 +10,7 @@ import (
 	log "github.com/sirupsen/logrus"
 
 	"github.com/acrlabs/prom2parquet/pkg/backends"
+	"github.com/acrlabs/prom2parquet/pkg/parquet"
 )
 
 const (
@@ -17,6 +20,44 @@ const (
 	backendFlag       = "backend"
 	backendRootFlag   = "backend-root"
 	verbosityFlag     = "verbosity"
+	pathTemplateFlag  = "path-template"
+	tsdbFlag          = "tsdb"
+	labelColumnsFlag  = "label-columns-file"
+	schemaModeFlag    = "schema-mode"
+
+	authBearerTokenFileFlag        = "auth-bearer-token-file"
+	authBasicUsernameFlag          = "auth-basic-username"
+	authBasicPasswordFileFlag      = "auth-basic-password-file"
+	flushAuthBearerTokenFileFlag   = "flush-auth-bearer-token-file"
+	flushAuthBasicUsernameFlag     = "flush-auth-basic-username"
+	flushAuthBasicPasswordFileFlag = "flush-auth-basic-password-file"
+
+	tlsCertFileFlag         = "tls-cert-file"
+	tlsKeyFileFlag          = "tls-key-file"
+	tlsClientCAFileFlag     = "tls-client-ca-file"
+	tlsClientCertPrefixFlag = "tls-client-cert-prefix"
+
+	multiTenantFlag      = "multi-tenant"
+	tenantHeaderFlag     = "tenant-header"
+	tenantMaxWritersFlag = "tenant-max-writers"
+	tenantLimitsFileFlag = "tenant-limits-file"
+
+	walDirFlag = "wal-dir"
+
+	haTrackerFlag         = "ha-tracker"
+	haClusterLabelFlag    = "ha-cluster-label"
+	haReplicaLabelFlag    = "ha-replica-label"
+	haFailoverTimeoutFlag = "ha-failover-timeout"
+
+	duplicateSamplesFlag = "duplicate-samples"
+
+	relabelConfigFileFlag = "relabel-config-file"
+
+	writerIdleTimeoutFlag = "writer-idle-timeout"
+	maxOpenWritersFlag    = "max-open-writers"
+	writerQueueSizeFlag   = "writer-queue-size"
+
+	shutdownDelayFlag = "shutdown-delay"
 )
 
 //nolint:gochecknoglobals
@@ -25,6 +66,19 @@ var supportedBackendIDs = map[backends.StorageBackend][]string{
 	backends.S3:    {"s3", "aws"},
 }
 
+//nolint:gochecknoglobals
+var duplicatePolicyIDs = map[parquet.DuplicatePolicy][]string{
+	parquet.KeepDuplicates:     {"keep"},
+	parquet.DropDuplicates:     {"drop"},
+	parquet.SeparateDuplicates: {"separate-file"},
+}
+
+//nolint:gochecknoglobals
+var schemaModeIDs = map[parquet.SchemaMode][]string{
+	parquet.FixedSchema:   {"fixed"},
+	parquet.DynamicSchema: {"dynamic"},
+}
+
 //nolint:gochecknoglobals
 var logLevelIDs = map[log.Level][]string{
 	log.TraceLevel: {"trace"},
@@ -41,10 +95,80 @@ type options struct {
 	flushInterval time.Duration
 	backend       backends.StorageBackend
 	backendRoot   string
+	pathTemplate  string
+	layout        *parquet.PathTemplate
+	labelColumns  labelColumnsConfig
+
+	ingestAuth authConfig
+	flushAuth  authConfig
+	tls        tlsConfig
+	tenancy    tenancyConfig
+	walDir     string
+	ha         haConfig
+	duplicates parquet.DuplicatePolicy
+	relabel    relabelConfig
+	writers    writerConfig
+
+	shutdownDelay time.Duration
 
 	verbosity log.Level
 }
 
+func (self *options) validate() error {
+	if err := self.parseLayout(); err != nil {
+		return err
+	}
+	if err := self.labelColumns.validate(); err != nil {
+		return fmt.Errorf("invalid label columns config: %w", err)
+	}
+	if err := self.ingestAuth.validate(); err != nil {
+		return fmt.Errorf("invalid authentication config: %w", err)
+	}
+	if err := self.flushAuth.validate(); err != nil {
+		return fmt.Errorf("invalid /flush authentication config: %w", err)
+	}
+	if err := self.tls.validate(); err != nil {
+		return fmt.Errorf("invalid TLS config: %w", err)
+	}
+	if err := self.tenancy.validate(); err != nil {
+		return fmt.Errorf("invalid multi-tenancy config: %w", err)
+	}
+	if err := self.ha.validate(); err != nil {
+		return fmt.Errorf("invalid HA tracker config: %w", err)
+	}
+	if err := self.relabel.validate(); err != nil {
+		return fmt.Errorf("invalid relabel config: %w", err)
+	}
+	if err := self.writers.validate(); err != nil {
+		return fmt.Errorf("invalid writer config: %w", err)
+	}
+	if self.shutdownDelay < 0 {
+		return errors.New("the shutdown delay must not be negative")
+	} else if self.shutdownDelay >= shutdownTime {
+		return fmt.Errorf("the shutdown delay must be less than the %v shutdown timeout", shutdownTime)
+	}
+	return nil
+}
+
+// parseLayout parses the path template; it's separate from validate because it's also needed for backfilling
+func (self *options) parseLayout() error {
+	if self.pathTemplate == "" {
+		return nil
+	}
+
+	layout, err := parquet.NewPathTemplate(self.pathTemplate)
+	if err != nil {
+		return fmt.Errorf("invalid path template: %w", err)
+	}
+	self.layout = layout
+	return nil
+}
+
+// customLayout returns true if the files aren't laid out using the default path template
+func (self *options) customLayout() bool {
+	return self.layout != nil && self.layout.String() != parquet.DefaultPathTemplate
+}
+
 func validArgs[K comparable](supportedIDs map[K][]string) string {
 	valids := []string{}
 	for _, l := range supportedIDs {
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const bearerPrefix = "Bearer "
+
+type authConfig struct {
+	bearerTokenFile   string
+	basicUsername     string
+	basicPasswordFile string
+}
+
+func (self authConfig) enabled() bool {
+	return self.bearerTokenFile != "" || self.basicUsername != "" || self.basicPasswordFile != ""
+}
+
+func (self authConfig) validate() error {
+	if (self.basicUsername == "") != (self.basicPasswordFile == "") {
+		return errors.New("basic auth requires both a username and a password file")
+	}
+
+	for _, file := range []string{self.bearerTokenFile, self.basicPasswordFile} {
+		if file == "" {
+			continue
+		}
+		if _, err := (&secretFile{path: file}).get(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// authenticator checks incoming requests against the configured credentials; a request is accepted if it matches
+// _any_ of the configured methods.  A nil authenticator accepts all requests.
+type authenticator struct {
+	basicUsername string
+	bearerToken   *secretFile
+	basicPassword *secretFile
+}
+
+func newAuthenticator(cfg authConfig) *authenticator {
+	if !cfg.enabled() {
+		return nil
+	}
+
+	a := &authenticator{basicUsername: cfg.basicUsername}
+	if cfg.bearerTokenFile != "" {
+		a.bearerToken = &secretFile{path: cfg.bearerTokenFile}
+	}
+	if cfg.basicPasswordFile != "" {
+		a.basicPassword = &secretFile{path: cfg.basicPasswordFile}
+	}
+	return a
+}
+
+func (self *authenticator) wrap(handler http.HandlerFunc) http.HandlerFunc {
+	if self == nil {
+		return handler
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		ok, err := self.authorized(req)
+		if err != nil {
+			log.Errorf("could not check credentials: %v", err)
+			http.Error(w, "could not check credentials", http.StatusInternalServerError)
+			return
+		} else if !ok {
+			if self.basicPassword != nil {
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", progname))
+			}
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		handler(w, req)
+	}
+}
+
+// reload re-reads all of the credentials files, even if they haven't changed
+func (self *authenticator) reload() error {
+	if self == nil {
+		return nil
+	}
+
+	var errs []error
+	for _, f := range []*secretFile{self.bearerToken, self.basicPassword} {
+		if f == nil {
+			continue
+		}
+		if _, err := f.reload(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (self *authenticator) authorized(req *http.Request) (bool, error) {
+	if self.bearerToken != nil {
+		if header := req.Header.Get("Authorization"); strings.HasPrefix(header, bearerPrefix) {
+			token, err := self.bearerToken.get()
+			if err != nil {
+				return false, err
+			}
+			if secureEquals(strings.TrimPrefix(header, bearerPrefix), token) {
+				return true, nil
+			}
+		}
+	}
+
+	if self.basicPassword != nil {
+		if username, password, ok := req.BasicAuth(); ok {
+			expected, err := self.basicPassword.get()
+			if err != nil {
+				return false, err
+			}
+			// Evaluate both comparisons so that we don't leak which one failed through timing
+			usernameOk := secureEquals(username, self.basicUsername)
+			passwordOk := secureEquals(password, expected)
+			if usernameOk && passwordOk {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
+
+func secureEquals(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// secretFile holds a credential that is stored in a file (e.g., a mounted Kubernetes secret).  The file is re-read
+// whenever its modification time changes, so credentials can be rotated without restarting.
+type secretFile struct {
+	path string
+
+	m       sync.Mutex
+	modTime time.Time
+	value   string
+}
+
+func (self *secretFile) reload() (string, error) {
+	self.m.Lock()
+	self.modTime = time.Time{}
+	self.m.Unlock()
+
+	return self.get()
+}
+
+func (self *secretFile) get() (string, error) {
+	self.m.Lock()
+	defer self.m.Unlock()
+
+	info, err := os.Stat(self.path)
+	if err != nil {
+		return "", fmt.Errorf("can't stat credentials file %s: %w", self.path, err)
+	}
+
+	if !info.ModTime().Equal(self.modTime) {
+		contents, err := os.ReadFile(self.path)
+		if err != nil {
+			return "", fmt.Errorf("can't read credentials file %s: %w", self.path, err)
+		}
+
+		value := strings.TrimSpace(string(contents))
+		if value == "" {
+			return "", fmt.Errorf("credentials file %s is empty", self.path)
+		}
+		self.value = value
+		self.modTime = info.ModTime()
+	}
+
+	return self.value, nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeSecret(t *testing.T, dir, name, value string) string {
+	path := filepath.Join(dir, name)
+	assert.Nil(t, os.WriteFile(path, []byte(value+"\n"), 0o600))
+	return path
+}
+
+func TestAuthenticator(t *testing.T) {
+	dir := t.TempDir()
+	tokenFile := writeSecret(t, dir, "token", "s3cr3t")
+	passwordFile := writeSecret(t, dir, "password", "hunter2")
+	flushTokenFile := writeSecret(t, dir, "flush-token", "fl00sh")
+
+	authOpts := &options{
+		ingestAuth: authConfig{
+			bearerTokenFile:   tokenFile,
+			basicUsername:     "prometheus",
+			basicPasswordFile: passwordFile,
+		},
+	}
+
+	cases := map[string]struct {
+		opts           *options
+		path           string
+		setAuth        func(*http.Request)
+		expectedStatus int
+	}{
+		"no auth configured": {
+			opts:           &options{},
+			path:           "/receive",
+			setAuth:        func(*http.Request) {},
+			expectedStatus: http.StatusUnsupportedMediaType,
+		},
+		"missing credentials": {
+			opts:           authOpts,
+			path:           "/receive",
+			setAuth:        func(*http.Request) {},
+			expectedStatus: http.StatusUnauthorized,
+		},
+		"valid bearer token": {
+			opts:           authOpts,
+			path:           "/receive",
+			setAuth:        func(r *http.Request) { r.Header.Set("Authorization", "Bearer s3cr3t") },
+			expectedStatus: http.StatusUnsupportedMediaType,
+		},
+		"invalid bearer token": {
+			opts:           authOpts,
+			path:           "/receive",
+			setAuth:        func(r *http.Request) { r.Header.Set("Authorization", "Bearer nope") },
+			expectedStatus: http.StatusUnauthorized,
+		},
+		"valid basic auth": {
+			opts:           authOpts,
+			path:           "/receive",
+			setAuth:        func(r *http.Request) { r.SetBasicAuth("prometheus", "hunter2") },
+			expectedStatus: http.StatusUnsupportedMediaType,
+		},
+		"wrong basic auth user": {
+			opts:           authOpts,
+			path:           "/receive",
+			setAuth:        func(r *http.Request) { r.SetBasicAuth("grafana", "hunter2") },
+			expectedStatus: http.StatusUnauthorized,
+		},
+		"flush uses ingest credentials by default": {
+			opts:           authOpts,
+			path:           "/flush",
+			setAuth:        func(r *http.Request) { r.Header.Set("Authorization", "Bearer s3cr3t") },
+			expectedStatus: http.StatusBadRequest,
+		},
+		"flush uses separate credentials": {
+			opts: &options{
+				ingestAuth: authOpts.ingestAuth,
+				flushAuth:  authConfig{bearerTokenFile: flushTokenFile},
+			},
+			path:           "/flush",
+			setAuth:        func(r *http.Request) { r.Header.Set("Authorization", "Bearer fl00sh") },
+			expectedStatus: http.StatusBadRequest,
+		},
+		"flush rejects ingest credentials": {
+			opts: &options{
+				ingestAuth: authOpts.ingestAuth,
+				flushAuth:  authConfig{bearerTokenFile: flushTokenFile},
+			},
+			path:           "/flush",
+			setAuth:        func(r *http.Request) { r.Header.Set("Authorization", "Bearer s3cr3t") },
+			expectedStatus: http.StatusUnauthorized,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			srv := newServer(tc.opts)
+			req := httptest.NewRequest(http.MethodPost, tc.path, nil)
+			req.Header.Set("Content-Type", "application/json")
+			tc.setAuth(req)
+
+			w := httptest.NewRecorder()
+			srv.httpserv.Handler.ServeHTTP(w, req)
+			assert.Equal(t, tc.expectedStatus, w.Code)
+		})
+	}
+}
+
+func TestSecretFileReload(t *testing.T) {
+	dir := t.TempDir()
+	path := writeSecret(t, dir, "token", "first")
+	secret := &secretFile{path: path}
+
+	value, err := secret.get()
+	assert.Nil(t, err)
+	assert.Equal(t, "first", value)
+
+	assert.Nil(t, os.WriteFile(path, []byte("second"), 0o600))
+	assert.Nil(t, os.Chtimes(path, time.Now(), time.Now().Add(time.Minute)))
+
+	value, err = secret.get()
+	assert.Nil(t, err)
+	assert.Equal(t, "second", value)
+}
+
+func TestAuthConfigValidate(t *testing.T) {
+	dir := t.TempDir()
+	passwordFile := writeSecret(t, dir, "password", "hunter2")
+	emptyFile := writeSecret(t, dir, "empty", "")
+
+	cases := map[string]struct {
+		cfg         authConfig
+		expectedErr bool
+	}{
+		"empty":                 {cfg: authConfig{}},
+		"basic auth":            {cfg: authConfig{basicUsername: "user", basicPasswordFile: passwordFile}},
+		"username only":         {cfg: authConfig{basicUsername: "user"}, expectedErr: true},
+		"missing token file":    {cfg: authConfig{bearerTokenFile: filepath.Join(dir, "nope")}, expectedErr: true},
+		"empty credential file": {cfg: authConfig{bearerTokenFile: emptyFile}, expectedErr: true},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			err := tc.cfg.validate()
+			if tc.expectedErr {
+				assert.NotNil(t, err)
+			} else {
+				assert.Nil(t, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"time"
+
+	kitlog "github.com/go-kit/log"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/acrlabs/prom2parquet/pkg/parquet"
+	"github.com/acrlabs/prom2parquet/pkg/util"
+)
+
+type backfillOptions struct {
+	tsdbPath string
+	prefix   string
+}
+
+func backfillCmd(opts *options) *cobra.Command {
+	bfOpts := backfillOptions{}
+
+	cmd := &cobra.Command{
+		Use:   "backfill",
+		Short: "Import data from existing Prometheus TSDB blocks into Parquet files",
+		Run: func(_ *cobra.Command, _ []string) {
+			util.SetupLogging(opts.verbosity)
+			if err := backfill(context.Background(), opts, &bfOpts); err != nil {
+				log.Errorf("backfill failed: %v", err)
+				os.Exit(1)
+			}
+		},
+	}
+
+	cmd.Flags().StringVar(
+		&bfOpts.tsdbPath,
+		tsdbFlag,
+		"",
+		"path to the Prometheus TSDB data directory to import",
+	)
+	//nolint:errcheck // this can only fail if the flag doesn't exist
+	cmd.MarkFlagRequired(tsdbFlag)
+
+	cmd.Flags().StringVar(
+		&bfOpts.prefix,
+		prefixFlag,
+		"",
+		fmt.Sprintf("directory prefix for series that don't have a %s label", prefixLabelKey),
+	)
+
+	return cmd
+}
+
+func backfill(ctx context.Context, opts *options, bfOpts *backfillOptions) error {
+	log.Infof("backfilling data from %s", bfOpts.tsdbPath)
+	if err := opts.parseLayout(); err != nil {
+		return err
+	}
+	if err := opts.labelColumns.validate(); err != nil {
+		return fmt.Errorf("invalid label columns config: %w", err)
+	}
+	if opts.labelColumns.mode == parquet.DynamicSchema {
+		log.Warn("dynamic schemas aren't supported for backfilling, only the configured label columns will be used")
+	}
+
+	sandbox, err := os.MkdirTemp("", progname)
+	if err != nil {
+		return fmt.Errorf("could not create sandbox directory: %w", err)
+	}
+	defer os.RemoveAll(sandbox)
+
+	db, err := tsdb.OpenDBReadOnly(bfOpts.tsdbPath, sandbox, kitlog.NewNopLogger())
+	if err != nil {
+		return fmt.Errorf("could not open TSDB at %s: %w", bfOpts.tsdbPath, err)
+	}
+	defer db.Close()
+
+	querier, err := db.Querier(math.MinInt64, math.MaxInt64)
+	if err != nil {
+		return fmt.Errorf("could not create TSDB querier: %w", err)
+	}
+	defer querier.Close()
+
+	bw := parquet.NewBackfillWriter(
+		opts.backendRoot,
+		opts.layout,
+		opts.labelColumns.columns,
+		opts.backend,
+		opts.flushInterval,
+	)
+	// The backfill writer needs all of the series for a metric together, but TSDB only sorts series by __name__ first
+	// if none of their label names sort before it (e.g., by starting with an uppercase letter), so we query each metric
+	// separately
+	metricNames, _, err := querier.LabelValues(ctx, model.MetricNameLabel, nil)
+	if err != nil {
+		return fmt.Errorf("could not read metric names from TSDB: %w", err)
+	}
+
+	numSeries := 0
+	for _, name := range metricNames {
+		matcher := labels.MustNewMatcher(labels.MatchEqual, model.MetricNameLabel, name)
+		mint, maxt, n, err := seriesTimeRange(ctx, querier, matcher)
+		if err != nil {
+			return err
+		}
+		numSeries += n
+
+		// The backfill writer only keeps a limited number of files open, so we import the metric a time range at a
+		// time; each range covers enough flush intervals to fill half of the open files, since every interval can have
+		// a native histogram file as well as a data file
+		window := int64(parquet.BackfillMaxOpenFiles/2) * opts.flushInterval.Milliseconds()
+		for start := time.UnixMilli(mint).UTC().Truncate(opts.flushInterval).UnixMilli(); start <= maxt; start += window {
+			hints := &storage.SelectHints{Start: start, End: start + window - 1}
+			if err := backfillRange(ctx, querier, hints, matcher, bw, bfOpts.prefix); err != nil {
+				return fmt.Errorf("could not backfill %s: %w", name, err)
+			}
+			if err := bw.Close(); err != nil {
+				return fmt.Errorf("could not close files: %w", err)
+			}
+		}
+	}
+
+	if err := bw.Close(); err != nil {
+		return fmt.Errorf("could not close files: %w", err)
+	}
+
+	log.Infof("backfilled %d series into %d files", numSeries, len(bw.Files()))
+	return nil
+}
+
+// seriesTimeRange returns the first and last timestamps of the matching series, along with the number of series that
+// have any data
+func seriesTimeRange(ctx context.Context, querier storage.Querier, matcher *labels.Matcher) (int64, int64, int, error) {
+	mint, maxt, numSeries := int64(math.MaxInt64), int64(math.MinInt64), 0
+
+	ss := querier.Select(ctx, false, nil, matcher)
+	for ss.Next() {
+		it := ss.At().Iterator(nil)
+		if it.Next() == chunkenc.ValNone {
+			continue
+		}
+		numSeries++
+		mint = min(mint, it.AtT())
+		maxt = max(maxt, it.AtT())
+		for it.Next() != chunkenc.ValNone {
+			maxt = max(maxt, it.AtT())
+		}
+		if err := it.Err(); err != nil {
+			return 0, 0, 0, fmt.Errorf("could not iterate over series %s: %w", ss.At().Labels(), err)
+		}
+	}
+	if err := ss.Err(); err != nil {
+		return 0, 0, 0, fmt.Errorf("could not read series for %s from TSDB: %w", matcher.Value, err)
+	}
+	return mint, maxt, numSeries, nil
+}
+
+func backfillRange(
+	ctx context.Context,
+	querier storage.Querier,
+	hints *storage.SelectHints,
+	matcher *labels.Matcher,
+	bw *parquet.BackfillWriter,
+	defaultPrefix string,
+) error {
+	ss := querier.Select(ctx, false, hints, matcher)
+	for ss.Next() {
+		ts, err := timeseriesFromStorageSeries(ss.At())
+		if err != nil {
+			return err
+		}
+
+		prefix, metricName := prefixAndMetricName(ts)
+		if prefix == "" {
+			prefix = defaultPrefix
+		}
+		if err := bw.Write(prefix, metricName, ts); err != nil {
+			return fmt.Errorf("could not write series: %w", err)
+		}
+	}
+	if err := ss.Err(); err != nil {
+		return fmt.Errorf("could not read series from TSDB: %w", err)
+	}
+	return nil
+}
+
+func timeseriesFromStorageSeries(series storage.Series) (prompb.TimeSeries, error) {
+	ts := prompb.TimeSeries{Labels: prompb.FromLabels(series.Labels(), nil)}
+
+	it := series.Iterator(nil)
+	for vt := it.Next(); vt != chunkenc.ValNone; vt = it.Next() {
+		switch vt {
+		case chunkenc.ValFloat:
+			t, v := it.At()
+			ts.Samples = append(ts.Samples, prompb.Sample{Value: v, Timestamp: t})
+		case chunkenc.ValHistogram:
+			t, h := it.AtHistogram(nil)
+			ts.Histograms = append(ts.Histograms, prompb.FromIntHistogram(t, h))
+		case chunkenc.ValFloatHistogram:
+			t, fh := it.AtFloatHistogram(nil)
+			ts.Histograms = append(ts.Histograms, prompb.FromFloatHistogram(t, fh))
+		case chunkenc.ValNone:
+		}
+	}
+	if err := it.Err(); err != nil {
+		return prompb.TimeSeries{}, fmt.Errorf("could not iterate over series %s: %w", series.Labels(), err)
+	}
+
+	return ts, nil
+}
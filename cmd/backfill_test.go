@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	kitlog "github.com/go-kit/log"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/xitongsys/parquet-go-source/mem"
+
+	"github.com/acrlabs/prom2parquet/pkg/backends"
+	"github.com/acrlabs/prom2parquet/pkg/parquet"
+)
+
+func TestBackfill(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	mem.SetInMemFileFs(&fs)
+
+	tsdbPath := t.TempDir()
+	db, err := tsdb.Open(tsdbPath, kitlog.NewNopLogger(), nil, tsdb.DefaultOptions(), nil)
+	assert.Nil(t, err)
+
+	app := db.Appender(context.Background())
+	withPrefix := labels.FromStrings(model.MetricNameLabel, metricName, prefixLabelKey, testPrefix, "pod", "the-pod")
+	// TSDB sorts these series before the first one (since "Zone" sorts before "__name__"), and puts the other metric
+	// in between them
+	upperCase := labels.FromStrings(model.MetricNameLabel, metricName, prefixLabelKey, testPrefix, "Zone", "a")
+	noPrefix := labels.FromStrings(model.MetricNameLabel, "other_metric", "Zone", "b")
+	for _, ts := range []int64{1000, 2000, 61000} {
+		for _, lbls := range []labels.Labels{withPrefix, upperCase, noPrefix} {
+			_, err = app.Append(0, lbls, ts, 1.0)
+			assert.Nil(t, err)
+		}
+	}
+	assert.Nil(t, app.Commit())
+	assert.Nil(t, db.Close())
+
+	opts := &options{backend: backends.Memory, backendRoot: "/test", flushInterval: time.Minute}
+	assert.Nil(t, backfill(context.Background(), opts, &backfillOptions{tsdbPath: tsdbPath, prefix: "default"}))
+
+	files, err := backends.ListFiles(context.Background(), "/test", "", backends.Memory)
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{
+		channelName + "/19700101000000.parquet",
+		channelName + "/19700101000100.parquet",
+		"default/other_metric/19700101000000.parquet",
+		"default/other_metric/19700101000100.parquet",
+	}, files)
+
+	dataFile := channelName + "/19700101000000.parquet"
+	series, err := parquet.ReadSeries(context.Background(), "/test", dataFile, backends.Memory)
+	assert.Nil(t, err)
+	assert.Len(t, series, 2)
+}
+
+func TestBackfillManyFiles(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	mem.SetInMemFileFs(&fs)
+
+	tsdbPath := t.TempDir()
+	db, err := tsdb.Open(tsdbPath, kitlog.NewNopLogger(), nil, tsdb.DefaultOptions(), nil)
+	assert.Nil(t, err)
+
+	// Each series spans more files than the backfill writer keeps open at once, so the second series would need files
+	// that have already been closed if the whole time range were imported together
+	app := db.Appender(context.Background())
+	numFiles := 2 * parquet.BackfillMaxOpenFiles
+	for _, pod := range []string{"pod-a", "pod-b"} {
+		lbls := labels.FromStrings(model.MetricNameLabel, metricName, prefixLabelKey, testPrefix, "pod", pod)
+		for i := range numFiles {
+			_, err = app.Append(0, lbls, int64(i)*1000, 1.0)
+			assert.Nil(t, err)
+		}
+	}
+	assert.Nil(t, app.Commit())
+	assert.Nil(t, db.Close())
+
+	opts := &options{backend: backends.Memory, backendRoot: "/test", flushInterval: time.Second}
+	assert.Nil(t, backfill(context.Background(), opts, &backfillOptions{tsdbPath: tsdbPath}))
+
+	files, err := backends.ListFiles(context.Background(), "/test", "", backends.Memory)
+	assert.Nil(t, err)
+	assert.Len(t, files, numFiles)
+
+	for _, file := range []string{files[0], files[len(files)-1]} {
+		series, err := parquet.ReadSeries(context.Background(), "/test", file, backends.Memory)
+		assert.Nil(t, err)
+		assert.Len(t, series, 2)
+	}
+}
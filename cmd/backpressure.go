@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// How long a request waits for space in a full writer queue before giving up
+	maxQueueWait = time.Second
+
+	queueFullRetryAfter      = 5 * time.Second
+	backendFailureRetryAfter = 30 * time.Second
+)
+
+var (
+	errQueueFull          = errors.New("writer queue is full")
+	errWriterLimit        = errors.New("writer limit reached")
+	errBackendUnavailable = errors.New("storage backend is failing")
+
+	errInvalidPrefix = errors.New("invalid prefix")
+)
+
+// retryableError is returned when a request couldn't be handled right now, but should succeed if the sender retries
+// after a while
+type retryableError struct {
+	err        error
+	retryAfter time.Duration
+}
+
+func (self *retryableError) Error() string {
+	return self.err.Error()
+}
+
+func (self *retryableError) Unwrap() error {
+	return self.err
+}
+
+// writeSendError responds to a remote write (or OTLP) request that couldn't be written.  Prometheus retries 5xx and 429
+// responses and drops the data for any other 4xx response, so data that couldn't be written for any reason other than
+// the request itself being bad has to get one of those.
+func writeSendError(w http.ResponseWriter, err error) {
+	var retryable *retryableError
+	switch {
+	case errors.As(err, &retryable):
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryable.retryAfter.Seconds()))))
+		if errors.Is(err, errBackendUnavailable) {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		} else {
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+		}
+	case errors.Is(err, errInvalidPrefix):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// backendHealth remembers the last time that the writers couldn't create or finish writing a set of files; while the
+// backend is failing, we reject new data so that the senders hold on to it and retry later, instead of handing it to
+// writers that are just going to lose it.
+type backendHealth struct {
+	m           sync.Mutex
+	lastFailure time.Time
+}
+
+func (self *backendHealth) failed(now time.Time) {
+	if self == nil {
+		return
+	}
+
+	self.m.Lock()
+	defer self.m.Unlock()
+	self.lastFailure = now
+}
+
+// check returns an error if the backend has failed recently, saying how long the sender should wait before retrying
+func (self *backendHealth) check(now time.Time) error {
+	if self == nil {
+		return nil
+	}
+
+	self.m.Lock()
+	defer self.m.Unlock()
+
+	if self.lastFailure.IsZero() {
+		return nil
+	}
+	if wait := self.lastFailure.Add(backendFailureRetryAfter).Sub(now); wait > 0 {
+		return &retryableError{err: errBackendUnavailable, retryAfter: wait}
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteSendError(t *testing.T) {
+	cases := map[string]struct {
+		err                error
+		expectedCode       int
+		expectedRetryAfter string
+	}{
+		"queue full": {
+			err:                fmt.Errorf("wrapped: %w", &retryableError{err: errQueueFull, retryAfter: 5 * time.Second}),
+			expectedCode:       http.StatusTooManyRequests,
+			expectedRetryAfter: "5",
+		},
+		"backend failing": {
+			err:                &retryableError{err: errBackendUnavailable, retryAfter: 1500 * time.Millisecond},
+			expectedCode:       http.StatusServiceUnavailable,
+			expectedRetryAfter: "2",
+		},
+		"other error": {
+			err:          errors.New("oops"),
+			expectedCode: http.StatusInternalServerError,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			writeSendError(w, tc.err)
+			assert.Equal(t, tc.expectedCode, w.Code)
+			assert.Equal(t, tc.expectedRetryAfter, w.Header().Get("Retry-After"))
+		})
+	}
+}
+
+func TestBackendHealth(t *testing.T) {
+	now := time.Now()
+	health := &backendHealth{}
+	assert.Nil(t, health.check(now))
+
+	health.failed(now)
+	err := health.check(now.Add(10 * time.Second))
+	assert.ErrorIs(t, err, errBackendUnavailable)
+
+	var retryable *retryableError
+	assert.ErrorAs(t, err, &retryable)
+	assert.Equal(t, backendFailureRetryAfter-10*time.Second, retryable.retryAfter)
+
+	assert.Nil(t, health.check(now.Add(backendFailureRetryAfter)))
+}
+
+func TestMetricWriterQueueFull(t *testing.T) {
+	w := newMetricWriter(make(chan prompb.TimeSeries, 1))
+	sent, err := w.send(context.TODO(), prompb.TimeSeries{})
+	assert.Nil(t, err)
+	assert.True(t, sent)
+
+	sent, err = w.send(context.TODO(), prompb.TimeSeries{})
+	assert.ErrorIs(t, err, errQueueFull)
+	assert.False(t, sent)
+}
+
+func TestSendTimeseriesBackendFailing(t *testing.T) {
+	srv := newServer(&options{})
+	srv.health.failed(time.Now())
+
+	_, _, err := srv.sendTimeseries(context.TODO(), "", []prompb.TimeSeries{{}})
+	assert.ErrorIs(t, err, errBackendUnavailable)
+}
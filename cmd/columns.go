@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/acrlabs/prom2parquet/pkg/parquet"
+)
+
+// labelColumnsConfig holds the labels that are stored in their own columns, which are read from a file like:
+//
+//	default: [pod, container, namespace, node]
+//	metrics:
+//	  - match: .*_bucket
+//	    labels: [le]
+//
+// If the default columns aren't specified, the built-in ones (pod, container, namespace, and node) are used.  With a
+// dynamic schema, these are the first columns in each file, and the writers add columns for any other labels they see.
+type labelColumnsConfig struct {
+	file    string
+	mode    parquet.SchemaMode
+	columns *parquet.LabelColumns
+}
+
+type labelColumnsFile struct {
+	Default *[]string `yaml:"default"`
+	Metrics []struct {
+		Match  string   `yaml:"match"`
+		Labels []string `yaml:"labels"`
+	} `yaml:"metrics"`
+}
+
+// validate loads and checks the label columns from the config file, if there is one; it's also needed for backfilling
+func (self *labelColumnsConfig) validate() error {
+	if self.file == "" && self.mode == parquet.FixedSchema {
+		return nil
+	}
+
+	cfg := labelColumnsFile{}
+	if self.file != "" {
+		contents, err := os.ReadFile(self.file)
+		if err != nil {
+			return fmt.Errorf("can't read label columns file %s: %w", self.file, err)
+		}
+		if err := yaml.Unmarshal(contents, &cfg); err != nil {
+			return fmt.Errorf("can't parse label columns file %s: %w", self.file, err)
+		}
+	}
+
+	defaults := parquet.DefaultLabelColumns()
+	if cfg.Default != nil {
+		defaults = *cfg.Default
+	}
+	rules := make([]parquet.LabelColumnRule, 0, len(cfg.Metrics))
+	for _, m := range cfg.Metrics {
+		rules = append(rules, parquet.LabelColumnRule{Match: m.Match, Labels: m.Labels})
+	}
+
+	columns, err := parquet.NewLabelColumns(self.mode, defaults, rules)
+	if err != nil {
+		return fmt.Errorf("invalid label columns file %s: %w", self.file, err)
+	}
+	self.columns = columns
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/acrlabs/prom2parquet/pkg/parquet"
+)
+
+func TestLabelColumnsConfig(t *testing.T) {
+	cases := map[string]struct {
+		contents        string
+		mode            parquet.SchemaMode
+		expected        []string
+		expectedDynamic bool
+		expectedErr     bool
+	}{
+		"built-in defaults": {
+			contents: "metrics:\n  - match: .*_bucket\n    labels: [le]\n",
+			expected: append(parquet.DefaultLabelColumns(), "le"),
+		},
+		"custom defaults": {
+			contents: "default: [job, instance]\nmetrics:\n  - match: .*_bucket\n    labels: [le]\n",
+			expected: []string{"job", "instance", "le"},
+		},
+		"no defaults": {
+			contents: "default: []\nmetrics:\n  - match: .*_bucket\n    labels: [le]\n",
+			expected: []string{"le"},
+		},
+		"dynamic schema": {
+			contents:        "default: [job]\n",
+			mode:            parquet.DynamicSchema,
+			expected:        []string{"job"},
+			expectedDynamic: true,
+		},
+		"invalid label": {
+			contents:    "default: [timestamp]\n",
+			expectedErr: true,
+		},
+		"invalid yaml": {
+			contents:    "default: {\n",
+			expectedErr: true,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "columns.yaml")
+			assert.Nil(t, os.WriteFile(file, []byte(tc.contents), 0o600))
+
+			cfg := labelColumnsConfig{file: file, mode: tc.mode}
+			err := cfg.validate()
+			if tc.expectedErr {
+				assert.NotNil(t, err)
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, tc.expected, cfg.columns.For("http_request_duration_seconds_bucket"))
+				assert.Equal(t, tc.expectedDynamic, cfg.columns.Dynamic())
+			}
+		})
+	}
+}
+
+func TestLabelColumnsConfigNoFile(t *testing.T) {
+	cfg := labelColumnsConfig{}
+	assert.Nil(t, cfg.validate())
+	assert.Nil(t, cfg.columns)
+
+	cfg = labelColumnsConfig{mode: parquet.DynamicSchema}
+	assert.Nil(t, cfg.validate())
+	assert.True(t, cfg.columns.Dynamic())
+	assert.Equal(t, parquet.DefaultLabelColumns(), cfg.columns.For("kube_node_stuff"))
+}
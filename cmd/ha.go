@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/samber/lo"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultHAClusterLabel    = "cluster"
+	defaultHAReplicaLabel    = "__replica__"
+	defaultHAFailoverTimeout = 30 * time.Second
+)
+
+type haConfig struct {
+	enabled         bool
+	clusterLabel    string
+	replicaLabel    string
+	failoverTimeout time.Duration
+}
+
+func (self haConfig) validate() error {
+	if !self.enabled {
+		return nil
+	}
+
+	if self.clusterLabel == "" || self.replicaLabel == "" {
+		return errors.New("the HA cluster and replica labels must not be empty")
+	} else if self.clusterLabel == self.replicaLabel {
+		return errors.New("the HA cluster and replica labels must be different")
+	} else if self.failoverTimeout <= 0 {
+		return errors.New("the HA failover timeout must be positive")
+	}
+	return nil
+}
+
+type haReplica struct {
+	name     string
+	lastSeen time.Time
+}
+
+// haTracker deduplicates data from Prometheus HA pairs, in the same way that Cortex's HA tracker does: for each
+// cluster, one replica is elected, and data from all the other replicas in that cluster is dropped.  If we don't hear
+// from the elected replica for longer than the failover timeout, the next replica we hear from is elected instead.
+// Series that don't have both a cluster and a replica label are always accepted.  A nil haTracker accepts everything.
+type haTracker struct {
+	cfg   haConfig
+	clock clockwork.Clock
+
+	m       sync.Mutex
+	elected map[string]*haReplica
+}
+
+func newHATracker(cfg haConfig) *haTracker {
+	if !cfg.enabled {
+		return nil
+	}
+
+	return &haTracker{
+		cfg:     cfg,
+		clock:   clockwork.NewRealClock(),
+		elected: map[string]*haReplica{},
+	}
+}
+
+// filter returns the series that should be written, with the replica label removed so that the data from different
+// replicas ends up in the same rows
+func (self *haTracker) filter(tenant string, timeserieses []prompb.TimeSeries) []prompb.TimeSeries {
+	if self == nil {
+		return timeserieses
+	}
+
+	self.m.Lock()
+	defer self.m.Unlock()
+
+	now := self.clock.Now()
+	accepted := make([]prompb.TimeSeries, 0, len(timeserieses))
+	for _, ts := range timeserieses {
+		cluster, hasCluster := lo.Find(ts.Labels, func(l prompb.Label) bool { return l.Name == self.cfg.clusterLabel })
+		replica, hasReplica := lo.Find(ts.Labels, func(l prompb.Label) bool { return l.Name == self.cfg.replicaLabel })
+		if hasCluster && hasReplica && !self.accept(tenant, cluster.Value, replica.Value, now) {
+			continue
+		}
+
+		if hasReplica {
+			ts.Labels = lo.Filter(ts.Labels, func(l prompb.Label, _ int) bool { return l.Name != self.cfg.replicaLabel })
+		}
+		accepted = append(accepted, ts)
+	}
+
+	if dropped := len(timeserieses) - len(accepted); dropped > 0 {
+		log.Debugf("dropped %d series from non-elected HA replicas", dropped)
+	}
+	return accepted
+}
+
+// accept checks (and updates) the elected replica for the cluster; the caller must hold the lock
+func (self *haTracker) accept(tenant, cluster, replica string, now time.Time) bool {
+	key := tenant + "/" + cluster
+	elected, ok := self.elected[key]
+	switch {
+	case !ok:
+		log.Infof("electing replica %s for HA cluster %s", replica, key)
+		self.elected[key] = &haReplica{name: replica, lastSeen: now}
+		return true
+
+	case elected.name == replica:
+		elected.lastSeen = now
+		return true
+
+	case now.Sub(elected.lastSeen) > self.cfg.failoverTimeout:
+		log.Infof(
+			"haven't heard from replica %s for HA cluster %s since %s, failing over to %s",
+			elected.name,
+			key,
+			elected.lastSeen,
+			replica,
+		)
+		self.elected[key] = &haReplica{name: replica, lastSeen: now}
+		return true
+	}
+
+	return false
+}
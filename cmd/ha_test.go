@@ -0,0 +1,103 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+)
+
+func haTimeseries(cluster, replica string) prompb.TimeSeries {
+	lbls := []prompb.Label{{Name: model.MetricNameLabel, Value: metricName}}
+	if cluster != "" {
+		lbls = append(lbls, prompb.Label{Name: defaultHAClusterLabel, Value: cluster})
+	}
+	if replica != "" {
+		lbls = append(lbls, prompb.Label{Name: defaultHAReplicaLabel, Value: replica})
+	}
+	return prompb.TimeSeries{Labels: lbls, Samples: []prompb.Sample{{Value: 1.0}}}
+}
+
+func TestHATrackerFilter(t *testing.T) {
+	type step struct {
+		advance  time.Duration
+		tenant   string
+		cluster  string
+		replica  string
+		accepted bool
+	}
+
+	cases := map[string]struct {
+		steps []step
+	}{
+		"elect first replica": {
+			steps: []step{
+				{cluster: "c1", replica: "a", accepted: true},
+				{cluster: "c1", replica: "b", accepted: false},
+				{advance: 10 * time.Second, cluster: "c1", replica: "a", accepted: true},
+				{advance: 10 * time.Second, cluster: "c1", replica: "b", accepted: false},
+			},
+		},
+		"failover": {
+			steps: []step{
+				{cluster: "c1", replica: "a", accepted: true},
+				{advance: 31 * time.Second, cluster: "c1", replica: "b", accepted: true},
+				{cluster: "c1", replica: "a", accepted: false},
+			},
+		},
+		"clusters are independent": {
+			steps: []step{
+				{cluster: "c1", replica: "a", accepted: true},
+				{cluster: "c2", replica: "b", accepted: true},
+				{cluster: "c2", replica: "a", accepted: false},
+			},
+		},
+		"tenants are independent": {
+			steps: []step{
+				{tenant: "t1", cluster: "c1", replica: "a", accepted: true},
+				{tenant: "t2", cluster: "c1", replica: "b", accepted: true},
+			},
+		},
+		"missing labels": {
+			steps: []step{
+				{cluster: "c1", replica: "a", accepted: true},
+				{cluster: "c1", accepted: true},
+				{replica: "b", accepted: true},
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			cl := clockwork.NewFakeClock()
+			tracker := newHATracker(haConfig{
+				enabled:         true,
+				clusterLabel:    defaultHAClusterLabel,
+				replicaLabel:    defaultHAReplicaLabel,
+				failoverTimeout: defaultHAFailoverTimeout,
+			})
+			tracker.clock = cl
+
+			for i, s := range tc.steps {
+				cl.Advance(s.advance)
+				res := tracker.filter(s.tenant, []prompb.TimeSeries{haTimeseries(s.cluster, s.replica)})
+				if !s.accepted {
+					assert.Empty(t, res, "step %d", i)
+					continue
+				}
+
+				assert.Len(t, res, 1, "step %d", i)
+				assert.Equal(t, haTimeseries(s.cluster, ""), res[0], "step %d", i)
+			}
+		})
+	}
+}
+
+func TestHATrackerDisabled(t *testing.T) {
+	tracker := newHATracker(haConfig{})
+	timeserieses := []prompb.TimeSeries{haTimeseries("c1", "a"), haTimeseries("c1", "b")}
+	assert.Equal(t, timeserieses, tracker.filter("", timeserieses))
+}
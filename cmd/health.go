@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/acrlabs/prom2parquet/pkg/backends"
+)
+
+const (
+	backendCheckInterval = 30 * time.Second
+	backendCheckTimeout  = 10 * time.Second
+
+	replayRetryAfter = 5 * time.Second
+)
+
+var errBackendNotChecked = errors.New("the storage backend hasn't been checked yet")
+
+// readiness tracks everything that determines whether the server should receive traffic: whether the storage backend
+// is reachable, whether we're still replaying the WAL, and whether we're shutting down.
+type readiness struct {
+	replaying    atomic.Bool
+	shuttingDown atomic.Bool
+
+	m          sync.Mutex
+	backendErr error
+}
+
+func newReadiness() *readiness {
+	return &readiness{backendErr: errBackendNotChecked}
+}
+
+func (self *readiness) setBackendErr(err error) {
+	self.m.Lock()
+	defer self.m.Unlock()
+	self.backendErr = err
+}
+
+func (self *readiness) check() error {
+	if self.shuttingDown.Load() {
+		return errors.New("shutting down")
+	} else if self.replaying.Load() {
+		return errors.New("replaying the WAL")
+	}
+
+	self.m.Lock()
+	defer self.m.Unlock()
+	return self.backendErr
+}
+
+// checkBackend makes sure that the storage backend is reachable, and records the result for the readiness check
+func (self *promserver) checkBackend(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, backendCheckTimeout)
+	defer cancel()
+
+	err := backends.Check(ctx, self.opts.backendRoot, self.opts.backend)
+	if err != nil {
+		log.Errorf("storage backend check failed: %v", err)
+		err = fmt.Errorf("storage backend is unreachable: %w", err)
+	}
+	self.readiness.setBackendErr(err)
+}
+
+func (self *promserver) runBackendChecks(stop <-chan struct{}) {
+	ticker := time.NewTicker(backendCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		self.checkBackend(context.Background())
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (self *promserver) healthy(w http.ResponseWriter, _ *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write([]byte("prom2parquet is healthy\n")); err != nil {
+		log.Errorf("could not write health check response: %v", err)
+	}
+}
+
+// ready reports whether the server can accept data; besides the backend and WAL checks, it also fails as soon as we
+// start shutting down, so that Kubernetes stops sending us traffic before the writers are closed.
+func (self *promserver) ready(w http.ResponseWriter, _ *http.Request) {
+	// Writes that failed recently also mean that the backend isn't working, even if the last check succeeded
+	err := self.readiness.check()
+	if err == nil {
+		err = self.health.check(time.Now())
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("prom2parquet is not ready: %v", err), http.StatusServiceUnavailable)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write([]byte("prom2parquet is ready\n")); err != nil {
+		log.Errorf("could not write readiness check response: %v", err)
+	}
+}
+
+// acceptingData rejects incoming data while the WAL is being replayed, since it couldn't be logged to the WAL yet
+func (self *promserver) acceptingData(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if self.readiness.replaying.Load() {
+			w.Header().Set("Retry-After", strconv.Itoa(int(replayRetryAfter.Seconds())))
+			http.Error(w, "replaying the WAL", http.StatusServiceUnavailable)
+			return
+		}
+		handler(w, req)
+	}
+}
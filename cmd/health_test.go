@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/acrlabs/prom2parquet/pkg/backends"
+)
+
+func TestReady(t *testing.T) {
+	cases := map[string]struct {
+		setup        func(*promserver)
+		expectedCode int
+	}{
+		"backend not checked": {
+			setup:        func(*promserver) {},
+			expectedCode: http.StatusServiceUnavailable,
+		},
+		"ready": {
+			setup:        func(s *promserver) { s.checkBackend(context.TODO()) },
+			expectedCode: http.StatusOK,
+		},
+		"replaying": {
+			setup: func(s *promserver) {
+				s.checkBackend(context.TODO())
+				s.readiness.replaying.Store(true)
+			},
+			expectedCode: http.StatusServiceUnavailable,
+		},
+		"shutting down": {
+			setup: func(s *promserver) {
+				s.checkBackend(context.TODO())
+				s.readiness.shuttingDown.Store(true)
+			},
+			expectedCode: http.StatusServiceUnavailable,
+		},
+		"writes failing": {
+			setup: func(s *promserver) {
+				s.checkBackend(context.TODO())
+				s.health.failed(time.Now())
+			},
+			expectedCode: http.StatusServiceUnavailable,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			srv := newServer(&options{backend: backends.Memory})
+			tc.setup(srv)
+
+			for path, expectedCode := range map[string]int{"/-/healthy": http.StatusOK, "/-/ready": tc.expectedCode} {
+				w := httptest.NewRecorder()
+				srv.httpserv.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+				assert.Equal(t, expectedCode, w.Code, path)
+			}
+		})
+	}
+}
+
+func TestCheckBackendLocal(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "data")
+	srv := newServer(&options{backend: backends.Local, backendRoot: root})
+
+	srv.checkBackend(context.TODO())
+	assert.Nil(t, srv.readiness.check())
+	entries, err := os.ReadDir(root)
+	assert.Nil(t, err)
+	assert.Empty(t, entries)
+
+	// A regular file where the root directory should be
+	assert.Nil(t, os.RemoveAll(root))
+	assert.Nil(t, os.WriteFile(root, []byte{}, 0o600))
+	srv.checkBackend(context.TODO())
+	assert.NotNil(t, srv.readiness.check())
+}
+
+func TestAcceptingDataReplaying(t *testing.T) {
+	srv := newServer(&options{})
+	srv.readiness.replaying.Store(true)
+
+	w := httptest.NewRecorder()
+	srv.httpserv.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/receive", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "5", w.Header().Get("Retry-After"))
+}
+
+func TestShutdownDelayValidate(t *testing.T) {
+	opts := options{shutdownDelay: shutdownTime - time.Second}
+	assert.Nil(t, opts.validate())
+
+	// The delay counts against the shutdown timeout, so it has to leave some time for flushing the files
+	opts.shutdownDelay = shutdownTime
+	assert.ErrorContains(t, opts.validate(), "shutdown timeout")
+}
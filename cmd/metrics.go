@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	dropReasonHA      = "ha_replica"
+	dropReasonRelabel = "relabel"
+	dropReasonPrefix  = "invalid_prefix"
+
+	rejectReasonQueueFull   = "queue_full"
+	rejectReasonWriterLimit = "writer_limit"
+	rejectReasonBackend     = "backend_unavailable"
+	rejectReasonError       = "error"
+)
+
+// serverMetrics are the metrics for the receive path; the writers report their own metrics (see parquet.Metrics).  All
+// of the metrics are registered with the server's own registry, which is served on /metrics.
+type serverMetrics struct {
+	registry *prometheus.Registry
+
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	received        *prometheus.CounterVec
+	dropped         *prometheus.CounterVec
+	rejected        *prometheus.CounterVec
+}
+
+func newServerMetrics(s *promserver) *serverMetrics {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	factory := promauto.With(reg)
+
+	factory.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "prom2parquet_open_writers",
+		Help: "Number of metric writers that are currently open",
+	}, func() float64 {
+		s.m.RLock()
+		defer s.m.RUnlock()
+		return float64(len(s.writers))
+	})
+	factory.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "prom2parquet_writer_queued_timeseries",
+		Help: "Number of timeseries waiting in the writer queues",
+	}, func() float64 {
+		s.m.RLock()
+		defer s.m.RUnlock()
+
+		queued := 0
+		for _, w := range s.writers {
+			queued += len(w.ch)
+		}
+		return float64(queued)
+	})
+	factory.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "prom2parquet_open_file_sets",
+		Help: "Number of sets of parquet files that are open or still being finalized",
+	}, func() float64 {
+		return float64(s.tracker.numOpen())
+	})
+
+	return &serverMetrics{
+		registry: reg,
+
+		requests: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "prom2parquet_http_requests_total",
+			Help: "Number of HTTP requests handled, by handler and status code",
+		}, []string{"handler", "code"}),
+		requestDuration: factory.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "prom2parquet_http_request_duration_seconds",
+			Help:    "Time taken to handle HTTP requests, by handler",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"handler"}),
+		received: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "prom2parquet_received_total",
+			Help: "Number of samples, histograms, and exemplars received",
+		}, []string{"kind"}),
+		dropped: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "prom2parquet_dropped_samples_total",
+			Help: "Number of samples that were received but intentionally not written, by reason",
+		}, []string{"reason"}),
+		rejected: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "prom2parquet_rejected_samples_total",
+			Help: "Number of samples in requests that failed and need to be retried by the sender, by reason",
+		}, []string{"reason"}),
+	}
+}
+
+func (self *serverMetrics) handler() http.Handler {
+	return promhttp.HandlerFor(self.registry, promhttp.HandlerOpts{Registry: self.registry})
+}
+
+// instrument records the number of requests and the request duration for the handler
+func (self *serverMetrics) instrument(name string, handler http.HandlerFunc) http.HandlerFunc {
+	labels := prometheus.Labels{"handler": name}
+	return promhttp.InstrumentHandlerDuration(
+		self.requestDuration.MustCurryWith(labels),
+		promhttp.InstrumentHandlerCounter(self.requests.MustCurryWith(labels), handler),
+	).ServeHTTP
+}
+
+func (self *serverMetrics) observeReceived(stats writeStats) {
+	self.received.WithLabelValues("sample").Add(float64(stats.samples))
+	self.received.WithLabelValues("histogram").Add(float64(stats.histograms))
+	self.received.WithLabelValues("exemplar").Add(float64(stats.exemplars))
+}
+
+func (self *serverMetrics) observeDropped(reason string, samples int) {
+	self.dropped.WithLabelValues(reason).Add(float64(samples))
+}
+
+// observeRejected records the samples that weren't written because of an error from sendTimeseries
+func (self *serverMetrics) observeRejected(err error, samples int) {
+	reason := rejectReasonError
+	switch {
+	case errors.Is(err, errQueueFull):
+		reason = rejectReasonQueueFull
+	case errors.Is(err, errWriterLimit):
+		reason = rejectReasonWriterLimit
+	case errors.Is(err, errBackendUnavailable):
+		reason = rejectReasonBackend
+	}
+	self.rejected.WithLabelValues(reason).Add(float64(samples))
+}
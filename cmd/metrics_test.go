@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsEndpoint(t *testing.T) {
+	srv := newServer(&options{})
+	srv.writers[channelName] = newMetricWriter(make(chan prompb.TimeSeries, 2))
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	w := httptest.NewRecorder()
+	srv.httpserv.Handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "prom2parquet_open_writers 1")
+	assert.Contains(t, w.Body.String(), "go_goroutines")
+}
+
+func TestSendTimeseriesMetrics(t *testing.T) {
+	rules, err := loadRelabelConfigs(writeRelabelConfig(t, testRelabelConfig))
+	assert.Nil(t, err)
+
+	srv := newServer(&options{relabel: relabelConfig{rules: rules}})
+	srv.writers[channelName] = newMetricWriter(make(chan prompb.TimeSeries, 1))
+
+	timeserieses := []prompb.TimeSeries{
+		{
+			Labels: []prompb.Label{
+				{Name: model.MetricNameLabel, Value: "noisy_metric"},
+				{Name: prefixLabelKey, Value: testPrefix},
+			},
+			Samples: []prompb.Sample{{Value: 1.0}},
+		},
+		{
+			Labels: []prompb.Label{
+				{Name: model.MetricNameLabel, Value: metricName},
+				{Name: prefixLabelKey, Value: testPrefix},
+			},
+			Samples: []prompb.Sample{{Value: 1.0}, {Value: 2.0, Timestamp: 1}},
+		},
+	}
+	_, _, err = srv.sendTimeseries(context.TODO(), "", srv.acceptTimeseries("", timeserieses))
+	assert.Nil(t, err)
+	assert.Equal(t, 3.0, testutil.ToFloat64(srv.metrics.received.WithLabelValues("sample")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(srv.metrics.dropped.WithLabelValues(dropReasonRelabel)))
+
+	srv.health.failed(time.Now())
+	_, _, err = srv.sendTimeseries(context.TODO(), "", timeserieses)
+	assert.NotNil(t, err)
+	assert.Equal(t, 3.0, testutil.ToFloat64(srv.metrics.rejected.WithLabelValues(rejectReasonBackend)))
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/storage/remote"
+	otlpprom "github.com/prometheus/prometheus/storage/remote/otlptranslator/prometheus"
+	otlptranslator "github.com/prometheus/prometheus/storage/remote/otlptranslator/prometheusremotewrite"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/pmetric"
+	"go.opentelemetry.io/collector/pdata/pmetric/pmetricotlp"
+)
+
+const jsonContentType = "application/json"
+
+// OTLP resource attributes that map onto the columns we extract from Prometheus labels; all other resource attributes
+// are normalized the same way that Prometheus normalizes OTLP attribute names (e.g., `cloud.region` -> `cloud_region`).
+// Note that this means a `prom2parquet.prefix` resource attribute can be used to set the prefix.
+//
+//nolint:gochecknoglobals
+var otlpResourceLabels = map[string]string{
+	"k8s.pod.name":       "pod",
+	"k8s.namespace.name": "namespace",
+	"k8s.container.name": "container",
+	"k8s.node.name":      "node",
+}
+
+func (self *promserver) otlpReceive(w http.ResponseWriter, req *http.Request) {
+	tenant, err := self.tenantFromRequest(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Prometheus' decoder only accepts the bare media types, so we strip any parameters (e.g., the charset) first
+	mediaType := req.Header.Get("Content-Type")
+	if parsed, _, err := mime.ParseMediaType(mediaType); err == nil {
+		mediaType = parsed
+		req.Header.Set("Content-Type", mediaType)
+	}
+
+	otlpReq, err := remote.DecodeOTLPWriteRequest(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	timeserieses := timeseriesFromOTLP(otlpReq.Metrics())
+	if err := self.overridePrefix(req, timeserieses); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	timeserieses = self.acceptTimeseries(tenant, timeserieses)
+
+	walDone, err := self.logToWAL(tenant, timeserieses)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer walDone()
+
+	if _, _, err := self.sendTimeseries(req.Context(), tenant, timeserieses); err != nil {
+		writeSendError(w, err)
+		return
+	}
+
+	writeOTLPResponse(w, mediaType)
+}
+
+// timeseriesFromOTLP converts OTLP metrics into Prometheus timeseries, using the same translation rules that
+// Prometheus' own OTLP receiver uses.  Unlike Prometheus, we attach the resource attributes to every series as labels
+// instead of putting them in a separate `target_info` metric, so that they end up in the same parquet files as the
+// data.
+func timeseriesFromOTLP(md pmetric.Metrics) []prompb.TimeSeries {
+	timeserieses := []prompb.TimeSeries{}
+	resourceMetricsSlice := md.ResourceMetrics()
+	for i := 0; i < resourceMetricsSlice.Len(); i++ {
+		resourceMetrics := resourceMetricsSlice.At(i)
+
+		single := pmetric.NewMetrics()
+		resourceMetrics.CopyTo(single.ResourceMetrics().AppendEmpty())
+
+		converter := otlptranslator.NewPrometheusConverter()
+		if err := converter.FromMetrics(single, otlptranslator.Settings{
+			ExternalLabels:    resourceLabels(resourceMetrics.Resource()),
+			DisableTargetInfo: true,
+			AddMetricSuffixes: true,
+		}); err != nil {
+			// Errors here are for individual metrics that couldn't be translated; the rest are still usable
+			log.Warnf("could not translate some OTLP metrics: %v", err)
+		}
+		timeserieses = append(timeserieses, converter.TimeSeries()...)
+	}
+
+	return timeserieses
+}
+
+func resourceLabels(resource pcommon.Resource) map[string]string {
+	lbls := map[string]string{}
+	resource.Attributes().Range(func(key string, value pcommon.Value) bool {
+		name, ok := otlpResourceLabels[key]
+		if !ok {
+			name = otlpprom.NormalizeLabel(key)
+		}
+		lbls[name] = value.AsString()
+		return true
+	})
+	return lbls
+}
+
+// writeOTLPResponse writes an (empty) OTLP export response, encoded the same way as the request; mediaType is the
+// request's media type, without any parameters.
+func writeOTLPResponse(w http.ResponseWriter, mediaType string) {
+	resp := pmetricotlp.NewExportResponse()
+
+	var body []byte
+	var err error
+	contentType := protobufContentType
+	if mediaType == jsonContentType {
+		contentType = jsonContentType
+		body, err = resp.MarshalJSON()
+	} else {
+		body, err = resp.MarshalProto()
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("could not marshal OTLP response: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(body); err != nil {
+		log.Errorf("could not write OTLP response: %v", err)
+	}
+}
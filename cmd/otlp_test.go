@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/pmetric"
+	"go.opentelemetry.io/collector/pdata/pmetric/pmetricotlp"
+)
+
+func TestTimeseriesFromOTLP(t *testing.T) {
+	md := pmetric.NewMetrics()
+	rm := md.ResourceMetrics().AppendEmpty()
+	rm.Resource().Attributes().PutStr("service.name", "the-service")
+	rm.Resource().Attributes().PutStr("k8s.pod.name", "the-pod")
+	rm.Resource().Attributes().PutStr("prom2parquet.prefix", testPrefix)
+	rm.Resource().Attributes().PutStr("cloud.region", "us-west-2")
+
+	ts := pcommon.NewTimestampFromTime(time.UnixMilli(1000))
+	metrics := rm.ScopeMetrics().AppendEmpty().Metrics()
+
+	gauge := metrics.AppendEmpty()
+	gauge.SetName("memory.usage")
+	gauge.SetUnit("By")
+	dp := gauge.SetEmptyGauge().DataPoints().AppendEmpty()
+	dp.SetTimestamp(ts)
+	dp.SetDoubleValue(42.0)
+
+	sum := metrics.AppendEmpty()
+	sum.SetName("requests")
+	sum.SetEmptySum().SetIsMonotonic(true)
+	sum.Sum().SetAggregationTemporality(pmetric.AggregationTemporalityCumulative)
+	dp = sum.Sum().DataPoints().AppendEmpty()
+	dp.SetTimestamp(ts)
+	dp.SetIntValue(7)
+	dp.Attributes().PutStr("method", "GET")
+
+	hist := metrics.AppendEmpty()
+	hist.SetName("latency")
+	hist.SetEmptyHistogram().SetAggregationTemporality(pmetric.AggregationTemporalityCumulative)
+	hdp := hist.Histogram().DataPoints().AppendEmpty()
+	hdp.SetTimestamp(ts)
+	hdp.SetCount(3)
+	hdp.SetSum(1.5)
+	hdp.ExplicitBounds().FromRaw([]float64{1.0})
+	hdp.BucketCounts().FromRaw([]uint64{2, 1})
+
+	timeserieses := timeseriesFromOTLP(md)
+
+	names := lo.Map(timeserieses, func(ts prompb.TimeSeries, _ int) string {
+		_, name := prefixAndMetricName(ts)
+		return name
+	})
+	assert.ElementsMatch(t, []string{
+		"memory_usage_bytes",
+		"requests_total",
+		"latency_bucket",
+		"latency_bucket",
+		"latency_count",
+		"latency_sum",
+	}, names)
+
+	for _, ts := range timeserieses {
+		prefix, _ := prefixAndMetricName(ts)
+		assert.Equal(t, testPrefix, prefix)
+		assert.Contains(t, ts.Labels, prompb.Label{Name: "pod", Value: "the-pod"})
+		assert.Contains(t, ts.Labels, prompb.Label{Name: "cloud_region", Value: "us-west-2"})
+		assert.Contains(t, ts.Labels, prompb.Label{Name: model.JobLabel, Value: "the-service"})
+	}
+
+	requests, _ := lo.Find(timeserieses, func(ts prompb.TimeSeries) bool {
+		_, name := prefixAndMetricName(ts)
+		return name == "requests_total"
+	})
+	assert.Contains(t, requests.Labels, prompb.Label{Name: "method", Value: "GET"})
+	assert.Equal(t, []prompb.Sample{{Value: 7, Timestamp: 1000}}, requests.Samples)
+}
+
+func TestOTLPReceiveContentType(t *testing.T) {
+	body, err := pmetricotlp.NewExportRequestFromMetrics(pmetric.NewMetrics()).MarshalJSON()
+	assert.Nil(t, err)
+
+	cases := map[string]struct {
+		contentType         string
+		expectedContentType string
+	}{
+		"json":              {contentType: jsonContentType, expectedContentType: jsonContentType},
+		"json with charset": {contentType: "application/json; charset=utf-8", expectedContentType: jsonContentType},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			srv := newServer(&options{})
+			req := httptest.NewRequest(http.MethodPost, "/v1/metrics", bytes.NewReader(body))
+			req.Header.Set("Content-Type", tc.contentType)
+			w := httptest.NewRecorder()
+
+			srv.otlpReceive(w, req)
+			assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+			assert.Equal(t, tc.expectedContentType, w.Header().Get("Content-Type"))
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/relabel"
+	"github.com/prometheus/prometheus/prompb"
+	"gopkg.in/yaml.v3"
+)
+
+// relabelConfig holds the relabeling rules, which are read from a file in the same format as a Prometheus scrape
+// config's metric relabeling section:
+//
+//	metric_relabel_configs:
+//	  - action: labeldrop
+//	    regex: pod_template_hash
+type relabelConfig struct {
+	file  string
+	rules []*relabel.Config
+}
+
+// validate loads and checks the relabeling rules from the config file, if there is one
+func (self *relabelConfig) validate() error {
+	if self.file == "" {
+		return nil
+	}
+
+	rules, err := loadRelabelConfigs(self.file)
+	if err != nil {
+		return err
+	}
+	self.rules = rules
+	return nil
+}
+
+func loadRelabelConfigs(file string) ([]*relabel.Config, error) {
+	contents, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("can't read relabel config file %s: %w", file, err)
+	}
+
+	cfg := struct {
+		MetricRelabelConfigs []*relabel.Config `yaml:"metric_relabel_configs"`
+	}{}
+	if err := yaml.Unmarshal(contents, &cfg); err != nil {
+		return nil, fmt.Errorf("can't parse relabel config file %s: %w", file, err)
+	}
+
+	for i, rule := range cfg.MetricRelabelConfigs {
+		if rule == nil {
+			return nil, fmt.Errorf("empty relabel rule %d in %s", i, file)
+		}
+		if err := rule.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid relabel rule %d in %s: %w", i, file, err)
+		}
+	}
+	return cfg.MetricRelabelConfigs, nil
+}
+
+// relabelTimeseries applies the relabeling rules to a timeseries, using the same semantics as Prometheus' metric
+// relabeling; it returns false if the series should be dropped.
+func relabelTimeseries(ts prompb.TimeSeries, rules []*relabel.Config) (prompb.TimeSeries, bool) {
+	if len(rules) == 0 {
+		return ts, true
+	}
+
+	b := labels.NewScratchBuilder(len(ts.Labels))
+	lbls, keep := relabel.Process(ts.ToLabels(&b, nil), rules...)
+	if !keep || lbls.IsEmpty() {
+		return prompb.TimeSeries{}, false
+	}
+
+	ts.Labels = prompb.FromLabels(lbls, nil)
+	return ts, true
+}
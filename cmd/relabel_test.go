@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/acrlabs/prom2parquet/pkg/backends"
+)
+
+const testRelabelConfig = `
+metric_relabel_configs:
+  - action: drop
+    source_labels: [__name__]
+    regex: noisy_.*
+  - action: labeldrop
+    regex: pod_template_hash
+  - action: replace
+    source_labels: [kubernetes_pod_name]
+    target_label: pod
+  - action: labeldrop
+    regex: kubernetes_pod_name
+`
+
+func writeRelabelConfig(t *testing.T, contents string) string {
+	file := filepath.Join(t.TempDir(), "relabel.yaml")
+	assert.Nil(t, os.WriteFile(file, []byte(contents), 0o600))
+	return file
+}
+
+func TestLoadRelabelConfigs(t *testing.T) {
+	cases := map[string]struct {
+		contents      string
+		expectedRules int
+		expectedErr   bool
+	}{
+		"valid":          {contents: testRelabelConfig, expectedRules: 4},
+		"empty":          {contents: "", expectedRules: 0},
+		"invalid action": {contents: "metric_relabel_configs:\n  - action: explode\n", expectedErr: true},
+		"invalid regex":  {contents: "metric_relabel_configs:\n  - action: drop\n    regex: '('\n", expectedErr: true},
+		"missing target": {contents: "metric_relabel_configs:\n  - action: hashmod\n    modulus: 2\n", expectedErr: true},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			rules, err := loadRelabelConfigs(writeRelabelConfig(t, tc.contents))
+			if tc.expectedErr {
+				assert.NotNil(t, err)
+			} else {
+				assert.Nil(t, err)
+				assert.Len(t, rules, tc.expectedRules)
+			}
+		})
+	}
+}
+
+func TestRelabelTimeseries(t *testing.T) {
+	rules, err := loadRelabelConfigs(writeRelabelConfig(t, testRelabelConfig))
+	assert.Nil(t, err)
+
+	cases := map[string]struct {
+		labels         []prompb.Label
+		expectedLabels []prompb.Label
+		expectedKeep   bool
+	}{
+		"dropped": {
+			labels:       []prompb.Label{{Name: model.MetricNameLabel, Value: "noisy_metric"}},
+			expectedKeep: false,
+		},
+		"relabeled": {
+			labels: []prompb.Label{
+				{Name: model.MetricNameLabel, Value: metricName},
+				{Name: "pod_template_hash", Value: "abcd1234"},
+				{Name: "kubernetes_pod_name", Value: "the-pod"},
+			},
+			expectedLabels: []prompb.Label{
+				{Name: model.MetricNameLabel, Value: metricName},
+				{Name: "pod", Value: "the-pod"},
+			},
+			expectedKeep: true,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			res, keep := relabelTimeseries(prompb.TimeSeries{Labels: tc.labels}, rules)
+			assert.Equal(t, tc.expectedKeep, keep)
+			if keep {
+				assert.Equal(t, tc.expectedLabels, res.Labels)
+			}
+		})
+	}
+}
+
+func TestSendTimeseriesRelabel(t *testing.T) {
+	rules, err := loadRelabelConfigs(writeRelabelConfig(t, testRelabelConfig))
+	assert.Nil(t, err)
+
+	srv := newServer(&options{relabel: relabelConfig{rules: rules}})
+	srv.writers["/"+metricName] = newMetricWriter(make(chan prompb.TimeSeries, 1))
+
+	stats, _, err := srv.sendTimeseries(context.TODO(), "", []prompb.TimeSeries{
+		{
+			Labels:  []prompb.Label{{Name: model.MetricNameLabel, Value: "noisy_metric"}},
+			Samples: []prompb.Sample{{Value: 1.0}},
+		},
+		{
+			Labels: []prompb.Label{
+				{Name: model.MetricNameLabel, Value: metricName},
+				{Name: "pod_template_hash", Value: "abcd1234"},
+			},
+			Samples: []prompb.Sample{{Value: 2.0}},
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, writeStats{samples: 1}, stats)
+
+	ts := <-srv.writers["/"+metricName].ch
+	assert.Equal(t, []prompb.Label{{Name: model.MetricNameLabel, Value: metricName}}, ts.Labels)
+}
+
+func TestSendTimeseriesRelabelMetadata(t *testing.T) {
+	rules, err := loadRelabelConfigs(writeRelabelConfig(t, `
+metric_relabel_configs:
+  - action: replace
+    source_labels: [__name__]
+    target_label: __name__
+    regex: old_(.*)
+    replacement: $1
+  - action: replace
+    target_label: prom2parquet_prefix
+    replacement: `+testPrefix+`
+`))
+	assert.Nil(t, err)
+
+	srv := newServer(&options{backend: backends.Memory, relabel: relabelConfig{rules: rules}})
+	srv.writers[channelName] = newMetricWriter(make(chan prompb.TimeSeries, 1))
+
+	_, routed, err := srv.sendTimeseries(context.TODO(), "", []prompb.TimeSeries{{
+		Labels: []prompb.Label{
+			{Name: model.MetricNameLabel, Value: "old_" + metricName},
+			{Name: prefixLabelKey, Value: "old-prefix"},
+		},
+		Samples: []prompb.Sample{{Value: 1.0}},
+	}})
+	assert.Nil(t, err)
+
+	srv.recordMetadata("", routed, []prompb.MetricMetadata{
+		{Type: prompb.MetricMetadata_GAUGE, MetricFamilyName: metricName},
+		{Type: prompb.MetricMetadata_GAUGE, MetricFamilyName: "old_" + metricName},
+	})
+	assert.Nil(t, srv.sidecars.wait(context.TODO()))
+
+	_, ok := srv.metadata.Get(testPrefix, metricName)
+	assert.True(t, ok)
+	_, ok = srv.metadata.Get(testPrefix, "old_"+metricName)
+	assert.False(t, ok)
+	_, ok = srv.metadata.Get("old-prefix", "old_"+metricName)
+	assert.False(t, ok)
+}
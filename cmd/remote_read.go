@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/storage/remote"
+	"github.com/samber/lo"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/acrlabs/prom2parquet/pkg/backends"
+	"github.com/acrlabs/prom2parquet/pkg/parquet"
+)
+
+const (
+	streamedContentType = "application/x-streamed-protobuf; proto=prometheus.ChunkedReadResponse"
+
+	// This is the same default that Prometheus uses
+	maxBytesInFrame = 1024 * 1024
+)
+
+func (self *promserver) remoteRead(w http.ResponseWriter, req *http.Request) {
+	// We find the data for a query by parsing the paths of the data files, which we can only do for the default layout
+	if self.opts.customLayout() {
+		http.Error(w, "remote read is not supported with a custom path template", http.StatusNotImplemented)
+		return
+	}
+
+	tenant, err := self.tenantFromRequest(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	readReq, err := remote.DecodeReadRequest(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	respType, err := remote.NegotiateResponseType(readReq.AcceptedResponseTypes)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var identityMatcher *labels.Matcher
+	if self.opts.tls.clientCertPrefix {
+		identity, err := clientCertIdentity(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		// Clients that are identified by their certificate can only read their own data
+		identityMatcher = labels.MustNewMatcher(labels.MatchEqual, prefixLabelKey, identity)
+	}
+
+	results := make([]*prompb.QueryResult, 0, len(readReq.Queries))
+	for _, query := range readReq.Queries {
+		matchers, err := remote.FromLabelMatchers(query.Matchers)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if identityMatcher != nil {
+			matchers = append(matchers, identityMatcher)
+		}
+
+		timeserieses, err := self.querySeries(
+			req.Context(),
+			tenant,
+			query.StartTimestampMs,
+			query.EndTimestampMs,
+			matchers,
+		)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		results = append(results, &prompb.QueryResult{Timeseries: timeserieses})
+	}
+
+	switch respType {
+	case prompb.ReadRequest_SAMPLES:
+		w.Header().Set("Content-Type", protobufContentType)
+		w.Header().Set("Content-Encoding", "snappy")
+		if err := remote.EncodeReadResponse(&prompb.ReadResponse{Results: results}, w); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+
+	case prompb.ReadRequest_STREAMED_XOR_CHUNKS:
+		w.Header().Set("Content-Type", streamedContentType)
+		f, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "response writer does not support flushing", http.StatusInternalServerError)
+			return
+		}
+
+		marshalPool := &sync.Pool{}
+		for i, result := range results {
+			// The streaming API requires the series to be sorted
+			ss := storage.NewSeriesSetToChunkSet(remote.FromQueryResult(true, result))
+			if _, err := remote.StreamChunkedReadResponses(
+				remote.NewChunkedWriter(w, f),
+				int64(i),
+				ss,
+				nil,
+				maxBytesInFrame,
+				marshalPool,
+			); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+}
+
+// querySeries finds all of the series in the saved data files that match the given label matchers and have samples in
+// the range [start, end] (in milliseconds).  We use the metric name and prefix matchers (if present) to avoid listing
+// and reading files that can't possibly match.  If the tenant is non-empty, only that tenant's files are searched, and
+// the tenant directory is not included in the prefix label.
+func (self *promserver) querySeries(
+	ctx context.Context,
+	tenant string,
+	start, end int64,
+	matchers []*labels.Matcher,
+) ([]*prompb.TimeSeries, error) {
+	listPrefix := ""
+	prefixValue, hasPrefix := equalityMatcherValue(matchers, prefixLabelKey)
+	nameValue, hasName := equalityMatcherValue(matchers, model.MetricNameLabel)
+	if hasPrefix && hasName {
+		listPrefix = path.Join(prefixValue, nameValue)
+	} else if hasPrefix {
+		listPrefix = prefixValue
+	}
+
+	files, err := backends.ListFiles(ctx, self.opts.backendRoot, tenantPrefix(tenant, listPrefix), self.opts.backend)
+	if err != nil {
+		return nil, fmt.Errorf("could not list data files: %w", err)
+	}
+
+	merged := map[string]*prompb.TimeSeries{}
+	for _, file := range files {
+		if tenant != "" {
+			var inTenant bool
+			if file, inTenant = strings.CutPrefix(file, tenant+"/"); !inTenant {
+				continue
+			}
+		}
+
+		prefix, metricName, fileStart, ok := parquet.ParseDataFilePath(file)
+		if !ok || fileStart.UnixMilli() > end {
+			continue
+		}
+
+		baseLabels := []prompb.Label{{Name: model.MetricNameLabel, Value: metricName}}
+		if prefix != "" {
+			baseLabels = append(baseLabels, prompb.Label{Name: prefixLabelKey, Value: prefix})
+		}
+		if !matchesLabels(matchers, baseLabels, true) {
+			continue
+		}
+
+		// Files that are currently being written to don't have a footer yet, so they can't be read
+		if self.tracker.isOpen(tenantPrefix(tenant, file)) {
+			log.Debugf("skipping %s, which is still being written", file)
+			continue
+		}
+
+		log.Debugf("reading %s for remote read request", file)
+		timeserieses, err := parquet.ReadSeries(ctx, self.opts.backendRoot, tenantPrefix(tenant, file), self.opts.backend)
+		if err != nil {
+			log.Warnf("skipping unreadable file %s: %v", file, err)
+			continue
+		}
+
+		for _, ts := range timeserieses {
+			// The writers store the prefix label along with the rest of the labels, but we use the one from the file path
+			// instead, since it's already been cleaned up (and doesn't include the tenant directory)
+			stored := lo.Reject(ts.Labels, func(l prompb.Label, _ int) bool { return l.Name == prefixLabelKey })
+			lbls := append(slices.Clone(baseLabels), stored...)
+			sort.Slice(lbls, func(i, j int) bool { return lbls[i].Name < lbls[j].Name })
+			if !matchesLabels(matchers, lbls, false) {
+				continue
+			}
+
+			samples := []prompb.Sample{}
+			for _, s := range ts.Samples {
+				if s.Timestamp >= start && s.Timestamp <= end {
+					samples = append(samples, s)
+				}
+			}
+			if len(samples) == 0 {
+				continue
+			}
+
+			key := labelsKey(lbls)
+			if _, ok := merged[key]; !ok {
+				merged[key] = &prompb.TimeSeries{Labels: lbls}
+			}
+			merged[key].Samples = append(merged[key].Samples, samples...)
+		}
+	}
+
+	result := make([]*prompb.TimeSeries, 0, len(merged))
+	for _, ts := range merged {
+		sort.Slice(ts.Samples, func(i, j int) bool { return ts.Samples[i].Timestamp < ts.Samples[j].Timestamp })
+		result = append(result, ts)
+	}
+	sort.Slice(result, func(i, j int) bool { return labelsKey(result[i].Labels) < labelsKey(result[j].Labels) })
+
+	return result, nil
+}
+
+// matchesLabels checks the label matchers against the given labels; a label that isn't present is treated as having
+// an empty value, which is how Prometheus handles it.  If onlyPath is true, only the matchers for the labels that are
+// encoded in the file path (the metric name and prefix) are checked.
+func matchesLabels(matchers []*labels.Matcher, lbls []prompb.Label, onlyPath bool) bool {
+	for _, m := range matchers {
+		if onlyPath && m.Name != model.MetricNameLabel && m.Name != prefixLabelKey {
+			continue
+		}
+
+		l, _ := lo.Find(lbls, func(i prompb.Label) bool { return i.Name == m.Name })
+		if !m.Matches(l.Value) {
+			return false
+		}
+	}
+	return true
+}
+
+func equalityMatcherValue(matchers []*labels.Matcher, name string) (string, bool) {
+	for _, m := range matchers {
+		if m.Name == name && m.Type == labels.MatchEqual {
+			return m.Value, true
+		}
+	}
+	return "", false
+}
+
+func labelsKey(lbls []prompb.Label) string {
+	b := labels.NewScratchBuilder(len(lbls))
+	for _, l := range lbls {
+		b.Add(l.Name, l.Value)
+	}
+	return b.Labels().String()
+}
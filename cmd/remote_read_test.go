@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/xitongsys/parquet-go-source/mem"
+
+	"github.com/acrlabs/prom2parquet/pkg/backends"
+	"github.com/acrlabs/prom2parquet/pkg/parquet"
+)
+
+// writeTestSeries writes the timeseries to data files in /test/<dir>/<metric>, using the same encoding that the writers
+// use; each file holds ten seconds of data.  All of the series for a metric have to be passed in together.
+func writeTestSeries(t *testing.T, dir string, timeserieses ...prompb.TimeSeries) {
+	bw := parquet.NewBackfillWriter("/test", nil, nil, backends.Memory, 10*time.Second)
+	for _, ts := range timeserieses {
+		_, metricName := prefixAndMetricName(ts)
+		assert.Nil(t, bw.Write(dir, metricName, ts))
+	}
+	assert.Nil(t, bw.Close())
+}
+
+func testSeries(metricName, pod string, samples ...prompb.Sample) prompb.TimeSeries {
+	return prompb.TimeSeries{
+		Labels: []prompb.Label{
+			{Name: model.MetricNameLabel, Value: metricName},
+			{Name: prefixLabelKey, Value: testPrefix},
+			{Name: "pod", Value: pod},
+		},
+		Samples: samples,
+	}
+}
+
+func TestQuerySeries(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	mem.SetInMemFileFs(&fs)
+
+	writeTestSeries(t, testPrefix,
+		testSeries(metricName, "pod-a",
+			prompb.Sample{Timestamp: 1000, Value: 1.0},
+			prompb.Sample{Timestamp: 5000, Value: 3.0},
+			prompb.Sample{Timestamp: 10000, Value: 4.0},
+			prompb.Sample{Timestamp: 20000, Value: 5.0},
+		),
+		testSeries(metricName, "pod-b", prompb.Sample{Timestamp: 1000, Value: 2.0}),
+		testSeries("other_metric", "pod-a", prompb.Sample{Timestamp: 1000, Value: 6.0}),
+	)
+
+	srv := newServer(&options{backend: backends.Memory, backendRoot: "/test"})
+
+	cases := map[string]struct {
+		matchers []*labels.Matcher
+		expected []*prompb.TimeSeries
+	}{
+		"metric and pod": {
+			matchers: []*labels.Matcher{
+				labels.MustNewMatcher(labels.MatchEqual, model.MetricNameLabel, metricName),
+				labels.MustNewMatcher(labels.MatchEqual, prefixLabelKey, testPrefix),
+				labels.MustNewMatcher(labels.MatchEqual, "pod", "pod-a"),
+			},
+			expected: []*prompb.TimeSeries{
+				{
+					Labels: []prompb.Label{
+						{Name: model.MetricNameLabel, Value: metricName},
+						{Name: "pod", Value: "pod-a"},
+						{Name: prefixLabelKey, Value: testPrefix},
+					},
+					Samples: []prompb.Sample{
+						{Value: 1.0, Timestamp: 1000},
+						{Value: 3.0, Timestamp: 5000},
+						{Value: 4.0, Timestamp: 10000},
+					},
+				},
+			},
+		},
+		"regex metric name": {
+			matchers: []*labels.Matcher{
+				labels.MustNewMatcher(labels.MatchRegexp, model.MetricNameLabel, "other_.*"),
+			},
+			expected: []*prompb.TimeSeries{
+				{
+					Labels: []prompb.Label{
+						{Name: model.MetricNameLabel, Value: "other_metric"},
+						{Name: "pod", Value: "pod-a"},
+						{Name: prefixLabelKey, Value: testPrefix},
+					},
+					Samples: []prompb.Sample{{Value: 6.0, Timestamp: 1000}},
+				},
+			},
+		},
+		"no match": {
+			matchers: []*labels.Matcher{
+				labels.MustNewMatcher(labels.MatchEqual, model.MetricNameLabel, "missing_metric"),
+			},
+			expected: []*prompb.TimeSeries{},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			res, err := srv.querySeries(context.TODO(), "", 0, 15000, tc.matchers)
+			assert.Nil(t, err)
+			assert.Equal(t, tc.expected, res)
+		})
+	}
+}
+
+func TestQuerySeriesOpenFile(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	mem.SetInMemFileFs(&fs)
+
+	srv := newServer(&options{backend: backends.Memory, backendRoot: "/test", flushInterval: time.Hour})
+	defer closeWriters(t, srv)
+
+	// The writer's current file doesn't have a footer yet, so it shouldn't even try to read it
+	_, err := srv.spawnWriter(context.TODO(), parquet.PathFields{Prefix: testPrefix, Metric: metricName})
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool { return srv.tracker.numOpen() == 1 }, time.Second, 10*time.Millisecond)
+
+	logs := test.NewGlobal()
+	res, err := srv.querySeries(context.TODO(), "", 0, time.Now().UnixMilli(), []*labels.Matcher{
+		labels.MustNewMatcher(labels.MatchEqual, model.MetricNameLabel, metricName),
+	})
+	assert.Nil(t, err)
+	assert.Empty(t, res)
+	for _, entry := range logs.AllEntries() {
+		assert.Greater(t, entry.Level, log.WarnLevel, entry.Message)
+	}
+}
+
+func TestRemoteRead(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	mem.SetInMemFileFs(&fs)
+	writeTestSeries(t, testPrefix, testSeries(metricName, "pod-a", prompb.Sample{Timestamp: 1000, Value: 1.0}))
+
+	srv := newServer(&options{backend: backends.Memory, backendRoot: "/test"})
+
+	cases := map[string]struct {
+		responseType        prompb.ReadRequest_ResponseType
+		expectedContentType string
+	}{
+		"samples": {
+			responseType:        prompb.ReadRequest_SAMPLES,
+			expectedContentType: "application/x-protobuf",
+		},
+		"streamed chunks": {
+			responseType:        prompb.ReadRequest_STREAMED_XOR_CHUNKS,
+			expectedContentType: streamedContentType,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			readReq := &prompb.ReadRequest{
+				Queries: []*prompb.Query{{
+					StartTimestampMs: 0,
+					EndTimestampMs:   2000,
+					Matchers: []*prompb.LabelMatcher{
+						{Type: prompb.LabelMatcher_EQ, Name: model.MetricNameLabel, Value: metricName},
+					},
+				}},
+				AcceptedResponseTypes: []prompb.ReadRequest_ResponseType{tc.responseType},
+			}
+			data, err := readReq.Marshal()
+			assert.Nil(t, err)
+
+			req := httptest.NewRequest(http.MethodPost, "/read", bytes.NewReader(snappy.Encode(nil, data)))
+			w := httptest.NewRecorder()
+			srv.remoteRead(w, req)
+
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, tc.expectedContentType, w.Header().Get("Content-Type"))
+			assert.NotEmpty(t, w.Body.Bytes())
+		})
+	}
+}
+
+func TestRemoteReadCustomLayout(t *testing.T) {
+	srv := newServer(&options{layout: parquet.MustNewPathTemplate("{{.Metric}}/{{.Date}}/{{.Timestamp}}.parquet")})
+
+	req := httptest.NewRequest(http.MethodPost, "/read", bytes.NewReader(nil))
+	w := httptest.NewRecorder()
+	srv.remoteRead(w, req)
+	assert.Equal(t, http.StatusNotImplemented, w.Code)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/config"
+	"github.com/prometheus/prometheus/prompb"
+	writev2 "github.com/prometheus/prometheus/prompb/io/prometheus/write/v2"
+	"github.com/samber/lo"
+)
+
+const (
+	protobufContentType = "application/x-protobuf"
+
+	samplesWrittenHeader    = "X-Prometheus-Remote-Write-Samples-Written"
+	histogramsWrittenHeader = "X-Prometheus-Remote-Write-Histograms-Written"
+	exemplarsWrittenHeader  = "X-Prometheus-Remote-Write-Exemplars-Written"
+)
+
+type writeStats struct {
+	samples    int
+	histograms int
+	exemplars  int
+}
+
+func (self writeStats) setHeaders(w http.ResponseWriter) {
+	w.Header().Set(samplesWrittenHeader, strconv.Itoa(self.samples))
+	w.Header().Set(histogramsWrittenHeader, strconv.Itoa(self.histograms))
+	w.Header().Set(exemplarsWrittenHeader, strconv.Itoa(self.exemplars))
+}
+
+func (self *writeStats) add(ts prompb.TimeSeries) {
+	self.samples += len(ts.Samples)
+	self.histograms += len(ts.Histograms)
+	self.exemplars += len(ts.Exemplars)
+}
+
+func statsForTimeseries(timeserieses []prompb.TimeSeries) writeStats {
+	stats := writeStats{}
+	for _, ts := range timeserieses {
+		stats.add(ts)
+	}
+	return stats
+}
+
+// parseProtoMsg determines which remote write protobuf message is in the request body, based on the `proto` parameter
+// of the Content-Type header.  An empty header is treated as a 1.0 request, for compatibility with older senders.
+func parseProtoMsg(contentType string) (config.RemoteWriteProtoMsg, error) {
+	if contentType == "" {
+		return config.RemoteWriteProtoMsgV1, nil
+	}
+
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", fmt.Errorf("could not parse content-type %q: %w", contentType, err)
+	}
+
+	if mediaType != protobufContentType {
+		return "", fmt.Errorf("expected media type %s, got %s", protobufContentType, mediaType)
+	}
+
+	protoMsg, ok := params["proto"]
+	if !ok {
+		return config.RemoteWriteProtoMsgV1, nil
+	}
+
+	msg := config.RemoteWriteProtoMsg(protoMsg)
+	if err := msg.Validate(); err != nil {
+		return "", fmt.Errorf("unsupported proto message: %w", err)
+	}
+	return msg, nil
+}
+
+// timeseriesFromV2Request converts a remote write 2.0 request into the 1.0 timeseries and metadata formats, so that
+// both versions can share the same writer pipeline.  All symbol references are bounds-checked, since they come from
+// an untrusted sender.
+func timeseriesFromV2Request(req *writev2.Request) ([]prompb.TimeSeries, []prompb.MetricMetadata, error) {
+	timeserieses := make([]prompb.TimeSeries, 0, len(req.Timeseries))
+	metadata := []prompb.MetricMetadata{}
+	for i, v2ts := range req.Timeseries {
+		lbls, err := desymbolizeLabels(v2ts.LabelsRefs, req.Symbols)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid labels for timeseries %d: %w", i, err)
+		}
+
+		ts := prompb.TimeSeries{
+			Labels:     lbls,
+			Samples:    make([]prompb.Sample, 0, len(v2ts.Samples)),
+			Histograms: make([]prompb.Histogram, 0, len(v2ts.Histograms)),
+			Exemplars:  make([]prompb.Exemplar, 0, len(v2ts.Exemplars)),
+		}
+
+		for _, s := range v2ts.Samples {
+			ts.Samples = append(ts.Samples, prompb.Sample{Value: s.Value, Timestamp: s.Timestamp})
+		}
+
+		for _, h := range v2ts.Histograms {
+			if h.IsFloatHistogram() {
+				ts.Histograms = append(ts.Histograms, prompb.FromFloatHistogram(h.Timestamp, h.ToFloatHistogram()))
+			} else {
+				ts.Histograms = append(ts.Histograms, prompb.FromIntHistogram(h.Timestamp, h.ToIntHistogram()))
+			}
+		}
+
+		for _, e := range v2ts.Exemplars {
+			exLabels, err := desymbolizeLabels(e.LabelsRefs, req.Symbols)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid exemplar labels for timeseries %d: %w", i, err)
+			}
+			ts.Exemplars = append(ts.Exemplars, prompb.Exemplar{
+				Labels:    exLabels,
+				Value:     e.Value,
+				Timestamp: e.Timestamp,
+			})
+		}
+
+		timeserieses = append(timeserieses, ts)
+
+		md, err := metadataFromV2TimeSeries(v2ts, lbls, req.Symbols)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid metadata for timeseries %d: %w", i, err)
+		} else if md != nil {
+			metadata = append(metadata, *md)
+		}
+	}
+
+	return timeserieses, metadata, nil
+}
+
+// metadataFromV2TimeSeries returns the metric metadata attached to a 2.0 timeseries, or nil if the sender didn't
+// include any
+func metadataFromV2TimeSeries(
+	v2ts writev2.TimeSeries,
+	lbls []prompb.Label,
+	symbols []string,
+) (*prompb.MetricMetadata, error) {
+	v2md := v2ts.Metadata
+	if v2md.Type == writev2.Metadata_METRIC_TYPE_UNSPECIFIED && v2md.HelpRef == 0 && v2md.UnitRef == 0 {
+		return nil, nil
+	}
+
+	if int(v2md.HelpRef) >= len(symbols) || int(v2md.UnitRef) >= len(symbols) {
+		return nil, fmt.Errorf("symbol reference out of range (%d symbols)", len(symbols))
+	}
+
+	nameLabel, _ := lo.Find(lbls, func(i prompb.Label) bool { return i.Name == model.MetricNameLabel })
+	md := v2ts.ToMetadata(symbols)
+	return &prompb.MetricMetadata{
+		Type:             prompb.FromMetadataType(md.Type),
+		MetricFamilyName: nameLabel.Value,
+		Help:             md.Help,
+		Unit:             md.Unit,
+	}, nil
+}
+
+func desymbolizeLabels(refs []uint32, symbols []string) ([]prompb.Label, error) {
+	if len(refs)%2 != 0 {
+		return nil, fmt.Errorf("odd number of label references (%d)", len(refs))
+	}
+
+	lbls := make([]prompb.Label, 0, len(refs)/2)
+	for i := 0; i < len(refs); i += 2 {
+		nameRef, valueRef := refs[i], refs[i+1]
+		if int(nameRef) >= len(symbols) || int(valueRef) >= len(symbols) {
+			return nil, fmt.Errorf("symbol reference out of range (%d symbols)", len(symbols))
+		}
+		lbls = append(lbls, prompb.Label{Name: symbols[nameRef], Value: symbols[valueRef]})
+	}
+	return lbls, nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/config"
+	"github.com/prometheus/prometheus/prompb"
+	writev2 "github.com/prometheus/prometheus/prompb/io/prometheus/write/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseProtoMsg(t *testing.T) {
+	cases := map[string]struct {
+		contentType string
+		expected    config.RemoteWriteProtoMsg
+		expectErr   bool
+	}{
+		"empty": {
+			contentType: "",
+			expected:    config.RemoteWriteProtoMsgV1,
+		},
+		"no proto param": {
+			contentType: "application/x-protobuf",
+			expected:    config.RemoteWriteProtoMsgV1,
+		},
+		"v1": {
+			contentType: "application/x-protobuf;proto=prometheus.WriteRequest",
+			expected:    config.RemoteWriteProtoMsgV1,
+		},
+		"v2": {
+			contentType: "application/x-protobuf;proto=io.prometheus.write.v2.Request",
+			expected:    config.RemoteWriteProtoMsgV2,
+		},
+		"unknown proto": {
+			contentType: "application/x-protobuf;proto=foo.Bar",
+			expectErr:   true,
+		},
+		"wrong media type": {
+			contentType: "application/json",
+			expectErr:   true,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			msg, err := parseProtoMsg(tc.contentType)
+			if tc.expectErr {
+				assert.NotNil(t, err)
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, tc.expected, msg)
+			}
+		})
+	}
+}
+
+func TestTimeseriesFromV2Request(t *testing.T) {
+	req := &writev2.Request{
+		Symbols: []string{
+			"", model.MetricNameLabel, metricName, prefixLabelKey, testPrefix, "trace_id", "abcd", "some help", "bytes",
+		},
+		Timeseries: []writev2.TimeSeries{
+			{
+				LabelsRefs: []uint32{1, 2, 3, 4},
+				Samples:    []writev2.Sample{{Value: 1.0, Timestamp: 0}, {Value: 2.0, Timestamp: 1}},
+				Histograms: []writev2.Histogram{
+					{Count: &writev2.Histogram_CountInt{CountInt: 3}, Sum: 4.5, Timestamp: 2},
+				},
+				Exemplars: []writev2.Exemplar{{LabelsRefs: []uint32{5, 6}, Value: 1.0, Timestamp: 0}},
+				Metadata:  writev2.Metadata{Type: writev2.Metadata_METRIC_TYPE_GAUGE, HelpRef: 7, UnitRef: 8},
+			},
+		},
+	}
+
+	timeserieses, metadata, err := timeseriesFromV2Request(req)
+	assert.Nil(t, err)
+	assert.Equal(t, []prompb.MetricMetadata{{
+		Type:             prompb.MetricMetadata_GAUGE,
+		MetricFamilyName: metricName,
+		Help:             "some help",
+		Unit:             "bytes",
+	}}, metadata)
+	assert.Len(t, timeserieses, 1)
+
+	ts := timeserieses[0]
+	assert.Equal(t, []prompb.Label{
+		{Name: model.MetricNameLabel, Value: metricName},
+		{Name: prefixLabelKey, Value: testPrefix},
+	}, ts.Labels)
+	assert.Equal(t, []prompb.Sample{{Value: 1.0, Timestamp: 0}, {Value: 2.0, Timestamp: 1}}, ts.Samples)
+	assert.Len(t, ts.Histograms, 1)
+	assert.Equal(t, uint64(3), ts.Histograms[0].GetCountInt())
+	assert.Equal(t, []prompb.Exemplar{{Labels: []prompb.Label{{Name: "trace_id", Value: "abcd"}}, Value: 1.0}},
+		ts.Exemplars)
+
+	assert.Equal(t, writeStats{samples: 2, histograms: 1, exemplars: 1}, statsForTimeseries(timeserieses))
+}
+
+func TestTimeseriesFromV2RequestBadSymbols(t *testing.T) {
+	cases := map[string][]uint32{
+		"out of range": {1, 7},
+		"odd length":   {1},
+	}
+
+	for name, refs := range cases {
+		t.Run(name, func(t *testing.T) {
+			req := &writev2.Request{
+				Symbols:    []string{"", model.MetricNameLabel, metricName},
+				Timeseries: []writev2.TimeSeries{{LabelsRefs: refs}},
+			}
+			_, _, err := timeseriesFromV2Request(req)
+			assert.NotNil(t, err)
+		})
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"github.com/spf13/cobra"
 	"github.com/thediveo/enumflag/v2"
 
+	"github.com/acrlabs/prom2parquet/pkg/parquet"
 	"github.com/acrlabs/prom2parquet/pkg/util"
 )
 
@@ -58,18 +59,223 @@ func rootCmd() *cobra.Command {
 		"root path/location for the specified backend (e.g. bucket name for AWS S3)",
 	)
 
+	root.PersistentFlags().StringVar(
+		&opts.pathTemplate,
+		pathTemplateFlag,
+		parquet.DefaultPathTemplate,
+		"Go template for the path of each data file, relative to the backend root",
+	)
+
+	root.PersistentFlags().StringVar(
+		&opts.labelColumns.file,
+		labelColumnsFlag,
+		"",
+		"YAML file listing the labels to store in their own columns, globally and per metric",
+	)
+
+	root.PersistentFlags().Var(
+		enumflag.New(&opts.labelColumns.mode, schemaModeFlag, schemaModeIDs, enumflag.EnumCaseInsensitive),
+		schemaModeFlag,
+		fmt.Sprintf(
+			"whether each metric's label columns are fixed, or a column is added for every label seen\n(valid options: %s)",
+			validArgs(schemaModeIDs),
+		),
+	)
+
 	root.PersistentFlags().VarP(
 		enumflag.New(&opts.verbosity, verbosityFlag, logLevelIDs, enumflag.EnumCaseInsensitive),
 		verbosityFlag,
 		"v",
 		fmt.Sprintf("log level (valid options: %s)", validArgs(logLevelIDs)),
 	)
+
+	root.Flags().StringVar(
+		&opts.ingestAuth.bearerTokenFile,
+		authBearerTokenFileFlag,
+		"",
+		"file containing the bearer token that clients must present",
+	)
+
+	root.Flags().StringVar(
+		&opts.ingestAuth.basicUsername,
+		authBasicUsernameFlag,
+		"",
+		"username that clients must present for basic authentication",
+	)
+
+	root.Flags().StringVar(
+		&opts.ingestAuth.basicPasswordFile,
+		authBasicPasswordFileFlag,
+		"",
+		"file containing the password that clients must present for basic authentication",
+	)
+
+	root.Flags().StringVar(
+		&opts.flushAuth.bearerTokenFile,
+		flushAuthBearerTokenFileFlag,
+		"",
+		"file containing the bearer token for the /flush endpoint (overrides the default credentials)",
+	)
+
+	root.Flags().StringVar(
+		&opts.flushAuth.basicUsername,
+		flushAuthBasicUsernameFlag,
+		"",
+		"username for basic authentication on the /flush endpoint (overrides the default credentials)",
+	)
+
+	root.Flags().StringVar(
+		&opts.flushAuth.basicPasswordFile,
+		flushAuthBasicPasswordFileFlag,
+		"",
+		"file containing the password for basic authentication on the /flush endpoint (overrides the default credentials)",
+	)
+
+	root.Flags().StringVar(
+		&opts.tls.certFile,
+		tlsCertFileFlag,
+		"",
+		"file containing the TLS certificate to serve (reloaded when it changes)",
+	)
+
+	root.Flags().StringVar(
+		&opts.tls.keyFile,
+		tlsKeyFileFlag,
+		"",
+		"file containing the TLS private key to serve (reloaded when it changes)",
+	)
+
+	root.Flags().StringVar(
+		&opts.tls.clientCAFile,
+		tlsClientCAFileFlag,
+		"",
+		"file containing the CA bundle used to verify client certificates; enables mutual TLS",
+	)
+
+	root.Flags().BoolVar(
+		&opts.tls.clientCertPrefix,
+		tlsClientCertPrefixFlag,
+		false,
+		"use the client certificate's common name as the prefix for all data it sends",
+	)
+
+	root.Flags().BoolVar(
+		&opts.tenancy.enabled,
+		multiTenantFlag,
+		false,
+		"use the tenant header on each request as the top-level directory for its data",
+	)
+
+	root.Flags().StringVar(
+		&opts.tenancy.header,
+		tenantHeaderFlag,
+		defaultTenantHeader,
+		"HTTP header containing the tenant ID",
+	)
+
+	root.Flags().IntVar(
+		&opts.tenancy.maxWriters,
+		tenantMaxWritersFlag,
+		0,
+		"default maximum number of metric writers per tenant (0 means unlimited)",
+	)
+
+	root.Flags().StringVar(
+		&opts.tenancy.limitsFile,
+		tenantLimitsFileFlag,
+		"",
+		"YAML file containing per-tenant limit overrides",
+	)
+
+	root.Flags().StringVar(
+		&opts.walDir,
+		walDirFlag,
+		"",
+		"local directory for the write-ahead log of received data (disabled if empty)",
+	)
+
+	root.Flags().BoolVar(
+		&opts.ha.enabled,
+		haTrackerFlag,
+		false,
+		"deduplicate data from Prometheus HA pairs by only accepting data from one replica per cluster",
+	)
+
+	root.Flags().StringVar(
+		&opts.ha.clusterLabel,
+		haClusterLabelFlag,
+		defaultHAClusterLabel,
+		"label identifying the HA cluster a series came from",
+	)
+
+	root.Flags().StringVar(
+		&opts.ha.replicaLabel,
+		haReplicaLabelFlag,
+		defaultHAReplicaLabel,
+		"label identifying the HA replica a series came from (removed before writing)",
+	)
+
+	root.Flags().DurationVar(
+		&opts.ha.failoverTimeout,
+		haFailoverTimeoutFlag,
+		defaultHAFailoverTimeout,
+		"how long to wait for data from the elected HA replica before failing over to another replica",
+	)
+
+	root.Flags().Var(
+		enumflag.New(&opts.duplicates, duplicateSamplesFlag, duplicatePolicyIDs, enumflag.EnumCaseInsensitive),
+		duplicateSamplesFlag,
+		fmt.Sprintf(
+			"what to do with samples that aren't newer than the last sample for their series\n(valid options: %s)",
+			validArgs(duplicatePolicyIDs),
+		),
+	)
+
+	root.Flags().StringVar(
+		&opts.relabel.file,
+		relabelConfigFileFlag,
+		"",
+		"YAML file containing metric_relabel_configs rules to apply to all incoming series",
+	)
+
+	root.Flags().DurationVar(
+		&opts.writers.idleTimeout,
+		writerIdleTimeoutFlag,
+		0,
+		"close the files for a metric once it hasn't received any data for this long (0 means never)",
+	)
+
+	root.Flags().IntVar(
+		&opts.writers.maxOpen,
+		maxOpenWritersFlag,
+		0,
+		"maximum number of metric writers to keep open, closing the least-recently-used one if needed (0 means unlimited)",
+	)
+
+	root.Flags().IntVar(
+		&opts.writers.queueSize,
+		writerQueueSizeFlag,
+		1000,
+		"number of timeseries to buffer for each metric writer before rejecting requests with a 429",
+	)
+
+	root.Flags().DurationVar(
+		&opts.shutdownDelay,
+		shutdownDelayFlag,
+		5*time.Second,
+		"how long to keep accepting data after failing the readiness check when shutting down",
+	)
+
+	root.AddCommand(backfillCmd(&opts))
 	return root
 }
 
 func start(opts *options) {
 	util.SetupLogging(opts.verbosity)
 	log.Infof("running with options: %v", opts)
+	if err := opts.validate(); err != nil {
+		log.Fatal(err)
+	}
 
 	server := newServer(opts)
 	server.run()
@@ -3,16 +3,20 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
+	"path"
+	"sort"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
 
 	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/config"
 	"github.com/prometheus/prometheus/prompb"
 	"github.com/prometheus/prometheus/storage/remote"
 	"github.com/samber/lo"
@@ -24,51 +28,135 @@ import (
 const (
 	prefixLabelKey = "prom2parquet_prefix"
 
+	// Separates the label values used by the path template from the prefix and metric name in the writer's channel name;
+	// this can't appear in a valid UTF-8 label value
+	partitionSep = "\xff"
+
 	shutdownTime = 30 * time.Second
+	rotateTime   = 5 * time.Minute
 )
 
 type promserver struct {
 	httpserv *http.Server
 	opts     *options
-	channels map[string]chan prompb.TimeSeries
-
-	m            sync.RWMutex
-	flushChannel chan os.Signal
-	killChannel  chan os.Signal
+	writers  map[string]*metricWriter
+	starts   map[string]*parquet.FileStarts
+	metadata *parquet.MetadataStore
+	sidecars *sidecarGroup
+	health   *backendHealth
+	tracker  *fileTracker
+	running  *writerGroup
+	wal      *walManager
+	ha       *haTracker
+
+	metrics       *serverMetrics
+	writerMetrics *parquet.Metrics
+	readiness     *readiness
+
+	ingestAuth *authenticator
+	flushAuth  *authenticator
+
+	m             sync.RWMutex
+	flushChannel  chan os.Signal
+	reloadChannel chan os.Signal
+	killChannel   chan os.Signal
 }
 
 func newServer(opts *options) *promserver {
 	fulladdr := fmt.Sprintf(":%d", opts.port)
 	mux := http.NewServeMux()
+	health := &backendHealth{}
 
 	s := &promserver{
 		httpserv: &http.Server{Addr: fulladdr, Handler: mux, ReadHeaderTimeout: 10 * time.Second},
 		opts:     opts,
-		channels: map[string]chan prompb.TimeSeries{},
+		writers:  map[string]*metricWriter{},
+		starts:   map[string]*parquet.FileStarts{},
+		metadata: parquet.NewMetadataStore(opts.backendRoot, opts.backend),
+		sidecars: newSidecarGroup(),
+		health:   health,
+		tracker:  newFileTracker(health),
+		ha:       newHATracker(opts.ha),
+
+		readiness: newReadiness(),
+
+		flushChannel:  make(chan os.Signal, 1),
+		reloadChannel: make(chan os.Signal, 1),
+		killChannel:   make(chan os.Signal, 1),
+	}
 
-		flushChannel: make(chan os.Signal, 1),
-		killChannel:  make(chan os.Signal, 1),
+	s.running = newWriterGroup(s.tracker)
+
+	s.ingestAuth = newAuthenticator(opts.ingestAuth)
+	s.flushAuth = s.ingestAuth
+	if opts.flushAuth.enabled() {
+		s.flushAuth = newAuthenticator(opts.flushAuth)
 	}
-	mux.HandleFunc("/receive", s.metricsReceive)
-	mux.HandleFunc("/flush", s.flushData)
+
+	s.metrics = newServerMetrics(s)
+	s.writerMetrics = parquet.NewMetrics(s.metrics.registry)
+
+	receive := s.ingestAuth.wrap(s.acceptingData(s.metricsReceive))
+	otlpReceive := s.ingestAuth.wrap(s.acceptingData(s.otlpReceive))
+	mux.HandleFunc("/receive", s.metrics.instrument("/receive", receive))
+	mux.HandleFunc("/flush", s.metrics.instrument("/flush", s.flushAuth.wrap(s.flushData)))
+	mux.HandleFunc("/v1/metrics", s.metrics.instrument("/v1/metrics", otlpReceive))
+	mux.HandleFunc("/read", s.metrics.instrument("/read", s.ingestAuth.wrap(s.remoteRead)))
+	mux.Handle("/metrics", s.metrics.handler())
+	listWriters := s.flushAuth.wrap(s.listWriters)
+	getWriter := s.flushAuth.wrap(s.getWriter)
+	mux.HandleFunc("GET "+writersAPIPath, s.metrics.instrument(writersAPIPath, listWriters))
+	mux.HandleFunc("GET "+writersAPIPath+"/{name...}", s.metrics.instrument(writersAPIPath+"/{name}", getWriter))
+	mux.HandleFunc("/-/healthy", s.healthy)
+	mux.HandleFunc("/-/ready", s.ready)
 
 	return s
 }
 
 func (self *promserver) run() {
-	signal.Notify(self.killChannel, syscall.SIGTERM)
+	signal.Notify(self.killChannel, syscall.SIGTERM, syscall.SIGINT)
+	signal.Notify(self.flushChannel, syscall.SIGUSR1)
+	signal.Notify(self.reloadChannel, syscall.SIGHUP)
 
 	endChannel := make(chan struct{}, 1)
 
+	// The server starts listening before the WAL is replayed, so that the health checks work while we're replaying;
+	// incoming data is rejected until the replay is done
+	if self.opts.walDir != "" {
+		self.readiness.replaying.Store(true)
+	}
+
 	go func() {
-		if err := self.httpserv.ListenAndServe(); err != nil {
+		var err error
+		if self.opts.tls.enabled() {
+			err = self.listenAndServeTLS()
+		} else {
+			err = self.httpserv.ListenAndServe()
+		}
+		if err != nil {
 			log.Errorf("server failed: %v", err)
 		}
 	}()
 
+	if self.opts.walDir != "" {
+		if err := self.startWAL(); err != nil {
+			log.Fatalf("could not start WAL: %v", err)
+		}
+		self.readiness.replaying.Store(false)
+	}
+
+	go self.runBackendChecks(endChannel)
+	if self.opts.writers.idleTimeout > 0 {
+		go self.runIdleEviction(endChannel)
+	}
+	go self.handleSignals(endChannel)
+
 	go func() {
 		<-self.killChannel
-		self.handleShutdown()
+		if err := self.handleShutdown(); err != nil {
+			log.Fatalf("shutdown did not finish cleanly, some data may have been lost: %v", err)
+		}
+		log.Info("shutdown complete")
 		close(endChannel)
 	}()
 
@@ -76,98 +164,380 @@ func (self *promserver) run() {
 	<-endChannel
 }
 
-func (self *promserver) handleShutdown() {
+// handleShutdown stops accepting new data, flushes all the open files, and waits for the in-flight requests, the
+// writers, and any pending uploads (including metadata sidecar files) to finish; it returns an error describing
+// anything that didn't finish in time.
+func (self *promserver) handleShutdown() error {
 	log.Info("shutting down...")
-	log.Infof("flushing all data files")
-	for _, ch := range self.channels {
-		close(ch)
-	}
 
-	ctxTimeout, cancel := context.WithTimeout(context.Background(), shutdownTime)
+	// The delay counts against the shutdown timeout, so that we're done within the timeout of getting the signal (which
+	// matches the default Kubernetes termination grace period)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTime)
 	defer cancel()
-	if err := self.httpserv.Shutdown(ctxTimeout); err != nil {
-		log.Errorf("failed shutting server down: %v", err)
+
+	// Fail the readiness check and give Kubernetes a chance to notice before we stop accepting data
+	self.readiness.shuttingDown.Store(true)
+	if self.opts.shutdownDelay > 0 {
+		log.Infof("waiting %v before closing writers", self.opts.shutdownDelay)
+		time.Sleep(self.opts.shutdownDelay)
 	}
 
-	timer := time.AfterFunc(shutdownTime, func() {
-		os.Exit(0)
-	})
+	var errs []error
+	if err := self.httpserv.Shutdown(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("could not finish in-flight requests: %w", err))
+	}
 
-	<-timer.C
+	log.Infof("flushing all data files")
+	self.m.RLock()
+	for _, w := range self.writers {
+		w.close()
+	}
+	self.m.RUnlock()
+
+	if err := self.running.wait(ctx); err != nil {
+		errs = append(errs, err)
+	}
+	if err := self.tracker.waitClosed(ctx); err != nil {
+		errs = append(errs, err)
+	}
+	if err := self.sidecars.wait(ctx); err != nil {
+		errs = append(errs, err)
+	}
+
+	if self.wal != nil {
+		self.wal.shutdown()
+	}
+	return errors.Join(errs...)
 }
 
 func (self *promserver) metricsReceive(w http.ResponseWriter, req *http.Request) {
-	body, err := remote.DecodeWriteRequest(req.Body)
+	tenant, err := self.tenantFromRequest(req)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	if err := self.sendTimeseries(req.Context(), body.Timeseries); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	protoMsg, err := parseProtoMsg(req.Header.Get("Content-Type"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	var timeserieses []prompb.TimeSeries
+	var metadata []prompb.MetricMetadata
+	switch protoMsg {
+	case config.RemoteWriteProtoMsgV1:
+		body, err := remote.DecodeWriteRequest(req.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		timeserieses = body.Timeseries
+		metadata = body.Metadata
+
+	case config.RemoteWriteProtoMsgV2:
+		body, err := remote.DecodeWriteV2Request(req.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		timeserieses, metadata, err = timeseriesFromV2Request(body)
+		if err != nil {
+			writeStats{}.setHeaders(w)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := self.overridePrefix(req, timeserieses); err != nil {
+		writeStats{}.setHeaders(w)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	timeserieses = self.acceptTimeseries(tenant, timeserieses)
+
+	walDone, err := self.logToWAL(tenant, timeserieses)
+	if err != nil {
+		writeStats{}.setHeaders(w)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer walDone()
+
+	stats, routed, err := self.sendTimeseries(req.Context(), tenant, timeserieses)
+	stats.setHeaders(w)
+	if err != nil {
+		writeSendError(w, err)
 		return
 	}
+
+	self.recordMetadata(tenant, routed, metadata)
+	w.WriteHeader(http.StatusNoContent)
 }
 
-func (self *promserver) sendTimeseries(ctx context.Context, timeserieses []prompb.TimeSeries) (err error) {
-	for _, ts := range timeserieses {
+// acceptTimeseries records the data that was received in a request and drops any data from non-elected HA replicas
+func (self *promserver) acceptTimeseries(tenant string, timeserieses []prompb.TimeSeries) []prompb.TimeSeries {
+	received := statsForTimeseries(timeserieses)
+	self.metrics.observeReceived(received)
+
+	timeserieses = self.ha.filter(tenant, timeserieses)
+	self.metrics.observeDropped(dropReasonHA, received.samples-statsForTimeseries(timeserieses).samples)
+	return timeserieses
+}
+
+// sendTimeseries relabels each of the timeseries and routes it to the writer for its metric (creating the writer if
+// necessary); it returns the number of samples, etc. that were actually sent to the writers, along with the relabeled
+// timeseries that were sent.
+func (self *promserver) sendTimeseries(
+	ctx context.Context,
+	tenant string,
+	timeserieses []prompb.TimeSeries,
+) (stats writeStats, routed []prompb.TimeSeries, err error) {
+	if err := self.health.check(time.Now()); err != nil {
+		self.metrics.observeRejected(err, statsForTimeseries(timeserieses).samples)
+		return stats, nil, err
+	}
+
+	// The relabel rules can be swapped out from under us if the config is reloaded
+	self.m.RLock()
+	rules := self.opts.relabel.rules
+	self.m.RUnlock()
+
+	for i, ts := range timeserieses {
 		// I'm not 100% sure which of these things would be recreated/shadowed below, so to be safe
 		// I'm just declaring everything upfront
-		var ch chan prompb.TimeSeries
+		var w *metricWriter
 		var ok bool
 
-		nameLabel, _ := lo.Find(ts.Labels, func(i prompb.Label) bool { return i.Name == model.MetricNameLabel })
-		prefixLabel, _ := lo.Find(ts.Labels, func(i prompb.Label) bool { return i.Name == prefixLabelKey })
-		channelName := prefixLabel.Value + "/" + nameLabel.Value
+		ts, ok = relabelTimeseries(ts, rules)
+		if !ok {
+			self.metrics.observeDropped(dropReasonRelabel, len(timeserieses[i].Samples))
+			continue
+		}
+
+		prefix, _ := prefixAndMetricName(ts)
+		if err := validatePrefix(prefix); err != nil {
+			// The sender won't retry a bad request, so the rest of the data in the request is dropped
+			self.metrics.observeDropped(dropReasonPrefix, statsForTimeseries(timeserieses[i:]).samples)
+			return stats, routed, err
+		}
+
+		fields := self.pathFields(tenant, ts)
+		channelName := writerName(fields, self.opts.layout)
 
 		log.Debugf("received timeseries data for %s", channelName)
 
-		self.m.RLock()
-		ch, ok = self.channels[channelName]
-		self.m.RUnlock()
+		// If the writer gets closed (e.g., because it was idle) between looking it up and sending to it, we remove it
+		// and try again with a new writer
+		for sent := false; !sent; {
+			self.m.RLock()
+			w, ok = self.writers[channelName]
+			self.m.RUnlock()
+
+			if !ok {
+				w, err = self.spawnWriter(ctx, fields)
+				if err != nil {
+					self.metrics.observeRejected(err, statsForTimeseries(timeserieses[i:]).samples)
+					return stats, routed, fmt.Errorf("could not spawn timeseries writer for %s: %w", channelName, err)
+				}
+			}
 
-		if !ok {
-			ch, err = self.spawnWriter(ctx, channelName)
-			if err != nil {
-				return fmt.Errorf("could not spawn timeseries writer for %s: %w", channelName, err)
+			if sent, err = w.send(ctx, ts); err != nil {
+				self.metrics.observeRejected(err, statsForTimeseries(timeserieses[i:]).samples)
+				return stats, routed, fmt.Errorf("could not send timeseries to %s: %w", channelName, err)
+			} else if !sent {
+				self.m.Lock()
+				self.removeWriter(channelName, w)
+				self.m.Unlock()
 			}
 		}
-
-		ch <- ts
+		stats.add(ts)
+		routed = append(routed, ts)
 	}
 
-	return nil
+	return stats, routed, nil
 }
 
-func (self *promserver) spawnWriter(ctx context.Context, channelName string) (chan prompb.TimeSeries, error) {
+func (self *promserver) spawnWriter(ctx context.Context, fields parquet.PathFields) (*metricWriter, error) {
+	// Writers that are evicted to make room for this one are closed after we release the lock (deferred calls run in
+	// reverse order), since closing has to wait for any in-progress sends to them
+	var evicted []*metricWriter
+	defer func() {
+		for _, w := range evicted {
+			w.close()
+		}
+	}()
+
 	self.m.Lock()
 	defer self.m.Unlock()
 
+	channelName := writerName(fields, self.opts.layout)
+
+	if tenant := fields.Tenant; tenant != "" {
+		if maxWriters := self.opts.tenancy.maxWritersFor(tenant); maxWriters > 0 && self.tenantWriters(tenant) >= maxWriters {
+			return nil, &retryableError{
+				err:        fmt.Errorf("tenant %s has reached its limit of %d writers: %w", tenant, maxWriters, errWriterLimit),
+				retryAfter: queueFullRetryAfter,
+			}
+		}
+	}
+
+	// If there used to be a writer with this name, the new one has to share its file start times so that it doesn't
+	// overwrite the old writer's files
+	starts, ok := self.starts[channelName]
+	if !ok {
+		starts = &parquet.FileStarts{}
+		self.starts[channelName] = starts
+	}
+
 	log.Infof("new metric name seen, creating writer %s", channelName)
 	writer, err := parquet.NewProm2ParquetWriter(
 		ctx,
 		self.opts.backendRoot,
-		channelName,
+		fields,
+		self.opts.layout,
+		self.opts.labelColumns.columns,
 		self.opts.backend,
 		self.opts.flushInterval,
+		self.metadata,
+		self.tracker,
+		self.opts.duplicates,
+		starts,
+		self.writerMetrics,
 	)
 	if err != nil {
 		return nil, fmt.Errorf("could not create writer for %s: %w", channelName, err)
 	}
-	ch := make(chan prompb.TimeSeries)
-	self.channels[channelName] = ch
+	evicted = self.evictLRU()
+
+	w := newMetricWriter(make(chan prompb.TimeSeries, self.opts.writers.queueSize))
+	self.writers[channelName] = w
+	self.running.start(channelName, w, writer) //nolint:contextcheck // the writer shouldn't use the request context
+
+	return w, nil
+}
+
+// recordMetadata saves any metric metadata from the request and rewrites the metadata sidecar files for any prefixes
+// that changed.  Remote write 1.0 sends metadata separately from the timeseries data, so it doesn't know what prefix a
+// metric family belongs to; we apply it to every prefix that we've seen the metric family in (but only within the
+// tenant that sent the metadata).
+func (self *promserver) recordMetadata(
+	tenant string,
+	timeserieses []prompb.TimeSeries,
+	metadata []prompb.MetricMetadata,
+) {
+	if len(metadata) == 0 {
+		return
+	}
+
+	type prefixAndMetric struct{ prefix, metricName string }
+	seen := map[prefixAndMetric]bool{}
+	for _, ts := range timeserieses {
+		prefix, metricName := prefixAndMetricName(ts)
+		seen[prefixAndMetric{tenantPrefix(tenant, prefix), metricName}] = true
+	}
 
-	go writer.Listen(ch) //nolint:contextcheck // the req context and the backend creation context should be separate
+	self.m.RLock()
+	for chName := range self.writers {
+		if tenant != "" && !strings.HasPrefix(chName, tenant+"/") {
+			continue
+		}
+		if prefix, metricName := splitWriterName(chName); metricName != "" {
+			seen[prefixAndMetric{prefix, metricName}] = true
+		}
+	}
+	self.m.RUnlock()
+
+	changedPrefixes := map[string]bool{}
+	for _, md := range metadata {
+		for pm := range seen {
+			if parquet.MetricFamilyMatches(pm.metricName, md.MetricFamilyName) &&
+				self.metadata.Update(pm.prefix, parquet.MetricMetadataFromProto(md)) {
+				changedPrefixes[pm.prefix] = true
+			}
+		}
+	}
 
-	return ch, nil
+	for prefix := range changedPrefixes {
+		self.sidecars.write(self.metadata, prefix)
+	}
 }
 
+// sidecarGroup keeps track of the metadata sidecar files that are being written in the background, so that we can wait
+// for them to finish on shutdown.
+type sidecarGroup struct {
+	m       sync.Mutex
+	pending map[string]int
+	changed chan struct{}
+}
+
+func newSidecarGroup() *sidecarGroup {
+	return &sidecarGroup{pending: map[string]int{}, changed: make(chan struct{})}
+}
+
+// write rewrites the metadata sidecar file for the prefix in the background
+func (self *sidecarGroup) write(metadata *parquet.MetadataStore, prefix string) {
+	self.m.Lock()
+	self.pending[prefix]++
+	self.m.Unlock()
+
+	go func() {
+		if err := metadata.WriteSidecar(prefix); err != nil {
+			log.Errorf("could not write metadata for %s: %v", prefix, err)
+		}
+
+		self.m.Lock()
+		defer self.m.Unlock()
+		self.pending[prefix]--
+		if self.pending[prefix] == 0 {
+			delete(self.pending, prefix)
+		}
+		close(self.changed)
+		self.changed = make(chan struct{})
+	}()
+}
+
+// wait blocks until every sidecar file has been written; if the context is done first, it returns an error listing the
+// prefixes whose sidecar files are still being written.
+func (self *sidecarGroup) wait(ctx context.Context) error {
+	for {
+		self.m.Lock()
+		if len(self.pending) == 0 {
+			self.m.Unlock()
+			return nil
+		}
+		changed := self.changed
+		self.m.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			self.m.Lock()
+			defer self.m.Unlock()
+
+			prefixes := lo.Keys(self.pending)
+			sort.Strings(prefixes)
+			return fmt.Errorf("metadata still being written for: %s: %w", strings.Join(prefixes, ", "), ctx.Err())
+		}
+	}
+}
+
+type flushResponse struct {
+	Files  []string `json:"files"`
+	Errors []string `json:"errors,omitempty"`
+}
+
+// flushData finalizes the current files for all of the writers matching the request and starts new ones.  Writers can
+// be selected by prefix (which must include the tenant directory in multi-tenant mode), by metric name (which can be a
+// glob pattern), or both.
 func (self *promserver) flushData(w http.ResponseWriter, req *http.Request) {
 	d := json.NewDecoder(req.Body)
 	d.DisallowUnknownFields()
 
 	flushReq := struct {
 		Prefix *string `json:"prefix"`
+		Metric *string `json:"metric"`
 	}{}
 
 	if err := d.Decode(&flushReq); err != nil {
@@ -175,15 +545,121 @@ func (self *promserver) flushData(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	if flushReq.Prefix == nil {
-		http.Error(w, "missing field 'prefix' in JSON object", http.StatusBadRequest)
+	if flushReq.Prefix == nil && flushReq.Metric == nil {
+		http.Error(w, "missing field 'prefix' or 'metric' in JSON object", http.StatusBadRequest)
 		return
 	}
+	if flushReq.Metric != nil {
+		if _, err := path.Match(*flushReq.Metric, ""); err != nil {
+			http.Error(w, fmt.Sprintf("invalid metric pattern: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	matches := map[string]*metricWriter{}
+	self.m.RLock()
+	for chName, mw := range self.writers {
+		_, metricName := splitWriterName(chName)
+		if flushReq.Prefix != nil && !strings.HasPrefix(chName, *flushReq.Prefix) {
+			continue
+		}
+		if flushReq.Metric != nil {
+			// We've already checked that the pattern is valid, so the only possible error is ErrBadPattern
+			if ok, err := path.Match(*flushReq.Metric, metricName); err != nil || !ok {
+				continue
+			}
+		}
+		matches[chName] = mw
+	}
+	self.m.RUnlock()
+
+	log.Infof("flushing data for %d writers", len(matches))
+	resp := rotateWriters(req.Context(), matches)
+
+	w.Header().Set("Content-Type", jsonContentType)
+	if len(resp.Errors) > 0 {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Errorf("could not write flush response: %v", err)
+	}
+}
+
+// rotateWriters finalizes the current files for all of the given writers (in parallel, since this might involve
+// uploading the files somewhere) and starts new ones
+func rotateWriters(ctx context.Context, writers map[string]*metricWriter) flushResponse {
+	var wg sync.WaitGroup
+	var resultsLock sync.Mutex
+	resp := flushResponse{Files: []string{}}
+	for chName, mw := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			files, err := mw.rotate(ctx)
+
+			resultsLock.Lock()
+			defer resultsLock.Unlock()
+			resp.Files = append(resp.Files, files...)
+			if err != nil {
+				resp.Errors = append(resp.Errors, fmt.Sprintf("%s: %v", chName, err))
+			}
+		}()
+	}
+	wg.Wait()
+	sort.Strings(resp.Files)
+	sort.Strings(resp.Errors)
+	return resp
+}
 
-	log.Infof("flushing all data for %s", *flushReq.Prefix)
-	for chName, ch := range self.channels {
-		if strings.HasPrefix(chName, *flushReq.Prefix) {
-			close(ch)
+func setLabel(lbls []prompb.Label, name, value string) []prompb.Label {
+	for i := range lbls {
+		if lbls[i].Name == name {
+			lbls[i].Value = value
+			return lbls
 		}
 	}
+	return append(lbls, prompb.Label{Name: name, Value: value})
+}
+
+// pathFields returns the values used to render the path template for the series
+func (self *promserver) pathFields(tenant string, ts prompb.TimeSeries) parquet.PathFields {
+	prefix, metricName := prefixAndMetricName(ts)
+	fields := parquet.PathFields{Tenant: tenant, Prefix: prefix, Metric: metricName}
+	if self.opts.layout == nil || len(self.opts.layout.Labels()) == 0 {
+		return fields
+	}
+
+	fields.Labels = map[string]string{}
+	for _, name := range self.opts.layout.Labels() {
+		l, _ := lo.Find(ts.Labels, func(l prompb.Label) bool { return l.Name == name })
+		fields.Labels[name] = l.Value
+	}
+	return fields
+}
+
+// writerName identifies the writer for a set of path fields; series that are written to different files need to go to
+// different writers, so the values of all the labels in the path template are included in the name.
+func writerName(fields parquet.PathFields, layout *parquet.PathTemplate) string {
+	name := fields.Dir() + "/" + fields.Metric
+	if layout != nil {
+		for _, l := range layout.Labels() {
+			name += partitionSep + fields.Labels[l]
+		}
+	}
+	return name
+}
+
+// splitWriterName returns the directory (i.e., the tenant and prefix) and metric name for a writer
+func splitWriterName(name string) (string, string) {
+	name, _, _ = strings.Cut(name, partitionSep)
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		return name[:i], name[i+1:]
+	}
+	return "", ""
+}
+
+func prefixAndMetricName(ts prompb.TimeSeries) (string, string) {
+	nameLabel, _ := lo.Find(ts.Labels, func(i prompb.Label) bool { return i.Name == model.MetricNameLabel })
+	prefixLabel, _ := lo.Find(ts.Labels, func(i prompb.Label) bool { return i.Name == prefixLabelKey })
+	return prefixLabel.Value, nameLabel.Value
 }
@@ -2,6 +2,9 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
 	"time"
@@ -11,9 +14,12 @@ import (
 	"github.com/samber/lo"
 	log "github.com/sirupsen/logrus"
 	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/spf13/afero"
 	"github.com/stretchr/testify/assert"
+	"github.com/xitongsys/parquet-go-source/mem"
 
 	"github.com/acrlabs/prom2parquet/pkg/backends"
+	"github.com/acrlabs/prom2parquet/pkg/parquet"
 )
 
 const (
@@ -28,6 +34,22 @@ const (
 // Also, these tests are sortof inherently race-y, as evidenced by this delightful constant:
 const sleepTime = 100 * time.Millisecond
 
+// closeWriters closes all of the server's writers and waits for them to finish, so that they aren't still running (and
+// using the in-memory filesystem) when the next test starts
+func closeWriters(t *testing.T, srv *promserver) {
+	t.Helper()
+
+	srv.m.RLock()
+	for _, w := range srv.writers {
+		w.close()
+	}
+	srv.m.RUnlock()
+
+	assert.Nil(t, srv.running.wait(context.TODO()))
+	assert.Nil(t, srv.tracker.waitClosed(context.TODO()))
+	assert.Nil(t, srv.sidecars.wait(context.TODO()))
+}
+
 func TestServerRun(t *testing.T) {
 	cases := map[string]struct {
 		operations          func(*promserver)
@@ -48,7 +70,7 @@ func TestServerRun(t *testing.T) {
 		t.Run(name, func(t *testing.T) {
 			logs := test.NewGlobal()
 			srv := newServer(&options{})
-			srv.channels["foo"] = make(chan prompb.TimeSeries)
+			srv.writers["foo"] = newMetricWriter(make(chan prompb.TimeSeries))
 			go srv.run()
 
 			tc.operations(srv)
@@ -73,7 +95,7 @@ func TestServerRun(t *testing.T) {
 
 func TestSendTimeseries(t *testing.T) {
 	srv := newServer(&options{})
-	srv.channels[channelName] = make(chan prompb.TimeSeries)
+	srv.writers[channelName] = newMetricWriter(make(chan prompb.TimeSeries))
 
 	ts := prompb.TimeSeries{
 		Labels: []prompb.Label{
@@ -107,17 +129,157 @@ func TestSendTimeseries(t *testing.T) {
 	}
 
 	go func() {
-		err := srv.sendTimeseries(context.TODO(), []prompb.TimeSeries{ts})
+		_, _, err := srv.sendTimeseries(context.TODO(), "", []prompb.TimeSeries{ts})
 		assert.Nil(t, err)
 	}()
 
-	val := <-srv.channels[channelName]
+	val := <-srv.writers[channelName].ch
 	assert.Equal(t, ts, val)
 }
 
 func TestSpawnWriter(t *testing.T) {
 	srv := newServer(&options{backend: backends.Memory})
-	_, err := srv.spawnWriter(context.TODO(), channelName)
+	defer closeWriters(t, srv)
+
+	_, err := srv.spawnWriter(context.TODO(), parquet.PathFields{Prefix: testPrefix, Metric: metricName})
+	assert.Nil(t, err)
+	assert.Contains(t, srv.writers, channelName)
+}
+
+func TestSendTimeseriesPathTemplateLabels(t *testing.T) {
+	layout, err := parquet.NewPathTemplate(`{{.Metric}}/namespace={{.Label "namespace"}}/{{.Timestamp}}.parquet`)
+	assert.Nil(t, err)
+
+	srv := newServer(&options{layout: layout})
+	for _, ns := range []string{"default", "kube-system"} {
+		srv.writers[channelName+partitionSep+ns] = newMetricWriter(make(chan prompb.TimeSeries, 1))
+	}
+
+	timeserieses := []prompb.TimeSeries{}
+	for _, ns := range []string{"default", "kube-system"} {
+		timeserieses = append(timeserieses, prompb.TimeSeries{
+			Labels: []prompb.Label{
+				{Name: model.MetricNameLabel, Value: metricName},
+				{Name: prefixLabelKey, Value: testPrefix},
+				{Name: "namespace", Value: ns},
+			},
+		})
+	}
+
+	_, _, err = srv.sendTimeseries(context.TODO(), "", timeserieses)
 	assert.Nil(t, err)
-	assert.Contains(t, srv.channels, channelName)
+	assert.Equal(t, timeserieses[0], <-srv.writers[channelName+partitionSep+"default"].ch)
+	assert.Equal(t, timeserieses[1], <-srv.writers[channelName+partitionSep+"kube-system"].ch)
+}
+
+func TestRecordMetadata(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	mem.SetInMemFileFs(&fs)
+
+	srv := newServer(&options{backend: backends.Memory, backendRoot: "/test"})
+	srv.writers["other-prefix/"+metricName] = newMetricWriter(make(chan prompb.TimeSeries))
+
+	ts := prompb.TimeSeries{
+		Labels: []prompb.Label{
+			{Name: model.MetricNameLabel, Value: metricName},
+			{Name: prefixLabelKey, Value: testPrefix},
+		},
+	}
+	metadata := []prompb.MetricMetadata{
+		{Type: prompb.MetricMetadata_GAUGE, MetricFamilyName: metricName, Help: "node stuff"},
+		{Type: prompb.MetricMetadata_COUNTER, MetricFamilyName: "unrelated_total"},
+	}
+
+	srv.recordMetadata("", []prompb.TimeSeries{ts}, metadata)
+	assert.Nil(t, srv.sidecars.wait(context.TODO()))
+
+	for _, prefix := range []string{testPrefix, "other-prefix"} {
+		exists, err := afero.Exists(fs, "/test/"+prefix+"/metadata.parquet")
+		assert.Nil(t, err)
+		assert.True(t, exists, prefix)
+
+		md, ok := srv.metadata.Get(prefix, metricName)
+		assert.True(t, ok)
+		assert.Equal(t, "gauge", md.Type)
+
+		_, ok = srv.metadata.Get(prefix, "unrelated_total")
+		assert.False(t, ok)
+	}
+}
+
+func TestFlushData(t *testing.T) {
+	cases := map[string]struct {
+		body         string
+		expectedCode int
+		expectedDirs []string
+	}{
+		"missing fields": {
+			body:         `{}`,
+			expectedCode: http.StatusBadRequest,
+		},
+		"bad pattern": {
+			body:         `{"metric": "kube_["}`,
+			expectedCode: http.StatusBadRequest,
+		},
+		"prefix": {
+			body:         `{"prefix": "` + testPrefix + `"}`,
+			expectedCode: http.StatusOK,
+			expectedDirs: []string{channelName, testPrefix + "/other_metric"},
+		},
+		"metric glob": {
+			body:         `{"metric": "kube_*"}`,
+			expectedCode: http.StatusOK,
+			expectedDirs: []string{"other-prefix/" + metricName, channelName},
+		},
+		"prefix and metric": {
+			body:         `{"prefix": "` + testPrefix + `", "metric": "` + metricName + `"}`,
+			expectedCode: http.StatusOK,
+			expectedDirs: []string{channelName},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			fs := afero.NewMemMapFs()
+			mem.SetInMemFileFs(&fs)
+
+			srv := newServer(&options{backend: backends.Memory, backendRoot: "/test", flushInterval: time.Hour})
+			defer closeWriters(t, srv)
+
+			for _, fields := range []parquet.PathFields{
+				{Prefix: testPrefix, Metric: metricName},
+				{Prefix: testPrefix, Metric: "other_metric"},
+				{Prefix: "other-prefix", Metric: metricName},
+			} {
+				_, err := srv.spawnWriter(context.TODO(), fields)
+				assert.Nil(t, err)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/flush", strings.NewReader(tc.body))
+			w := httptest.NewRecorder()
+			srv.flushData(w, req)
+			assert.Equal(t, tc.expectedCode, w.Code)
+			if tc.expectedCode != http.StatusOK {
+				return
+			}
+
+			var resp flushResponse
+			assert.Nil(t, json.NewDecoder(w.Body).Decode(&resp))
+			assert.Empty(t, resp.Errors)
+			assert.Len(t, resp.Files, len(tc.expectedDirs))
+			for i, dir := range tc.expectedDirs {
+				assert.True(t, strings.HasPrefix(resp.Files[i], dir+"/"), resp.Files[i])
+			}
+
+			// The writers are still usable after they've been flushed
+			_, _, err := srv.sendTimeseries(context.TODO(), "", []prompb.TimeSeries{{
+				Labels: []prompb.Label{
+					{Name: model.MetricNameLabel, Value: metricName},
+					{Name: prefixLabelKey, Value: testPrefix},
+				},
+				Samples: []prompb.Sample{{Value: 1.0}},
+			}})
+			assert.Nil(t, err)
+		})
+	}
 }
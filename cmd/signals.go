@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// handleSignals rotates all of the open files on SIGUSR1 and reloads the configuration on SIGHUP; SIGTERM and SIGINT
+// are handled by run.
+func (self *promserver) handleSignals(stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-self.flushChannel:
+			// Rotating can take a while if the files are being uploaded somewhere, so don't block other signals
+			go self.rotateAll()
+		case <-self.reloadChannel:
+			if err := self.reload(); err != nil {
+				log.Errorf("could not reload configuration: %v", err)
+			}
+		}
+	}
+}
+
+func (self *promserver) rotateAll() {
+	self.m.RLock()
+	writers := make(map[string]*metricWriter, len(self.writers))
+	for chName, w := range self.writers {
+		writers[chName] = w
+	}
+	self.m.RUnlock()
+
+	// If a writer gets stuck (e.g., because the backend is hanging), we don't want to wait for it forever
+	ctx, cancel := context.WithTimeout(context.Background(), rotateTime)
+	defer cancel()
+
+	log.Infof("rotating files for all %d writers", len(writers))
+	resp := rotateWriters(ctx, writers)
+	log.Infof("finalized %d files", len(resp.Files))
+	for _, err := range resp.Errors {
+		log.Errorf("could not finalize files: %s", err)
+	}
+}
+
+// reload re-reads the relabel rules, tenant limits, and credentials files.  Each of them is reloaded independently;
+// if one can't be loaded, the previous version is kept and an error is returned.
+func (self *promserver) reload() error {
+	log.Info("reloading configuration")
+
+	var errs []error
+	relabelCfg := relabelConfig{file: self.opts.relabel.file}
+	relabelErr := relabelCfg.validate()
+	if relabelErr != nil {
+		errs = append(errs, fmt.Errorf("invalid relabel config: %w", relabelErr))
+	}
+
+	tenancyCfg := self.opts.tenancy
+	tenancyCfg.limits = nil
+	tenancyErr := tenancyCfg.validate()
+	if tenancyErr != nil {
+		errs = append(errs, fmt.Errorf("invalid multi-tenancy config: %w", tenancyErr))
+	}
+
+	self.m.Lock()
+	if relabelErr == nil {
+		self.opts.relabel = relabelCfg
+	}
+	if tenancyErr == nil {
+		self.opts.tenancy.limits = tenancyCfg.limits
+	}
+	self.m.Unlock()
+
+	if err := self.ingestAuth.reload(); err != nil {
+		errs = append(errs, fmt.Errorf("invalid credentials: %w", err))
+	}
+	if self.flushAuth != self.ingestAuth {
+		if err := self.flushAuth.reload(); err != nil {
+			errs = append(errs, fmt.Errorf("invalid /flush credentials: %w", err))
+		}
+	}
+
+	if len(errs) == 0 {
+		log.Info("configuration reloaded")
+	}
+	return errors.Join(errs...)
+}
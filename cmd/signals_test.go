@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/xitongsys/parquet-go-source/mem"
+
+	"github.com/acrlabs/prom2parquet/pkg/backends"
+	"github.com/acrlabs/prom2parquet/pkg/parquet"
+)
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	relabelFile := writeRelabelConfig(t, "metric_relabel_configs: []\n")
+	limitsFile := filepath.Join(dir, "limits.yaml")
+	assert.Nil(t, os.WriteFile(limitsFile, []byte("tenant-a:\n  max_writers: 5\n"), 0o600))
+	tokenFile := writeSecret(t, dir, "token", "first")
+
+	opts := &options{
+		relabel:    relabelConfig{file: relabelFile},
+		tenancy:    tenancyConfig{enabled: true, header: defaultTenantHeader, maxWriters: 2, limitsFile: limitsFile},
+		ingestAuth: authConfig{bearerTokenFile: tokenFile},
+	}
+	assert.Nil(t, opts.relabel.validate())
+	assert.Nil(t, opts.tenancy.validate())
+	srv := newServer(opts)
+
+	assert.Nil(t, os.WriteFile(relabelFile, []byte(testRelabelConfig), 0o600))
+	assert.Nil(t, os.WriteFile(limitsFile, []byte("tenant-a:\n  max_writers: 10\n"), 0o600))
+	assert.Nil(t, os.WriteFile(tokenFile, []byte("second"), 0o600))
+
+	assert.Nil(t, srv.reload())
+	assert.Len(t, srv.opts.relabel.rules, 4)
+	assert.Equal(t, 10, srv.opts.tenancy.maxWritersFor("tenant-a"))
+	token, err := srv.ingestAuth.bearerToken.get()
+	assert.Nil(t, err)
+	assert.Equal(t, "second", token)
+
+	// Invalid files are reported, but the previous config stays in place
+	assert.Nil(t, os.WriteFile(relabelFile, []byte("metric_relabel_configs: [{action: bogus}]\n"), 0o600))
+	assert.Nil(t, os.WriteFile(limitsFile, []byte("not yaml: ["), 0o600))
+	assert.Nil(t, os.WriteFile(tokenFile, []byte(""), 0o600))
+
+	assert.NotNil(t, srv.reload())
+	assert.Len(t, srv.opts.relabel.rules, 4)
+	assert.Equal(t, 10, srv.opts.tenancy.maxWritersFor("tenant-a"))
+	token, err = srv.ingestAuth.bearerToken.get()
+	assert.NotNil(t, err)
+	assert.Equal(t, "", token)
+}
+
+func TestRotateAll(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	mem.SetInMemFileFs(&fs)
+
+	srv := newServer(&options{backend: backends.Memory, backendRoot: "/test", flushInterval: time.Hour})
+	defer closeWriters(t, srv)
+
+	for _, name := range []string{metricName, "other_metric"} {
+		_, err := srv.spawnWriter(context.TODO(), parquet.PathFields{Prefix: testPrefix, Metric: name})
+		assert.Nil(t, err)
+	}
+
+	srv.rotateAll()
+	resp := rotateWriters(context.TODO(), srv.writers)
+	assert.Empty(t, resp.Errors)
+	assert.Len(t, resp.Files, 2)
+	for _, f := range resp.Files {
+		assert.True(t, strings.HasPrefix(f, testPrefix+"/"), f)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/acrlabs/prom2parquet/pkg/parquet"
+)
+
+const defaultTenantHeader = "X-Scope-OrgID"
+
+type tenancyConfig struct {
+	enabled    bool
+	header     string
+	maxWriters int
+	limitsFile string
+
+	limits map[string]tenantLimits
+}
+
+// tenantLimits holds the per-tenant overrides from the limits file, which looks like:
+//
+//	tenant-a:
+//	  max_writers: 100
+type tenantLimits struct {
+	MaxWriters *int `yaml:"max_writers"`
+}
+
+// validate checks the tenancy options and loads the per-tenant limits file, if there is one
+func (self *tenancyConfig) validate() error {
+	if !self.enabled {
+		if self.limitsFile != "" {
+			return errors.New("a tenant limits file requires multi-tenancy to be enabled")
+		}
+		return nil
+	}
+
+	if self.header == "" {
+		return errors.New("the tenant header must not be empty")
+	}
+
+	if self.limitsFile != "" {
+		contents, err := os.ReadFile(self.limitsFile)
+		if err != nil {
+			return fmt.Errorf("can't read tenant limits file %s: %w", self.limitsFile, err)
+		}
+
+		limits := map[string]tenantLimits{}
+		if err := yaml.Unmarshal(contents, &limits); err != nil {
+			return fmt.Errorf("can't parse tenant limits file %s: %w", self.limitsFile, err)
+		}
+		self.limits = limits
+	}
+	return nil
+}
+
+func (self *tenancyConfig) maxWritersFor(tenant string) int {
+	if l, ok := self.limits[tenant]; ok && l.MaxWriters != nil {
+		return *l.MaxWriters
+	}
+	return self.maxWriters
+}
+
+// tenantFromRequest returns the tenant for the request from the configured header; if multi-tenancy is disabled, the
+// tenant is always empty.  The tenant is used as the top-level directory for all of the tenant's data.
+func (self *promserver) tenantFromRequest(req *http.Request) (string, error) {
+	if !self.opts.tenancy.enabled {
+		return "", nil
+	}
+
+	tenant := req.Header.Get(self.opts.tenancy.header)
+	if tenant == "" {
+		return "", fmt.Errorf("missing tenant header %s", self.opts.tenancy.header)
+	}
+
+	if err := validateDirName(tenant); err != nil {
+		return "", fmt.Errorf("invalid tenant: %w", err)
+	}
+	return tenant, nil
+}
+
+// tenantWriters counts the number of active writers for the tenant; the caller must hold the lock
+func (self *promserver) tenantWriters(tenant string) int {
+	count := 0
+	for chName := range self.writers {
+		if strings.HasPrefix(chName, tenant+"/") {
+			count++
+		}
+	}
+	return count
+}
+
+func tenantPrefix(tenant, prefix string) string {
+	return path.Join(tenant, parquet.CleanPrefix(prefix))
+}
+
+// validateDirName ensures that a client-supplied name is safe to use as a single directory component
+func validateDirName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\") {
+		return fmt.Errorf("%q is not a valid directory name", name)
+	}
+	return nil
+}
+
+// validatePrefix ensures that a client-supplied prefix (which may contain several directories) can't escape the
+// tenant's directory
+func validatePrefix(prefix string) error {
+	if strings.HasPrefix(prefix, "/") || slices.Contains(strings.Split(prefix, "/"), "..") {
+		return fmt.Errorf("%q is not a valid prefix: %w", prefix, errInvalidPrefix)
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/xitongsys/parquet-go-source/mem"
+
+	"github.com/acrlabs/prom2parquet/pkg/backends"
+	"github.com/acrlabs/prom2parquet/pkg/parquet"
+)
+
+func TestTenantFromRequest(t *testing.T) {
+	cases := map[string]struct {
+		tenancy        tenancyConfig
+		headers        map[string]string
+		expectedTenant string
+		expectedErr    bool
+	}{
+		"disabled": {
+			headers: map[string]string{defaultTenantHeader: "tenant-a"},
+		},
+		"default header": {
+			tenancy:        tenancyConfig{enabled: true, header: defaultTenantHeader},
+			headers:        map[string]string{defaultTenantHeader: "tenant-a"},
+			expectedTenant: "tenant-a",
+		},
+		"custom header": {
+			tenancy:        tenancyConfig{enabled: true, header: "X-Tenant"},
+			headers:        map[string]string{"X-Tenant": "tenant-b"},
+			expectedTenant: "tenant-b",
+		},
+		"missing header": {
+			tenancy:     tenancyConfig{enabled: true, header: defaultTenantHeader},
+			expectedErr: true,
+		},
+		"path traversal": {
+			tenancy:     tenancyConfig{enabled: true, header: defaultTenantHeader},
+			headers:     map[string]string{defaultTenantHeader: "../../etc"},
+			expectedErr: true,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			srv := newServer(&options{tenancy: tc.tenancy})
+			req := httptest.NewRequest(http.MethodPost, "/receive", nil)
+			for k, v := range tc.headers {
+				req.Header.Set(k, v)
+			}
+
+			tenant, err := srv.tenantFromRequest(req)
+			if tc.expectedErr {
+				assert.NotNil(t, err)
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, tc.expectedTenant, tenant)
+			}
+		})
+	}
+}
+
+func TestTenancyConfigValidate(t *testing.T) {
+	limitsFile := filepath.Join(t.TempDir(), "limits.yaml")
+	assert.Nil(t, os.WriteFile(limitsFile, []byte("tenant-a:\n  max_writers: 5\ntenant-b: {}\n"), 0o600))
+
+	cfg := tenancyConfig{enabled: true, header: defaultTenantHeader, maxWriters: 2, limitsFile: limitsFile}
+	assert.Nil(t, cfg.validate())
+	assert.Equal(t, 5, cfg.maxWritersFor("tenant-a"))
+	assert.Equal(t, 2, cfg.maxWritersFor("tenant-b"))
+	assert.Equal(t, 2, cfg.maxWritersFor("tenant-c"))
+
+	cfg = tenancyConfig{limitsFile: limitsFile}
+	assert.NotNil(t, cfg.validate())
+}
+
+func TestSpawnWriterTenantLimit(t *testing.T) {
+	srv := newServer(&options{
+		backend: backends.Memory,
+		tenancy: tenancyConfig{enabled: true, maxWriters: 1},
+	})
+	defer closeWriters(t, srv)
+
+	_, err := srv.spawnWriter(
+		context.TODO(),
+		parquet.PathFields{Tenant: "tenant-a", Prefix: testPrefix, Metric: metricName},
+	)
+	assert.Nil(t, err)
+	assert.Contains(t, srv.writers, "tenant-a/"+channelName)
+
+	_, err = srv.spawnWriter(
+		context.TODO(),
+		parquet.PathFields{Tenant: "tenant-a", Prefix: testPrefix, Metric: "other_metric"},
+	)
+	assert.ErrorIs(t, err, errWriterLimit)
+
+	// Other tenants have their own limits
+	_, err = srv.spawnWriter(
+		context.TODO(),
+		parquet.PathFields{Tenant: "tenant-b", Prefix: testPrefix, Metric: "other_metric"},
+	)
+	assert.Nil(t, err)
+}
+
+func TestSendTimeseriesTenant(t *testing.T) {
+	srv := newServer(&options{tenancy: tenancyConfig{enabled: true}})
+	srv.writers["tenant-a/"+channelName] = newMetricWriter(make(chan prompb.TimeSeries))
+
+	ts := prompb.TimeSeries{
+		Labels: []prompb.Label{
+			{Name: model.MetricNameLabel, Value: metricName},
+			{Name: prefixLabelKey, Value: testPrefix},
+		},
+	}
+
+	go func() {
+		_, _, err := srv.sendTimeseries(context.TODO(), "tenant-a", []prompb.TimeSeries{ts})
+		assert.Nil(t, err)
+	}()
+
+	val := <-srv.writers["tenant-a/"+channelName].ch
+	assert.Equal(t, ts, val)
+}
+
+func TestSendTimeseriesCrossTenantPrefix(t *testing.T) {
+	srv := newServer(&options{tenancy: tenancyConfig{enabled: true}})
+	srv.writers["tenant-b/"+channelName] = newMetricWriter(make(chan prompb.TimeSeries, 1))
+
+	for _, prefix := range []string{"../tenant-b/" + testPrefix, "/tenant-b/" + testPrefix} {
+		_, _, err := srv.sendTimeseries(context.TODO(), "tenant-a", []prompb.TimeSeries{{
+			Labels: []prompb.Label{
+				{Name: model.MetricNameLabel, Value: metricName},
+				{Name: prefixLabelKey, Value: prefix},
+			},
+			Samples: []prompb.Sample{{Value: 1.0}},
+		}})
+		assert.ErrorIs(t, err, errInvalidPrefix)
+
+		w := httptest.NewRecorder()
+		writeSendError(w, err)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	}
+
+	assert.Len(t, srv.writers, 1)
+	assert.Empty(t, srv.writers["tenant-b/"+channelName].ch)
+}
+
+func TestTenantPrefix(t *testing.T) {
+	assert.Equal(t, "tenant-a/tenant-b", tenantPrefix("tenant-a", "../tenant-b"))
+	assert.Equal(t, "tenant-a/foo/bar", tenantPrefix("tenant-a", "/foo/bar"))
+	assert.Equal(t, "foo", tenantPrefix("", "../foo"))
+	assert.Equal(t, "tenant-a", tenantPrefix("tenant-a", ""))
+}
+
+func TestQuerySeriesTenant(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	mem.SetInMemFileFs(&fs)
+
+	for i, tenant := range []string{"tenant-a", "tenant-ab"} {
+		ts := testSeries(metricName, "pod-a", prompb.Sample{Timestamp: 1000, Value: float64(i + 1)})
+		writeTestSeries(t, tenant+"/"+testPrefix, ts)
+	}
+
+	srv := newServer(&options{backend: backends.Memory, backendRoot: "/test"})
+	res, err := srv.querySeries(context.TODO(), "tenant-a", 0, 15000, []*labels.Matcher{
+		labels.MustNewMatcher(labels.MatchEqual, model.MetricNameLabel, metricName),
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []*prompb.TimeSeries{{
+		Labels: []prompb.Label{
+			{Name: model.MetricNameLabel, Value: metricName},
+			{Name: "pod", Value: "pod-a"},
+			{Name: prefixLabelKey, Value: testPrefix},
+		},
+		Samples: []prompb.Sample{{Value: 1.0, Timestamp: 1000}},
+	}}, res)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+	log "github.com/sirupsen/logrus"
+)
+
+// The protocols that the server offers during the TLS handshake; net/http normally adds these to the server's TLS
+// config, but the config returned by GetConfigForClient replaces it, so we have to set them ourselves or HTTP/2 would
+// be disabled
+//
+//nolint:gochecknoglobals
+var tlsNextProtos = []string{"h2", "http/1.1"}
+
+type tlsConfig struct {
+	certFile         string
+	keyFile          string
+	clientCAFile     string
+	clientCertPrefix bool
+}
+
+func (self tlsConfig) enabled() bool {
+	return self.certFile != "" || self.keyFile != ""
+}
+
+func (self tlsConfig) validate() error {
+	if (self.certFile == "") != (self.keyFile == "") {
+		return errors.New("TLS requires both a certificate and a key file")
+	} else if self.clientCAFile != "" && !self.enabled() {
+		return errors.New("client certificate verification requires a TLS certificate and key")
+	} else if self.clientCertPrefix && self.clientCAFile == "" {
+		return errors.New("using the client certificate as the prefix requires a client CA file")
+	}
+
+	if self.enabled() {
+		if _, err := newCertReloader(self); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// certReloader serves the TLS certificate and client CA bundle from disk, re-reading them whenever the files change
+// so that rotated certificates (e.g., from cert-manager) are picked up without a restart.  If a reload fails, the
+// previously-loaded certificates continue to be used.
+type certReloader struct {
+	cfg tlsConfig
+
+	m         sync.Mutex
+	modTimes  [3]time.Time
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+}
+
+func newCertReloader(cfg tlsConfig) (*certReloader, error) {
+	r := &certReloader{cfg: cfg}
+	if err := r.maybeReload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (self *certReloader) config() *tls.Config {
+	return &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		NextProtos:         slices.Clone(tlsNextProtos),
+		GetCertificate:     self.getCertificate,
+		GetConfigForClient: self.getConfigForClient,
+	}
+}
+
+func (self *certReloader) getCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	self.reloadOrWarn()
+
+	self.m.Lock()
+	defer self.m.Unlock()
+	return self.cert, nil
+}
+
+func (self *certReloader) getConfigForClient(_ *tls.ClientHelloInfo) (*tls.Config, error) {
+	self.reloadOrWarn()
+
+	self.m.Lock()
+	defer self.m.Unlock()
+
+	cfg := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		NextProtos:   slices.Clone(tlsNextProtos),
+		Certificates: []tls.Certificate{*self.cert},
+	}
+	if self.clientCAs != nil {
+		cfg.ClientCAs = self.clientCAs
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+func (self *certReloader) reloadOrWarn() {
+	if err := self.maybeReload(); err != nil {
+		log.Warnf("could not reload TLS certificates, continuing to use the old ones: %v", err)
+	}
+}
+
+func (self *certReloader) maybeReload() error {
+	self.m.Lock()
+	defer self.m.Unlock()
+
+	files := [3]string{self.cfg.certFile, self.cfg.keyFile, self.cfg.clientCAFile}
+	modTimes := [3]time.Time{}
+	for i, file := range files {
+		if file == "" {
+			continue
+		}
+
+		info, err := os.Stat(file)
+		if err != nil {
+			return fmt.Errorf("can't stat %s: %w", file, err)
+		}
+		modTimes[i] = info.ModTime()
+	}
+
+	if self.cert != nil && modTimes == self.modTimes {
+		return nil
+	}
+
+	log.Infof("loading TLS certificate from %s", self.cfg.certFile)
+	cert, err := tls.LoadX509KeyPair(self.cfg.certFile, self.cfg.keyFile)
+	if err != nil {
+		return fmt.Errorf("can't load TLS certificate: %w", err)
+	}
+
+	var clientCAs *x509.CertPool
+	if self.cfg.clientCAFile != "" {
+		pem, err := os.ReadFile(self.cfg.clientCAFile)
+		if err != nil {
+			return fmt.Errorf("can't read client CA file %s: %w", self.cfg.clientCAFile, err)
+		}
+
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in client CA file %s", self.cfg.clientCAFile)
+		}
+	}
+
+	self.cert = &cert
+	self.clientCAs = clientCAs
+	self.modTimes = modTimes
+	return nil
+}
+
+func (self *promserver) listenAndServeTLS() error {
+	reloader, err := newCertReloader(self.opts.tls)
+	if err != nil {
+		return err
+	}
+
+	self.httpserv.TLSConfig = reloader.config()
+	return self.httpserv.ListenAndServeTLS("", "")
+}
+
+// overridePrefix replaces the prefix label on all of the timeseries with the identity from the client certificate, if
+// that option is enabled; this prevents clients from writing data into each other's directories.
+func (self *promserver) overridePrefix(req *http.Request, timeserieses []prompb.TimeSeries) error {
+	if !self.opts.tls.clientCertPrefix {
+		return nil
+	}
+
+	identity, err := clientCertIdentity(req)
+	if err != nil {
+		return err
+	}
+
+	for i := range timeserieses {
+		timeserieses[i].Labels = setLabel(timeserieses[i].Labels, prefixLabelKey, identity)
+	}
+	return nil
+}
+
+// clientCertIdentity returns the common name of the verified client certificate for the request (falling back to the
+// first DNS name if the common name is empty).  Since the identity is used as a directory name, it's rejected if it
+// could escape the backend root.
+func clientCertIdentity(req *http.Request) (string, error) {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return "", errors.New("no verified client certificate")
+	}
+
+	cert := req.TLS.VerifiedChains[0][0]
+	identity := cert.Subject.CommonName
+	if identity == "" && len(cert.DNSNames) > 0 {
+		identity = cert.DNSNames[0]
+	}
+
+	if err := validateDirName(identity); err != nil {
+		return "", fmt.Errorf("invalid client certificate identity: %w", err)
+	}
+	return identity, nil
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeTestCert(t *testing.T, dir, commonName string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	assert.Nil(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+	assert.Nil(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	assert.Nil(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600))
+	return certFile, keyFile
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir, "first")
+
+	reloader, err := newCertReloader(tlsConfig{certFile: certFile, keyFile: keyFile})
+	assert.Nil(t, err)
+
+	cert, err := reloader.getCertificate(nil)
+	assert.Nil(t, err)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	assert.Nil(t, err)
+	assert.Equal(t, "first", leaf.Subject.CommonName)
+
+	writeTestCert(t, dir, "second")
+	later := time.Now().Add(time.Minute)
+	assert.Nil(t, os.Chtimes(certFile, later, later))
+	assert.Nil(t, os.Chtimes(keyFile, later, later))
+
+	cert, err = reloader.getCertificate(nil)
+	assert.Nil(t, err)
+	leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	assert.Nil(t, err)
+	assert.Equal(t, "second", leaf.Subject.CommonName)
+
+	// A broken file shouldn't replace the certificate we already have
+	assert.Nil(t, os.WriteFile(certFile, []byte("garbage"), 0o600))
+	assert.Nil(t, os.Chtimes(certFile, later.Add(time.Minute), later.Add(time.Minute)))
+	cert, err = reloader.getCertificate(nil)
+	assert.Nil(t, err)
+	leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	assert.Nil(t, err)
+	assert.Equal(t, "second", leaf.Subject.CommonName)
+}
+
+func TestTLSConfigValidate(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir, "server")
+
+	cases := map[string]struct {
+		cfg         tlsConfig
+		expectedErr bool
+	}{
+		"disabled":        {cfg: tlsConfig{}},
+		"tls":             {cfg: tlsConfig{certFile: certFile, keyFile: keyFile}},
+		"mtls":            {cfg: tlsConfig{certFile: certFile, keyFile: keyFile, clientCAFile: certFile}},
+		"missing key":     {cfg: tlsConfig{certFile: certFile}, expectedErr: true},
+		"ca without cert": {cfg: tlsConfig{clientCAFile: certFile}, expectedErr: true},
+		"prefix without ca": {
+			cfg:         tlsConfig{certFile: certFile, keyFile: keyFile, clientCertPrefix: true},
+			expectedErr: true,
+		},
+		"bad ca file": {
+			cfg:         tlsConfig{certFile: certFile, keyFile: keyFile, clientCAFile: keyFile},
+			expectedErr: true,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			err := tc.cfg.validate()
+			if tc.expectedErr {
+				assert.NotNil(t, err)
+			} else {
+				assert.Nil(t, err)
+			}
+		})
+	}
+}
+
+func TestOverridePrefix(t *testing.T) {
+	cases := map[string]struct {
+		commonName     string
+		dnsNames       []string
+		expectedPrefix string
+		expectedErr    bool
+	}{
+		"common name":    {commonName: "tenant-a", expectedPrefix: "tenant-a"},
+		"dns name":       {dnsNames: []string{"tenant-b.example.com"}, expectedPrefix: "tenant-b.example.com"},
+		"path traversal": {commonName: "../etc", expectedErr: true},
+		"empty identity": {expectedErr: true},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			srv := newServer(&options{tls: tlsConfig{clientCertPrefix: true}})
+			req := httptest.NewRequest(http.MethodPost, "/receive", nil)
+			req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{
+				Subject:  pkix.Name{CommonName: tc.commonName},
+				DNSNames: tc.dnsNames,
+			}}}}
+
+			timeserieses := []prompb.TimeSeries{
+				{Labels: []prompb.Label{{Name: model.MetricNameLabel, Value: metricName}}},
+				{Labels: []prompb.Label{
+					{Name: model.MetricNameLabel, Value: metricName},
+					{Name: prefixLabelKey, Value: "somebody-else"},
+				}},
+			}
+			err := srv.overridePrefix(req, timeserieses)
+			if tc.expectedErr {
+				assert.NotNil(t, err)
+				return
+			}
+
+			assert.Nil(t, err)
+			for _, ts := range timeserieses {
+				prefix, _ := prefixAndMetricName(ts)
+				assert.Equal(t, tc.expectedPrefix, prefix)
+			}
+		})
+	}
+}
+
+func TestOverridePrefixNoClientCert(t *testing.T) {
+	srv := newServer(&options{tls: tlsConfig{clientCertPrefix: true}})
+	req := httptest.NewRequest(http.MethodPost, "/receive", nil)
+	assert.NotNil(t, srv.overridePrefix(req, []prompb.TimeSeries{}))
+}
+
+func TestMutualTLSHandshake(t *testing.T) {
+	serverDir, clientDir := t.TempDir(), t.TempDir()
+	certFile, keyFile := writeTestCert(t, serverDir, "127.0.0.1")
+	clientCertFile, clientKeyFile := writeTestCert(t, clientDir, "tenant-a")
+
+	reloader, err := newCertReloader(tlsConfig{certFile: certFile, keyFile: keyFile, clientCAFile: clientCertFile})
+	assert.Nil(t, err)
+
+	srv := newServer(&options{})
+	ts := httptest.NewUnstartedServer(srv.httpserv.Handler)
+	ts.TLS = reloader.config()
+	ts.StartTLS()
+	defer ts.Close()
+
+	clientCert, err := tls.LoadX509KeyPair(clientCertFile, clientKeyFile)
+	assert.Nil(t, err)
+
+	cases := map[string]struct {
+		certs       []tls.Certificate
+		expectedErr bool
+	}{
+		"with client cert":    {certs: []tls.Certificate{clientCert}},
+		"without client cert": {expectedErr: true},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			client := &http.Client{Transport: &http.Transport{
+				//nolint:gosec // the test server uses a self-signed certificate
+				TLSClientConfig: &tls.Config{Certificates: tc.certs, InsecureSkipVerify: true},
+			}}
+
+			resp, err := client.Post(ts.URL+"/flush", jsonContentType, nil)
+			if tc.expectedErr {
+				assert.NotNil(t, err)
+				return
+			}
+
+			assert.Nil(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		})
+	}
+}
+
+func TestTLSHandshakeHTTP2(t *testing.T) {
+	certFile, keyFile := writeTestCert(t, t.TempDir(), "127.0.0.1")
+	reloader, err := newCertReloader(tlsConfig{certFile: certFile, keyFile: keyFile})
+	assert.Nil(t, err)
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", reloader.config())
+	assert.Nil(t, err)
+	defer ln.Close()
+
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			_ = conn.(*tls.Conn).Handshake() //nolint:forcetypeassert // tls.Listen always returns TLS connections
+			conn.Close()
+		}
+	}()
+
+	//nolint:gosec // the test server uses a self-signed certificate
+	conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{NextProtos: tlsNextProtos, InsecureSkipVerify: true})
+	assert.Nil(t, err)
+	defer conn.Close()
+	assert.Equal(t, "h2", conn.ConnectionState().NegotiatedProtocol)
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/samber/lo"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/acrlabs/prom2parquet/pkg/wal"
+)
+
+const walCheckpointInterval = time.Minute
+
+// fileTracker keeps track of which sets of parquet files are currently open.  Each set gets an increasing ID when it's
+// opened, so if every set with an ID <= N has been closed, then all the data that was handed to the writers before
+// set N+1 was opened is durably stored.  It also counts the failures (files that couldn't be written, or data that was
+// dropped) that the WAL manager hasn't dealt with yet.
+type fileTracker struct {
+	health *backendHealth
+
+	m        sync.Mutex
+	lastID   uint64
+	open     map[uint64]string
+	failures int
+	changed  chan struct{}
+}
+
+func newFileTracker(health *backendHealth) *fileTracker {
+	return &fileTracker{
+		health:  health,
+		open:    map[uint64]string{},
+		changed: make(chan struct{}),
+	}
+}
+
+func (self *fileTracker) FilesOpened(dataFile string) uint64 {
+	self.m.Lock()
+	defer self.m.Unlock()
+
+	self.lastID++
+	self.open[self.lastID] = dataFile
+	return self.lastID
+}
+
+func (self *fileTracker) FilesClosed(id uint64, ok bool) {
+	self.m.Lock()
+	defer self.m.Unlock()
+
+	// If the files couldn't be written, we remember that so that the WAL segments that might hold their data are kept,
+	// and the data is replayed the next time we start up
+	if !ok {
+		log.Errorf("parquet files %s could not be written; their data will be kept in the WAL", self.open[id])
+		self.failures++
+		self.health.failed(time.Now())
+	}
+	delete(self.open, id)
+
+	close(self.changed)
+	self.changed = make(chan struct{})
+}
+
+// dataDropped records that a writer lost some of the data that was handed to it; like files that couldn't be written,
+// this keeps the WAL segments that might hold the data, so that it's replayed the next time we start up
+func (self *fileTracker) dataDropped(writer string) {
+	self.m.Lock()
+	defer self.m.Unlock()
+
+	log.Errorf("writer %s dropped queued data; it will be kept in the WAL", writer)
+	self.failures++
+	self.health.failed(time.Now())
+}
+
+// takeFailures returns true if there have been any failures since the last time it was called
+func (self *fileTracker) takeFailures() bool {
+	self.m.Lock()
+	defer self.m.Unlock()
+
+	failed := self.failures > 0
+	self.failures = 0
+	return failed
+}
+
+// mark returns the ID of the most recently-opened set of files
+func (self *fileTracker) mark() uint64 {
+	self.m.Lock()
+	defer self.m.Unlock()
+	return self.lastID
+}
+
+// closedThrough returns true if every set of files with an ID <= mark has been closed, and there aren't any failures
+// that haven't been taken yet (since we don't know which segments they affect)
+func (self *fileTracker) closedThrough(mark uint64) bool {
+	self.m.Lock()
+	defer self.m.Unlock()
+
+	if self.failures > 0 {
+		return false
+	}
+	for id := range self.open {
+		if id <= mark {
+			return false
+		}
+	}
+	return true
+}
+
+// isOpen returns true if the data file belongs to a set of files that hasn't been closed yet
+func (self *fileTracker) isOpen(dataFile string) bool {
+	self.m.Lock()
+	defer self.m.Unlock()
+	return lo.Contains(lo.Values(self.open), dataFile)
+}
+
+func (self *fileTracker) numOpen() int {
+	self.m.Lock()
+	defer self.m.Unlock()
+	return len(self.open)
+}
+
+// waitClosed blocks until every open set of files has been closed (which, for remote backends, means that they've been
+// uploaded); if the context is done first, it returns an error listing the files that are still open.
+func (self *fileTracker) waitClosed(ctx context.Context) error {
+	for {
+		self.m.Lock()
+		if len(self.open) == 0 {
+			self.m.Unlock()
+			return nil
+		}
+		changed := self.changed
+		self.m.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			self.m.Lock()
+			defer self.m.Unlock()
+
+			files := lo.Values(self.open)
+			sort.Strings(files)
+			return fmt.Errorf("files still open: %s: %w", strings.Join(files, ", "), ctx.Err())
+		}
+	}
+}
+
+func (self *promserver) startWAL() error {
+	mgr, err := newWALManager(self.opts.walDir, self.tracker, self.running)
+	if err != nil {
+		return err
+	}
+
+	if err := mgr.replay(func(tenant string, timeserieses []prompb.TimeSeries) error {
+		// Requests with an invalid prefix are logged before they're rejected; they'll never succeed, so we skip them
+		// instead of refusing to start
+		if _, _, err := self.sendTimeseries(context.Background(), tenant, timeserieses); errors.Is(err, errInvalidPrefix) {
+			log.Warnf("skipping WAL record: %v", err)
+		} else if err != nil {
+			return err
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	self.wal = mgr
+	go mgr.run()
+	return nil
+}
+
+// logToWAL durably records the timeseries (if the WAL is enabled) before they're sent to the writers; the returned
+// function must be called once they've been sent.
+func (self *promserver) logToWAL(tenant string, timeserieses []prompb.TimeSeries) (func(), error) {
+	if self.wal == nil {
+		return func() {}, nil
+	}
+
+	seg, err := self.wal.log(tenant, timeserieses)
+	if err != nil {
+		return nil, err
+	}
+	return func() { self.wal.done(seg) }, nil
+}
+
+type sealedSegment struct {
+	num    int
+	queued map[*metricWriter]uint64
+	mark   uint64
+	marked bool
+}
+
+// walManager decides when WAL segments can be removed.  A segment is "sealed" when it's cut; once every request that
+// logged data to it has handed that data off to the writers, we note how much data has been queued for each writer.
+// The data can sit in the queues for a while (and the writers may open new files in the meantime), so once the writers
+// have worked through their queues up to that point, we record the current file tracker mark, and once all of the
+// files up to that mark are closed, the segment is no longer needed.
+//
+// If some data couldn't be written, any of the segments that exist at the time might hold it, so all of them are kept
+// (and replayed on the next startup); segments that are started after that are removed as usual.
+type walManager struct {
+	wal     *wal.WAL
+	tracker *fileTracker
+	writers *writerGroup
+
+	m        sync.Mutex
+	inflight map[int]int
+	sealed   []*sealedSegment
+	failed   bool
+	stop     chan struct{}
+}
+
+func newWALManager(dir string, tracker *fileTracker, writers *writerGroup) (*walManager, error) {
+	w, err := wal.Open(dir)
+	if err != nil {
+		return nil, fmt.Errorf("can't open WAL: %w", err)
+	}
+
+	return &walManager{
+		wal:      w,
+		tracker:  tracker,
+		writers:  writers,
+		inflight: map[int]int{},
+		stop:     make(chan struct{}),
+	}, nil
+}
+
+// log writes the timeseries to the WAL; the caller must call done with the returned segment number once the data has
+// been handed off to the writers (whether or not that succeeded).
+func (self *walManager) log(tenant string, timeserieses []prompb.TimeSeries) (int, error) {
+	self.m.Lock()
+	defer self.m.Unlock()
+
+	// We hold the lock while writing so that the segment can't be cut (and marked) before we've registered as inflight
+	seg, err := self.wal.Log(tenant, timeserieses)
+	if err != nil {
+		return 0, fmt.Errorf("can't write to WAL: %w", err)
+	}
+	self.inflight[seg]++
+	return seg, nil
+}
+
+func (self *walManager) done(seg int) {
+	self.m.Lock()
+	defer self.m.Unlock()
+
+	self.inflight[seg]--
+	if self.inflight[seg] <= 0 {
+		delete(self.inflight, seg)
+	}
+}
+
+// replay sends all of the data from a previous run's WAL segments to the writers
+func (self *walManager) replay(send wal.ReplayFunc) error {
+	replayed, err := self.wal.Replay(send)
+	if err != nil {
+		return fmt.Errorf("can't replay WAL: %w", err)
+	}
+
+	self.m.Lock()
+	defer self.m.Unlock()
+	for _, num := range replayed {
+		self.sealed = append(self.sealed, &sealedSegment{num: num})
+	}
+	log.Infof("replayed %d WAL segments", len(replayed))
+	return nil
+}
+
+// checkpoint cuts the current segment and removes any segments whose data is all durably stored in parquet files
+func (self *walManager) checkpoint() {
+	self.m.Lock()
+	defer self.m.Unlock()
+
+	// The failures have to be taken before cutting, so that any data they lost is in a sealed segment; if we can't
+	// cut, we have to wait until we can before dealing with them
+	failed := self.tracker.takeFailures() || self.failed
+	if num, ok, err := self.wal.Cut(); err != nil {
+		log.Errorf("could not cut WAL segment: %v", err)
+		if failed {
+			self.failed = true
+			return
+		}
+	} else if ok {
+		self.sealed = append(self.sealed, &sealedSegment{num: num})
+	}
+	self.failed = false
+
+	if failed && len(self.sealed) > 0 {
+		nums := lo.Map(self.sealed, func(s *sealedSegment, _ int) int { return s.num })
+		log.Warnf("keeping WAL segments %v until the next startup, since they may hold data that couldn't be written", nums)
+		self.sealed = nil
+	}
+
+	for _, s := range self.sealed {
+		if s.marked {
+			continue
+		}
+		if s.queued == nil && self.inflight[s.num] == 0 {
+			s.queued = self.writers.queued()
+		}
+		if s.queued != nil && self.writers.writtenThrough(s.queued) {
+			s.mark = self.tracker.mark()
+			s.marked = true
+		}
+	}
+
+	// Segments have to be removed in order, otherwise a crash could leave a gap in the replayed data
+	removed := 0
+	for _, s := range self.sealed {
+		if !s.marked || !self.tracker.closedThrough(s.mark) {
+			break
+		}
+
+		log.Debugf("removing WAL segment %d", s.num)
+		if err := self.wal.Remove(s.num); err != nil {
+			log.Errorf("could not remove WAL segment: %v", err)
+			break
+		}
+		removed++
+	}
+	self.sealed = self.sealed[removed:]
+}
+
+func (self *walManager) run() {
+	ticker := time.NewTicker(walCheckpointInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-self.stop:
+			return
+		case <-ticker.C:
+			self.checkpoint()
+		}
+	}
+}
+
+// shutdown removes every WAL segment whose data made it into parquet, so that it isn't replayed again on the next
+// startup, and closes the WAL; it should be called once the writers have finished closing their files.
+func (self *walManager) shutdown() {
+	close(self.stop)
+	self.checkpoint()
+
+	if err := self.wal.Close(); err != nil {
+		log.Errorf("could not close WAL: %v", err)
+	}
+}
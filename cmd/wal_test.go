@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/xitongsys/parquet-go-source/mem"
+
+	"github.com/acrlabs/prom2parquet/pkg/backends"
+	"github.com/acrlabs/prom2parquet/pkg/parquet"
+	"github.com/acrlabs/prom2parquet/pkg/wal"
+)
+
+func testWALTimeseries() []prompb.TimeSeries {
+	return []prompb.TimeSeries{{
+		Labels: []prompb.Label{
+			{Name: model.MetricNameLabel, Value: metricName},
+			{Name: prefixLabelKey, Value: testPrefix},
+		},
+		Samples: []prompb.Sample{{Value: 1.0, Timestamp: 1000}},
+	}}
+}
+
+func TestWALCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	tracker := newFileTracker(nil)
+	mgr, err := newWALManager(dir, tracker, newWriterGroup(tracker))
+	assert.Nil(t, err)
+
+	filesID := tracker.FilesOpened("foo/1.parquet")
+	seg, err := mgr.log("", testWALTimeseries())
+	assert.Nil(t, err)
+	segFile := filepath.Join(dir, "00000000")
+
+	// The request hasn't handed its data off to the writers yet
+	mgr.checkpoint()
+	assert.FileExists(t, segFile)
+
+	// The data is in the writers, but the files aren't closed yet
+	mgr.done(seg)
+	mgr.checkpoint()
+	assert.FileExists(t, segFile)
+
+	// Files that are opened after the data was handed off don't hold anything up
+	tracker.FilesOpened("foo/2.parquet")
+	tracker.FilesClosed(filesID, true)
+	mgr.checkpoint()
+	assert.NoFileExists(t, segFile)
+}
+
+func TestWALCheckpointFailedFiles(t *testing.T) {
+	dir := t.TempDir()
+	tracker := newFileTracker(nil)
+	mgr, err := newWALManager(dir, tracker, newWriterGroup(tracker))
+	assert.Nil(t, err)
+
+	filesID := tracker.FilesOpened("foo/1.parquet")
+	seg, err := mgr.log("", testWALTimeseries())
+	assert.Nil(t, err)
+	mgr.done(seg)
+	tracker.FilesClosed(filesID, false)
+
+	mgr.checkpoint()
+	assert.FileExists(t, filepath.Join(dir, "00000000"))
+	assert.Equal(t, 0, tracker.numOpen())
+}
+
+func TestWALCheckpointAfterFailure(t *testing.T) {
+	dir := t.TempDir()
+	tracker := newFileTracker(nil)
+	mgr, err := newWALManager(dir, tracker, newWriterGroup(tracker))
+	assert.Nil(t, err)
+
+	filesID := tracker.FilesOpened("foo/1.parquet")
+	seg, err := mgr.log("", testWALTimeseries())
+	assert.Nil(t, err)
+	mgr.done(seg)
+	tracker.FilesClosed(filesID, false)
+	mgr.checkpoint()
+
+	// Data that's written after the failure has been dealt with goes in a new segment, which can be removed as usual;
+	// the segment that might hold the lost data is kept for the next startup
+	filesID = tracker.FilesOpened("foo/2.parquet")
+	seg, err = mgr.log("", testWALTimeseries())
+	assert.Nil(t, err)
+	mgr.done(seg)
+	mgr.checkpoint()
+	assert.FileExists(t, filepath.Join(dir, "00000001"))
+
+	tracker.FilesOpened("foo/3.parquet")
+	tracker.FilesClosed(filesID, true)
+	mgr.checkpoint()
+	assert.NoFileExists(t, filepath.Join(dir, "00000001"))
+	assert.FileExists(t, filepath.Join(dir, "00000000"))
+}
+
+func TestWALCheckpointQueuedData(t *testing.T) {
+	dir := t.TempDir()
+	tracker := newFileTracker(nil)
+	writers := newWriterGroup(tracker)
+	mgr, err := newWALManager(dir, tracker, writers)
+	assert.Nil(t, err)
+
+	// The writer isn't listening, so the data just sits in its queue
+	w := newMetricWriter(make(chan prompb.TimeSeries, 1))
+	w.writer = &parquet.Prom2ParquetWriter{}
+	writers.running[w] = channelName
+
+	filesID := tracker.FilesOpened("foo/1.parquet")
+	seg, err := mgr.log("", testWALTimeseries())
+	assert.Nil(t, err)
+	sent, err := w.send(context.TODO(), testWALTimeseries()[0])
+	assert.Nil(t, err)
+	assert.True(t, sent)
+	mgr.done(seg)
+	segFile := filepath.Join(dir, "00000000")
+
+	// The writer can open new files before it gets to the queued data, so the old files being closed doesn't mean
+	// anything
+	nextID := tracker.FilesOpened("foo/2.parquet")
+	tracker.FilesClosed(filesID, true)
+	mgr.checkpoint()
+	assert.FileExists(t, segFile)
+
+	// Once the writer is done with the data, the segment can be removed when the files it might be in are closed
+	delete(writers.running, w)
+	mgr.checkpoint()
+	assert.FileExists(t, segFile)
+
+	tracker.FilesClosed(nextID, true)
+	mgr.checkpoint()
+	assert.NoFileExists(t, segFile)
+}
+
+func TestWALCheckpointDroppedData(t *testing.T) {
+	dir := t.TempDir()
+	tracker := newFileTracker(nil)
+	mgr, err := newWALManager(dir, tracker, newWriterGroup(tracker))
+	assert.Nil(t, err)
+
+	filesID := tracker.FilesOpened("foo/1.parquet")
+	seg, err := mgr.log("", testWALTimeseries())
+	assert.Nil(t, err)
+	mgr.done(seg)
+	tracker.dataDropped(channelName)
+	tracker.FilesClosed(filesID, true)
+
+	mgr.checkpoint()
+	assert.FileExists(t, filepath.Join(dir, "00000000"))
+}
+
+func TestFileTrackerWaitClosed(t *testing.T) {
+	tracker := newFileTracker(nil)
+	first := tracker.FilesOpened("foo/1.parquet")
+	second := tracker.FilesOpened("bar/1.parquet")
+	tracker.FilesClosed(first, true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), sleepTime)
+	defer cancel()
+	err := tracker.waitClosed(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.ErrorContains(t, err, "bar/1.parquet")
+	assert.NotContains(t, err.Error(), "foo/1.parquet")
+
+	go tracker.FilesClosed(second, false)
+	assert.Nil(t, tracker.waitClosed(context.TODO()))
+}
+
+func TestStartWALReplay(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	mem.SetInMemFileFs(&fs)
+
+	dir := t.TempDir()
+	w, err := wal.Open(dir)
+	assert.Nil(t, err)
+	_, err = w.Log("", testWALTimeseries())
+	assert.Nil(t, err)
+	assert.Nil(t, w.Close())
+
+	srv := newServer(&options{
+		backend:       backends.Memory,
+		backendRoot:   "/test",
+		flushInterval: time.Minute,
+		walDir:        dir,
+	})
+	assert.Nil(t, srv.startWAL())
+	assert.Contains(t, srv.writers, channelName)
+
+	// The replayed segment is removed once the files it was written to are closed
+	closeWriters(t, srv)
+	srv.wal.shutdown()
+	assert.NoFileExists(t, filepath.Join(dir, "00000000"))
+}
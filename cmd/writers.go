@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/samber/lo"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/acrlabs/prom2parquet/pkg/parquet"
+)
+
+const maxWriterEvictionInterval = time.Minute
+
+var errWriterStopped = errors.New("writer has stopped")
+
+type writerConfig struct {
+	idleTimeout time.Duration
+	maxOpen     int
+	queueSize   int
+}
+
+func (self writerConfig) validate() error {
+	if self.idleTimeout < 0 {
+		return errors.New("the writer idle timeout must not be negative")
+	} else if self.maxOpen < 0 {
+		return errors.New("the maximum number of open writers must not be negative")
+	} else if self.queueSize < 0 {
+		return errors.New("the writer queue size must not be negative")
+	}
+	return nil
+}
+
+// metricWriter is the server's handle to the goroutine that writes the data for a single metric.  Writers can be
+// closed (e.g., because they've been idle for too long) while another request is trying to send data to them, so all
+// sends go through the handle, which guarantees that we never send on a closed channel.
+type metricWriter struct {
+	ch       chan prompb.TimeSeries
+	writer   *parquet.Prom2ParquetWriter
+	lastUsed atomic.Int64
+	queued   atomic.Uint64
+	stopped  chan struct{}
+
+	m      sync.RWMutex
+	closed bool
+}
+
+func newMetricWriter(ch chan prompb.TimeSeries) *metricWriter {
+	w := &metricWriter{ch: ch, stopped: make(chan struct{})}
+	w.lastUsed.Store(time.Now().UnixNano())
+	return w
+}
+
+// send queues the timeseries up for the writer; it returns false if the writer has already been closed, in which case
+// the caller needs to get a new writer.  If the writer's queue is full, send waits a little while for the writer to
+// catch up and then gives up with a retryable error.
+func (self *metricWriter) send(ctx context.Context, ts prompb.TimeSeries) (bool, error) {
+	self.m.RLock()
+	defer self.m.RUnlock()
+
+	if self.closed {
+		return false, nil
+	}
+
+	self.lastUsed.Store(time.Now().UnixNano())
+	select {
+	case self.ch <- ts:
+		self.queued.Add(1)
+		return true, nil
+	default:
+	}
+
+	timer := time.NewTimer(maxQueueWait)
+	defer timer.Stop()
+	select {
+	case self.ch <- ts:
+		self.queued.Add(1)
+		return true, nil
+	case <-timer.C:
+		return false, &retryableError{err: errQueueFull, retryAfter: queueFullRetryAfter}
+	case <-ctx.Done():
+		return false, fmt.Errorf("request cancelled while waiting for writer: %w", ctx.Err())
+	}
+}
+
+// rotate finalizes the writer's current files and starts new ones, returning the files that were finalized; if the
+// writer has already been closed, its files are being finalized anyways, so there's nothing to do.  If the writer stops
+// listening (e.g., because it couldn't create its files) before it gets to the rotation, rotate returns an error
+// instead of waiting for it.
+func (self *metricWriter) rotate(ctx context.Context) ([]string, error) {
+	self.m.RLock()
+	defer self.m.RUnlock()
+
+	if self.closed || self.writer == nil {
+		return nil, nil
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	go func() {
+		select {
+		case <-self.stopped:
+			cancel(errWriterStopped)
+		case <-ctx.Done():
+		}
+	}()
+
+	files, err := self.writer.Rotate(ctx)
+	if err != nil && errors.Is(context.Cause(ctx), errWriterStopped) {
+		return files, errWriterStopped
+	}
+	return files, err //nolint:wrapcheck // the writer's errors already have enough context
+}
+
+// close waits for any in-progress sends to finish and then closes the channel, which causes the writer to flush its
+// files and exit; it's safe to call more than once.
+func (self *metricWriter) close() {
+	self.m.Lock()
+	defer self.m.Unlock()
+
+	if !self.closed {
+		self.closed = true
+		close(self.ch)
+	}
+}
+
+func (self *metricWriter) idleSince() time.Time {
+	return time.Unix(0, self.lastUsed.Load())
+}
+
+// writerGroup keeps track of every writer goroutine that's still running, including writers that have been evicted but
+// haven't finished closing their files yet, so that we can wait for all of them to finish on shutdown.
+type writerGroup struct {
+	tracker *fileTracker
+
+	m       sync.Mutex
+	running map[*metricWriter]string
+	changed chan struct{}
+}
+
+func newWriterGroup(tracker *fileTracker) *writerGroup {
+	return &writerGroup{tracker: tracker, running: map[*metricWriter]string{}, changed: make(chan struct{})}
+}
+
+// start runs the writer in the background; it keeps running until the metricWriter is closed, or until the writer
+// can't create its files, in which case the metricWriter is closed so that the next request gets a new writer.
+func (self *writerGroup) start(name string, w *metricWriter, writer *parquet.Prom2ParquetWriter) {
+	w.writer = writer
+
+	self.m.Lock()
+	self.running[w] = name
+	self.m.Unlock()
+
+	go func() {
+		err := writer.Listen(w.ch)
+		close(w.stopped)
+		if err != nil {
+			log.Errorf("writer %s failed: %v", name, err)
+
+			// Anything still in the queue is lost, but if the WAL is enabled the tracker makes sure that it's kept and
+			// replayed on the next startup
+			self.tracker.dataDropped(name)
+			go w.close()
+			for range w.ch {
+				// Drain the queue so that any sends that are waiting on it can finish and the close can go through
+			}
+		}
+
+		self.m.Lock()
+		defer self.m.Unlock()
+		delete(self.running, w)
+		close(self.changed)
+		self.changed = make(chan struct{})
+	}()
+}
+
+// queued returns the number of timeseries that have been sent to each of the running writers so far
+func (self *writerGroup) queued() map[*metricWriter]uint64 {
+	self.m.Lock()
+	defer self.m.Unlock()
+
+	queued := make(map[*metricWriter]uint64, len(self.running))
+	for w := range self.running {
+		queued[w] = w.queued.Load()
+	}
+	return queued
+}
+
+// writtenThrough returns true if each of the writers has finished with (at least) the given number of timeseries, or
+// has stopped running
+func (self *writerGroup) writtenThrough(queued map[*metricWriter]uint64) bool {
+	self.m.Lock()
+	defer self.m.Unlock()
+
+	for w, n := range queued {
+		if _, ok := self.running[w]; ok && w.writer.SeriesWritten() < n {
+			return false
+		}
+	}
+	return true
+}
+
+// wait blocks until every writer has finished; if the context is done first, it returns an error listing the writers
+// that are still running.
+func (self *writerGroup) wait(ctx context.Context) error {
+	for {
+		self.m.Lock()
+		if len(self.running) == 0 {
+			self.m.Unlock()
+			return nil
+		}
+		changed := self.changed
+		self.m.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			self.m.Lock()
+			defer self.m.Unlock()
+
+			names := lo.Values(self.running)
+			sort.Strings(names)
+			return fmt.Errorf("writers still running: %s: %w", strings.Join(names, ", "), ctx.Err())
+		}
+	}
+}
+
+// removeWriter removes the writer from the map (if it hasn't already been replaced by a new writer); the caller must
+// hold the lock.  The writer still needs to be closed, which should be done without holding the lock.
+func (self *promserver) removeWriter(name string, w *metricWriter) {
+	if cur, ok := self.writers[name]; ok && cur == w {
+		delete(self.writers, name)
+	}
+}
+
+// evictLRU makes room for a new writer by removing the least-recently-used writers until we're below the open writer
+// limit; the caller must hold the lock, and must close the returned writers after releasing it.
+func (self *promserver) evictLRU() []*metricWriter {
+	if self.opts.writers.maxOpen <= 0 {
+		return nil
+	}
+
+	evicted := []*metricWriter{}
+	for len(self.writers) >= self.opts.writers.maxOpen {
+		var lruName string
+		var lru *metricWriter
+		for name, w := range self.writers {
+			if lru == nil || w.idleSince().Before(lru.idleSince()) {
+				lruName, lru = name, w
+			}
+		}
+
+		log.Infof("reached the limit of %d open writers, evicting %s", self.opts.writers.maxOpen, lruName)
+		self.removeWriter(lruName, lru)
+		evicted = append(evicted, lru)
+	}
+	if len(evicted) > 0 {
+		self.pruneFileStarts(time.Now())
+	}
+	return evicted
+}
+
+// evictIdle closes and removes every writer that hasn't received any data since the idle timeout
+func (self *promserver) evictIdle(now time.Time) {
+	self.m.Lock()
+	evicted := []*metricWriter{}
+	for name, w := range self.writers {
+		if now.Sub(w.idleSince()) >= self.opts.writers.idleTimeout {
+			log.Infof("writer %s has been idle since %s, closing it", name, w.idleSince())
+			self.removeWriter(name, w)
+			evicted = append(evicted, w)
+		}
+	}
+	self.pruneFileStarts(now)
+	self.m.Unlock()
+
+	for _, w := range evicted {
+		w.close()
+	}
+}
+
+// pruneFileStarts forgets the file start times for writers that have been closed, once any new writer with the same
+// name would be in a later flush interval anyways; the caller must hold the lock.
+func (self *promserver) pruneFileStarts(now time.Time) {
+	cutoff := now.Truncate(self.opts.flushInterval).Add(-self.opts.flushInterval)
+	for name, starts := range self.starts {
+		if _, ok := self.writers[name]; !ok && starts.Last().Before(cutoff) {
+			delete(self.starts, name)
+		}
+	}
+}
+
+func (self *promserver) runIdleEviction(stop <-chan struct{}) {
+	ticker := time.NewTicker(min(self.opts.writers.idleTimeout, maxWriterEvictionInterval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			self.evictIdle(now)
+		}
+	}
+}
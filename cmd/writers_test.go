@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/xitongsys/parquet-go-source/mem"
+
+	"github.com/acrlabs/prom2parquet/pkg/backends"
+	"github.com/acrlabs/prom2parquet/pkg/parquet"
+)
+
+func TestMetricWriterClose(t *testing.T) {
+	w := newMetricWriter(make(chan prompb.TimeSeries, 1))
+	sent, err := w.send(context.TODO(), prompb.TimeSeries{})
+	assert.Nil(t, err)
+	assert.True(t, sent)
+
+	w.close()
+	w.close()
+	sent, err = w.send(context.TODO(), prompb.TimeSeries{})
+	assert.Nil(t, err)
+	assert.False(t, sent)
+}
+
+func TestMetricWriterRotateStopped(t *testing.T) {
+	writer, err := parquet.NewProm2ParquetWriter(
+		context.TODO(),
+		"/test",
+		parquet.PathFields{Prefix: testPrefix, Metric: metricName},
+		nil,
+		nil,
+		backends.Memory,
+		time.Hour,
+		nil,
+		nil,
+		parquet.KeepDuplicates,
+		nil,
+		nil,
+	)
+	assert.Nil(t, err)
+
+	// The writer never listens for the rotation, so without noticing that it stopped, this would block forever
+	w := newMetricWriter(make(chan prompb.TimeSeries))
+	w.writer = writer
+	close(w.stopped)
+	files, err := w.rotate(context.TODO())
+	assert.ErrorIs(t, err, errWriterStopped)
+	assert.Empty(t, files)
+}
+
+func TestEvictIdle(t *testing.T) {
+	srv := newServer(&options{backend: backends.Memory, writers: writerConfig{idleTimeout: time.Minute}})
+
+	now := time.Now()
+	idle := newMetricWriter(make(chan prompb.TimeSeries))
+	idle.lastUsed.Store(now.Add(-2 * time.Minute).UnixNano())
+	active := newMetricWriter(make(chan prompb.TimeSeries))
+	active.lastUsed.Store(now.Add(-30 * time.Second).UnixNano())
+	srv.writers["idle"] = idle
+	srv.writers["active"] = active
+
+	srv.evictIdle(now)
+	assert.NotContains(t, srv.writers, "idle")
+	assert.Contains(t, srv.writers, "active")
+	sent, err := idle.send(context.TODO(), prompb.TimeSeries{})
+	assert.Nil(t, err)
+	assert.False(t, sent)
+}
+
+func TestEvictIdleWriterMetrics(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	mem.SetInMemFileFs(&fs)
+
+	srv := newServer(&options{
+		backend:       backends.Memory,
+		backendRoot:   "/test",
+		flushInterval: time.Hour,
+		writers:       writerConfig{idleTimeout: time.Minute},
+	})
+	_, err := srv.spawnWriter(context.TODO(), parquet.PathFields{Prefix: testPrefix, Metric: metricName})
+	assert.Nil(t, err)
+
+	count, err := testutil.GatherAndCount(srv.metrics.registry, "prom2parquet_writer_write_errors_total")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count)
+
+	srv.evictIdle(time.Now().Add(2 * time.Minute))
+	assert.Nil(t, srv.running.wait(context.TODO()))
+
+	count, err = testutil.GatherAndCount(srv.metrics.registry, "prom2parquet_writer_write_errors_total")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, count)
+}
+
+func TestSpawnWriterEvictLRU(t *testing.T) {
+	srv := newServer(&options{backend: backends.Memory, writers: writerConfig{maxOpen: 2}})
+	defer closeWriters(t, srv)
+
+	now := time.Now()
+	for i, name := range []string{"old_metric", "new_metric"} {
+		w, err := srv.spawnWriter(context.TODO(), parquet.PathFields{Prefix: testPrefix, Metric: name})
+		assert.Nil(t, err)
+		w.lastUsed.Store(now.Add(time.Duration(i) * time.Second).UnixNano())
+	}
+	old := srv.writers[testPrefix+"/old_metric"]
+
+	_, err := srv.spawnWriter(context.TODO(), parquet.PathFields{Prefix: testPrefix, Metric: metricName})
+	assert.Nil(t, err)
+	assert.Len(t, srv.writers, 2)
+	assert.NotContains(t, srv.writers, testPrefix+"/old_metric")
+	assert.Contains(t, srv.writers, testPrefix+"/new_metric")
+	assert.Contains(t, srv.writers, channelName)
+	sent, err := old.send(context.TODO(), prompb.TimeSeries{})
+	assert.Nil(t, err)
+	assert.False(t, sent)
+}
+
+func TestSendTimeseriesClosedWriter(t *testing.T) {
+	srv := newServer(&options{backend: backends.Memory})
+	defer closeWriters(t, srv)
+
+	closed := newMetricWriter(make(chan prompb.TimeSeries))
+	closed.close()
+	srv.writers[channelName] = closed
+
+	ts := prompb.TimeSeries{
+		Labels: []prompb.Label{
+			{Name: model.MetricNameLabel, Value: metricName},
+			{Name: prefixLabelKey, Value: testPrefix},
+		},
+		Samples: []prompb.Sample{{Value: 1.0}},
+	}
+	stats, _, err := srv.sendTimeseries(context.TODO(), "", []prompb.TimeSeries{ts})
+	assert.Nil(t, err)
+	assert.Equal(t, writeStats{samples: 1}, stats)
+	assert.Contains(t, srv.writers, channelName)
+	assert.NotEqual(t, closed, srv.writers[channelName])
+}
+
+func TestSpawnWriterSharesFileStarts(t *testing.T) {
+	srv := newServer(&options{backend: backends.Memory, flushInterval: time.Minute})
+	defer closeWriters(t, srv)
+
+	fields := parquet.PathFields{Prefix: testPrefix, Metric: metricName}
+
+	w, err := srv.spawnWriter(context.TODO(), fields)
+	assert.Nil(t, err)
+	starts := srv.starts[channelName]
+
+	srv.m.Lock()
+	srv.removeWriter(channelName, w)
+	srv.m.Unlock()
+	w.close()
+
+	_, err = srv.spawnWriter(context.TODO(), fields)
+	assert.Nil(t, err)
+	assert.Same(t, starts, srv.starts[channelName])
+}
+
+func TestWriterGroupWait(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	mem.SetInMemFileFs(&fs)
+
+	srv := newServer(&options{backend: backends.Memory, backendRoot: "/test", flushInterval: time.Hour})
+	w, err := srv.spawnWriter(context.TODO(), parquet.PathFields{Prefix: testPrefix, Metric: metricName})
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), sleepTime)
+	defer cancel()
+	err = srv.running.wait(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.ErrorContains(t, err, channelName)
+
+	w.close()
+	assert.Nil(t, srv.running.wait(context.TODO()))
+	assert.Nil(t, srv.tracker.waitClosed(context.TODO()))
+}
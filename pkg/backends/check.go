@@ -0,0 +1,49 @@
+package backends
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Check makes sure that we can write to the backend: for the local backend, we write (and remove) a test file in the
+// root directory, and for S3 we check that the bucket exists and we have access to it.
+func Check(ctx context.Context, root string, backend StorageBackend) error {
+	switch backend {
+	case Local:
+		if err := os.MkdirAll(root, 0750); err != nil {
+			return fmt.Errorf("can't create directory %s: %w", root, err)
+		}
+
+		f, err := os.CreateTemp(root, ".prom2parquet-check-*")
+		if err != nil {
+			return fmt.Errorf("can't write to %s: %w", root, err)
+		}
+		if err := f.Close(); err != nil {
+			return fmt.Errorf("can't write to %s: %w", root, err)
+		}
+		if err := os.Remove(f.Name()); err != nil {
+			return fmt.Errorf("can't remove test file %s: %w", f.Name(), err)
+		}
+		return nil
+
+	case Memory:
+		return nil
+
+	case S3:
+		cfg, err := config.LoadDefaultConfig(ctx)
+		if err != nil {
+			return fmt.Errorf("can't load AWS config: %w", err)
+		}
+
+		if _, err := s3.NewFromConfig(cfg).HeadBucket(ctx, &s3.HeadBucketInput{Bucket: &root}); err != nil {
+			return fmt.Errorf("can't access s3://%s: %w", root, err)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unknown backend: %v", backend)
+}
@@ -0,0 +1,188 @@
+package backends
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/spf13/afero"
+	"github.com/xitongsys/parquet-go-source/buffer"
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go-source/mem"
+	"github.com/xitongsys/parquet-go-source/s3v2"
+	"github.com/xitongsys/parquet-go/source"
+)
+
+const parquetExt = ".parquet"
+
+func ConstructReaderForFile( //nolint:ireturn // this is fine
+	ctx context.Context,
+	root,
+	file string,
+	backend StorageBackend,
+) (source.ParquetFile, error) {
+	switch backend {
+	case Local:
+		fr, err := local.NewLocalFileReader(filepath.Join(root, file))
+		if err != nil {
+			return nil, fmt.Errorf("can't create local file reader: %w", err)
+		}
+		return fr, nil
+
+	case Memory:
+		fullPath, err := filepath.Abs(filepath.Join(root, file))
+		if err != nil {
+			return nil, fmt.Errorf("can't construct local path %s/%s: %w", root, file, err)
+		}
+
+		memFs := mem.GetMemFileFs()
+		if memFs == nil {
+			return nil, fmt.Errorf("in-memory filesystem not initialized")
+		}
+
+		// The in-memory ParquetFile shares a single file handle between all of its "opened" copies, which
+		// doesn't work for reading, so we just read the whole file into a buffer instead
+		contents, err := afero.ReadFile(memFs, fullPath)
+		if err != nil {
+			return nil, fmt.Errorf("can't create in-memory reader: %w", err)
+		}
+		return buffer.NewBufferFileFromBytes(contents), nil
+
+	case S3:
+		fr, err := s3v2.NewS3FileReader(ctx, root, file)
+		if err != nil {
+			return nil, fmt.Errorf("can't create S3 reader: %w", err)
+		}
+		return fr, nil
+	}
+
+	return nil, fmt.Errorf("unknown backend: %v", backend)
+}
+
+// ListFiles returns the paths (relative to root) of all the parquet files underneath the given prefix
+func ListFiles(ctx context.Context, root, prefix string, backend StorageBackend) ([]string, error) {
+	switch backend {
+	case Local:
+		return listAferoFiles(afero.NewOsFs(), root, prefix)
+
+	case Memory:
+		memFs := mem.GetMemFileFs()
+		if memFs == nil {
+			return nil, nil
+		}
+
+		fullRoot, err := filepath.Abs(root)
+		if err != nil {
+			return nil, fmt.Errorf("can't construct local path %s: %w", root, err)
+		}
+		return listAferoFiles(memFs, fullRoot, prefix)
+
+	case S3:
+		return listS3Files(ctx, root, prefix)
+	}
+
+	return nil, fmt.Errorf("unknown backend: %v", backend)
+}
+
+// Exists returns true if the file (relative to root) is already present in the backend
+func Exists(ctx context.Context, root, file string, backend StorageBackend) (bool, error) {
+	switch backend {
+	case Local:
+		return aferoExists(afero.NewOsFs(), filepath.Join(root, file))
+
+	case Memory:
+		memFs := mem.GetMemFileFs()
+		if memFs == nil {
+			return false, nil
+		}
+
+		fullPath, err := filepath.Abs(filepath.Join(root, file))
+		if err != nil {
+			return false, fmt.Errorf("can't construct local path %s/%s: %w", root, file, err)
+		}
+		return aferoExists(memFs, fullPath)
+
+	case S3:
+		cfg, err := config.LoadDefaultConfig(ctx)
+		if err != nil {
+			return false, fmt.Errorf("can't load AWS config: %w", err)
+		}
+
+		_, err = s3.NewFromConfig(cfg).HeadObject(ctx, &s3.HeadObjectInput{Bucket: &root, Key: &file})
+		var notFound *types.NotFound
+		if errors.As(err, &notFound) {
+			return false, nil
+		} else if err != nil {
+			return false, fmt.Errorf("can't check s3://%s/%s: %w", root, file, err)
+		}
+		return true, nil
+	}
+
+	return false, fmt.Errorf("unknown backend: %v", backend)
+}
+
+func aferoExists(afs afero.Fs, path string) (bool, error) {
+	exists, err := afero.Exists(afs, path)
+	if err != nil {
+		return false, fmt.Errorf("can't check %s: %w", path, err)
+	}
+	return exists, nil
+}
+
+func listAferoFiles(afs afero.Fs, root, prefix string) ([]string, error) {
+	files := []string{}
+	err := afero.Walk(afs, filepath.Join(root, prefix), func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !info.IsDir() && strings.HasSuffix(path, parquetExt) {
+			relPath, err := filepath.Rel(root, path)
+			if err != nil {
+				return fmt.Errorf("can't compute relative path for %s: %w", path, err)
+			}
+			files = append(files, filepath.ToSlash(relPath))
+		}
+		return nil
+	})
+
+	if errors.Is(err, os.ErrNotExist) {
+		return files, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("can't list files in %s/%s: %w", root, prefix, err)
+	}
+	return files, nil
+}
+
+func listS3Files(ctx context.Context, bucket, prefix string) ([]string, error) {
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("can't load AWS config: %w", err)
+	}
+
+	files := []string{}
+	paginator := s3.NewListObjectsV2Paginator(s3.NewFromConfig(cfg), &s3.ListObjectsV2Input{
+		Bucket: &bucket,
+		Prefix: &prefix,
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("can't list objects in s3://%s/%s: %w", bucket, prefix, err)
+		}
+
+		for _, obj := range page.Contents {
+			if obj.Key != nil && strings.HasSuffix(*obj.Key, parquetExt) {
+				files = append(files, *obj.Key)
+			}
+		}
+	}
+	return files, nil
+}
@@ -0,0 +1,193 @@
+package parquet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/xitongsys/parquet-go/writer"
+
+	"github.com/acrlabs/prom2parquet/pkg/backends"
+)
+
+// BackfillWriter writes historical timeseries data into the same file layout and schema that Prom2ParquetWriter uses.
+// Unlike Prom2ParquetWriter, which partitions data by the wall-clock time that it was received, BackfillWriter
+// partitions data by the timestamp of each sample.
+//
+// BackfillWriter expects to receive all of the series for a metric name (with any prefix) before moving on to the next
+// metric; all open files are closed whenever the metric name changes.  At most BackfillMaxOpenFiles files are open at
+// once: when another one is needed, the one that was opened first is closed, so callers should send the data for a
+// metric a time range at a time (closing the writer in between) rather than one series at a time across its whole
+// history.  Files can't be appended to once they're closed, so if a later series would need to write to a file that was
+// already closed, or a file already exists in the backend, Write returns an error instead of overwriting it.
+type BackfillWriter struct {
+	backend       backends.StorageBackend
+	root          string
+	layout        *PathTemplate
+	columns       *LabelColumns
+	flushInterval time.Duration
+
+	currentMetric   string
+	labelColumns    []string
+	sampleSchema    *rowSchema
+	histogramSchema *rowSchema
+
+	writers map[string]*writer.ParquetWriter
+	open    []string
+	written map[string]bool
+	files   []string
+}
+
+// BackfillMaxOpenFiles is the maximum number of files that a BackfillWriter keeps open at once
+const BackfillMaxOpenFiles = 64
+
+// NewBackfillWriter creates a backfill writer; if layout is nil, the default path template is used, and if columns is
+// nil, the default label columns are used.  Backfilled files always use the configured label columns, even if the
+// columns are dynamic, since the files for each time range are written a series at a time and can't be rotated.
+func NewBackfillWriter(
+	root string,
+	layout *PathTemplate,
+	columns *LabelColumns,
+	backend backends.StorageBackend,
+	flushInterval time.Duration,
+) *BackfillWriter {
+	if layout == nil {
+		layout = defaultPathTemplate
+	}
+
+	return &BackfillWriter{
+		backend:       backend,
+		root:          root,
+		layout:        layout,
+		columns:       columns,
+		flushInterval: flushInterval,
+		writers:       map[string]*writer.ParquetWriter{},
+		written:       map[string]bool{},
+	}
+}
+
+func (self *BackfillWriter) Write(prefix, metricName string, ts prompb.TimeSeries) error {
+	if metricName != self.currentMetric {
+		if err := self.Close(); err != nil {
+			return err
+		}
+		self.currentMetric = metricName
+		self.labelColumns = self.columns.For(metricName)
+		self.sampleSchema = newRowSchema(DataPoint{}, self.labelColumns)
+		self.histogramSchema = newRowSchema(HistogramDataPoint{}, self.labelColumns)
+	}
+
+	fields := PathFields{Prefix: prefix, Metric: metricName, Labels: map[string]string{}}
+	for _, l := range ts.Labels {
+		fields.Labels[l.Name] = l.Value
+	}
+	// Most series only span a handful of files, so we cache the rendered paths instead of rendering the template for
+	// every sample
+	files := map[time.Time]string{}
+
+	dp := createDataPointForLabels(ts.Labels, self.labelColumns)
+	for _, s := range ts.Samples {
+		dp.Value = s.Value
+		dp.Timestamp = s.Timestamp
+
+		file, err := self.dataFile(fields, s.Timestamp, files)
+		if err != nil {
+			return err
+		}
+		if err := self.write(file, self.sampleSchema, dp); err != nil {
+			return err
+		}
+	}
+
+	for _, h := range ts.Histograms {
+		file, err := self.dataFile(fields, h.Timestamp, files)
+		if err != nil {
+			return err
+		}
+		if err := self.write(histogramFile(file), self.histogramSchema, createHistogramDataPoint(dp, h)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Close finalizes all currently-open files
+func (self *BackfillWriter) Close() error {
+	var errs []error
+	for _, file := range self.open {
+		errs = append(errs, self.closeFile(file))
+	}
+	self.open = nil
+
+	return errors.Join(errs...)
+}
+
+func (self *BackfillWriter) closeFile(file string) error {
+	pw := self.writers[file]
+	delete(self.writers, file)
+
+	setLabelColumnsMetadata(pw)
+	if err := pw.WriteStop(); err != nil {
+		return fmt.Errorf("can't close %s: %w", file, err)
+	}
+	return nil
+}
+
+// Files returns the list of all files that have been written so far
+func (self *BackfillWriter) Files() []string {
+	return self.files
+}
+
+func (self *BackfillWriter) write(file string, schema *rowSchema, datapoint interface{}) error {
+	pw, ok := self.writers[file]
+	if !ok {
+		if self.written[file] {
+			return fmt.Errorf("can't reopen %s, which has already been closed", file)
+		}
+		if exists, err := backends.Exists(context.Background(), self.root, file, self.backend); err != nil {
+			return err
+		} else if exists {
+			return fmt.Errorf("can't write to %s, which already exists", file)
+		}
+
+		if len(self.open) >= BackfillMaxOpenFiles {
+			oldest := self.open[0]
+			self.open = self.open[1:]
+			if err := self.closeFile(oldest); err != nil {
+				return err
+			}
+		}
+
+		var err error
+		pw, err = newParquetWriter(self.root, file, self.backend, schema.new())
+		if err != nil {
+			return err
+		}
+		self.writers[file] = pw
+		self.open = append(self.open, file)
+		self.written[file] = true
+		self.files = append(self.files, file)
+	}
+
+	if err := pw.Write(schema.row(datapoint)); err != nil {
+		return fmt.Errorf("can't write to %s: %w", file, err)
+	}
+	return nil
+}
+
+func (self *BackfillWriter) dataFile(fields PathFields, timestamp int64, cache map[time.Time]string) (string, error) {
+	start := time.UnixMilli(timestamp).UTC().Truncate(self.flushInterval)
+	if file, ok := cache[start]; ok {
+		return file, nil
+	}
+
+	file, err := self.layout.Render(fields, start)
+	if err != nil {
+		return "", err
+	}
+	cache[start] = file
+	return file, nil
+}
@@ -0,0 +1,125 @@
+package parquet
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/xitongsys/parquet-go-source/mem"
+
+	"github.com/acrlabs/prom2parquet/pkg/backends"
+)
+
+func TestBackfillWriter(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	mem.SetInMemFileFs(&fs)
+
+	bw := NewBackfillWriter("/test", nil, nil, backends.Memory, 10*time.Second)
+	ts := prompb.TimeSeries{
+		Labels: []prompb.Label{{Name: "pod", Value: "the-pod"}},
+		Samples: []prompb.Sample{
+			{Value: 1.0, Timestamp: 1000},
+			{Value: 2.0, Timestamp: 9000},
+			{Value: 3.0, Timestamp: 12000},
+		},
+	}
+	assert.Nil(t, bw.Write("prefix", "kube_node_stuff", ts))
+	assert.Nil(t, bw.Write("prefix", "other_metric", ts))
+	assert.Nil(t, bw.Close())
+
+	assert.ElementsMatch(t, []string{
+		"prefix/kube_node_stuff/19700101000000.parquet",
+		"prefix/kube_node_stuff/19700101000010.parquet",
+		"prefix/other_metric/19700101000000.parquet",
+		"prefix/other_metric/19700101000010.parquet",
+	}, bw.Files())
+
+	res, err := ReadSeries(context.Background(), "/test", "prefix/kube_node_stuff/19700101000000.parquet", backends.Memory)
+	assert.Nil(t, err)
+	assert.Len(t, res, 1)
+	assert.Equal(t, []prompb.Sample{{Value: 1.0, Timestamp: 1000}, {Value: 2.0, Timestamp: 9000}}, res[0].Samples)
+
+	res, err = ReadSeries(context.Background(), "/test", "prefix/kube_node_stuff/19700101000010.parquet", backends.Memory)
+	assert.Nil(t, err)
+	assert.Len(t, res, 1)
+	assert.Equal(t, []prompb.Sample{{Value: 3.0, Timestamp: 12000}}, res[0].Samples)
+}
+
+func TestBackfillWriterInterleavedPrefixes(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	mem.SetInMemFileFs(&fs)
+
+	bw := NewBackfillWriter("/test", nil, nil, backends.Memory, 10*time.Second)
+	for i, prefix := range []string{"prefix-a", "prefix-b", "prefix-a"} {
+		assert.Nil(t, bw.Write(prefix, "kube_node_stuff", prompb.TimeSeries{
+			Labels:  []prompb.Label{{Name: "pod", Value: fmt.Sprintf("pod-%d", i)}},
+			Samples: []prompb.Sample{{Value: float64(i), Timestamp: 1000}},
+		}))
+	}
+	assert.Nil(t, bw.Close())
+
+	assert.Equal(t, []string{
+		"prefix-a/kube_node_stuff/19700101000000.parquet",
+		"prefix-b/kube_node_stuff/19700101000000.parquet",
+	}, bw.Files())
+
+	res, err := ReadSeries(context.Background(), "/test", bw.Files()[0], backends.Memory)
+	assert.Nil(t, err)
+	assert.Len(t, res, 2)
+}
+
+func TestBackfillWriterReopen(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	mem.SetInMemFileFs(&fs)
+
+	bw := NewBackfillWriter("/test", nil, nil, backends.Memory, 10*time.Second)
+	ts := prompb.TimeSeries{Samples: []prompb.Sample{{Value: 1.0, Timestamp: 1000}}}
+	assert.Nil(t, bw.Write("prefix", "kube_node_stuff", ts))
+	assert.Nil(t, bw.Write("prefix", "other_metric", ts))
+	assert.ErrorContains(t, bw.Write("prefix", "kube_node_stuff", ts), "already been closed")
+	assert.Nil(t, bw.Close())
+}
+
+func TestBackfillWriterMaxOpenFiles(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	mem.SetInMemFileFs(&fs)
+
+	bw := NewBackfillWriter("/test", nil, nil, backends.Memory, time.Second)
+	ts := prompb.TimeSeries{}
+	for i := range BackfillMaxOpenFiles + 1 {
+		ts.Samples = append(ts.Samples, prompb.Sample{Value: float64(i), Timestamp: int64(i) * 1000})
+	}
+	assert.Nil(t, bw.Write("prefix", "kube_node_stuff", ts))
+	assert.Len(t, bw.writers, BackfillMaxOpenFiles)
+	assert.NotContains(t, bw.writers, "prefix/kube_node_stuff/19700101000000.parquet")
+
+	// The first file was closed to make room for the last one, so it's complete and can't be written to again
+	res, err := ReadSeries(context.Background(), "/test", "prefix/kube_node_stuff/19700101000000.parquet", backends.Memory)
+	assert.Nil(t, err)
+	assert.Len(t, res, 1)
+	assert.ErrorContains(t, bw.Write("prefix", "kube_node_stuff", ts), "already been closed")
+	assert.Nil(t, bw.Close())
+	assert.Len(t, bw.Files(), BackfillMaxOpenFiles+1)
+}
+
+func TestBackfillWriterExistingFile(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	mem.SetInMemFileFs(&fs)
+
+	ts := prompb.TimeSeries{Samples: []prompb.Sample{{Value: 1.0, Timestamp: 1000}}}
+	bw := NewBackfillWriter("/test", nil, nil, backends.Memory, 10*time.Second)
+	assert.Nil(t, bw.Write("prefix", "kube_node_stuff", ts))
+	assert.Nil(t, bw.Close())
+
+	bw = NewBackfillWriter("/test", nil, nil, backends.Memory, 10*time.Second)
+	assert.ErrorContains(t, bw.Write("prefix", "kube_node_stuff", ts), "already exists")
+	assert.Nil(t, bw.Close())
+
+	res, err := ReadSeries(context.Background(), "/test", "prefix/kube_node_stuff/19700101000000.parquet", backends.Memory)
+	assert.Nil(t, err)
+	assert.Len(t, res, 1)
+}
@@ -0,0 +1,121 @@
+package parquet
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+
+	"github.com/prometheus/common/model"
+)
+
+const (
+	podNameKey   = "pod"
+	namespaceKey = "namespace"
+	containerKey = "container"
+	nodeKey      = "node"
+)
+
+// SchemaMode controls whether the label columns for a metric are fixed when its writer is created, or whether a column
+// is added for every label that the writer sees.
+type SchemaMode int
+
+const (
+	FixedSchema SchemaMode = iota
+	DynamicSchema
+)
+
+// DefaultLabelColumns returns the labels that are stored in their own columns if nothing else is configured
+func DefaultLabelColumns() []string {
+	return []string{podNameKey, containerKey, namespaceKey, nodeKey}
+}
+
+// LabelColumnRule adds a column for each of the given labels to every metric whose name matches the (fully-anchored)
+// regular expression in Match
+type LabelColumnRule struct {
+	Match  string
+	Labels []string
+}
+
+type labelColumnRule struct {
+	match  *regexp.Regexp
+	labels []string
+}
+
+// LabelColumns determines which labels are stored in their own columns for each metric; all of the other labels for a
+// series are stored in the `labels` column as a comma-separated list of name=value pairs.
+type LabelColumns struct {
+	mode     SchemaMode
+	defaults []string
+	rules    []labelColumnRule
+}
+
+// NewLabelColumns creates a label columns config: every metric gets a column for each of the default labels, plus a
+// column for each of the labels of every rule that matches its name.  With a dynamic schema, these are just the first
+// columns in each file, and every other label gets a column as soon as it's seen.
+func NewLabelColumns(mode SchemaMode, defaults []string, rules []LabelColumnRule) (*LabelColumns, error) {
+	if err := validateLabelColumns(defaults); err != nil {
+		return nil, fmt.Errorf("invalid default label columns: %w", err)
+	}
+
+	columns := &LabelColumns{mode: mode, defaults: defaults}
+	for i, r := range rules {
+		match, err := regexp.Compile("^(?:" + r.Match + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("can't parse regex for label column rule %d: %w", i, err)
+		}
+		if err := validateLabelColumns(r.Labels); err != nil {
+			return nil, fmt.Errorf("invalid label columns for rule %d: %w", i, err)
+		}
+		columns.rules = append(columns.rules, labelColumnRule{match: match, labels: r.Labels})
+	}
+	return columns, nil
+}
+
+// For returns the labels that get their own columns for the given metric, in the order that the columns appear in the
+// schema; if the config is nil, the default columns are used.
+func (self *LabelColumns) For(metricName string) []string {
+	if self == nil {
+		return DefaultLabelColumns()
+	}
+
+	columns := slices.Clone(self.defaults)
+	for _, r := range self.rules {
+		if !r.match.MatchString(metricName) {
+			continue
+		}
+		for _, l := range r.labels {
+			if !slices.Contains(columns, l) {
+				columns = append(columns, l)
+			}
+		}
+	}
+	return columns
+}
+
+// Dynamic returns true if writers should add a column for every label they see
+func (self *LabelColumns) Dynamic() bool {
+	return self != nil && self.mode == DynamicSchema
+}
+
+// canBeColumn returns true if a label can be stored in its own column, i.e., if it's a valid label name that doesn't
+// conflict with any of the built-in columns
+func canBeColumn(label string, reserved map[string]bool) bool {
+	return label != model.MetricNameLabel && model.LabelName(label).IsValid() && !reserved[label]
+}
+
+func validateLabelColumns(labels []string) error {
+	reserved := fixedColumns()
+	for _, l := range labels {
+		if reserved[l] {
+			return fmt.Errorf("%q conflicts with one of the built-in columns", l)
+		} else if !canBeColumn(l, reserved) {
+			return fmt.Errorf("%q is not a valid label name", l)
+		}
+	}
+
+	if len(slices.Compact(slices.Sorted(slices.Values(labels)))) != len(labels) {
+		return errors.New("label columns must be unique")
+	}
+	return nil
+}
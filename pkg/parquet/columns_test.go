@@ -0,0 +1,96 @@
+package parquet
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewLabelColumns(t *testing.T) {
+	cases := map[string]struct {
+		defaults    []string
+		rules       []LabelColumnRule
+		expectedErr bool
+	}{
+		"valid": {
+			defaults: []string{"job", "instance"},
+			rules:    []LabelColumnRule{{Match: ".*_bucket", Labels: []string{"le"}}},
+		},
+		"invalid label name": {
+			defaults:    []string{"a-label"},
+			expectedErr: true,
+		},
+		"metric name": {
+			defaults:    []string{"__name__"},
+			expectedErr: true,
+		},
+		"built-in column": {
+			rules:       []LabelColumnRule{{Match: ".*", Labels: []string{"value"}}},
+			expectedErr: true,
+		},
+		"histogram column": {
+			defaults:    []string{"sum"},
+			expectedErr: true,
+		},
+		"duplicate label": {
+			defaults:    []string{"job", "job"},
+			expectedErr: true,
+		},
+		"invalid regex": {
+			rules:       []LabelColumnRule{{Match: "(", Labels: []string{"le"}}},
+			expectedErr: true,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			_, err := NewLabelColumns(FixedSchema, tc.defaults, tc.rules)
+			assert.Equal(t, tc.expectedErr, err != nil)
+		})
+	}
+}
+
+func TestLabelColumnsFor(t *testing.T) {
+	columns, err := NewLabelColumns(FixedSchema, []string{"job", "instance"}, []LabelColumnRule{
+		{Match: ".*_bucket", Labels: []string{"le"}},
+		{Match: "node_disk_.*", Labels: []string{"device", "instance"}},
+	})
+	assert.Nil(t, err)
+
+	cases := map[string]struct {
+		columns  *LabelColumns
+		metric   string
+		expected []string
+	}{
+		"nil config": {
+			metric:   "kube_node_stuff",
+			expected: []string{podNameKey, containerKey, namespaceKey, nodeKey},
+		},
+		"defaults only": {
+			columns:  columns,
+			metric:   "kube_node_stuff",
+			expected: []string{"job", "instance"},
+		},
+		"matching rule": {
+			columns:  columns,
+			metric:   "http_request_duration_seconds_bucket",
+			expected: []string{"job", "instance", "le"},
+		},
+		"match is anchored": {
+			columns:  columns,
+			metric:   "http_request_duration_seconds_bucket_total",
+			expected: []string{"job", "instance"},
+		},
+		"no duplicate columns": {
+			columns:  columns,
+			metric:   "node_disk_read_bytes_total",
+			expected: []string{"job", "instance", "device"},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, tc.columns.For(tc.metric))
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package parquet
+
+import (
+	"strings"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// DuplicatePolicy controls what happens to samples whose timestamp is not newer than the last sample written for the
+// same series; these usually come from Prometheus retrying a remote write request that timed out.
+type DuplicatePolicy int
+
+const (
+	KeepDuplicates DuplicatePolicy = iota
+	DropDuplicates
+	SeparateDuplicates
+)
+
+const duplicatesSuffix = "duplicates"
+
+// seriesTracker remembers the last timestamp written for each series.  To keep memory bounded, series are forgotten
+// after two flush intervals without any new data, which is much longer than Prometheus will keep retrying a request.
+type seriesTracker struct {
+	current  map[string]int64
+	previous map[string]int64
+
+	duplicates int
+	outOfOrder int
+}
+
+func newSeriesTracker() *seriesTracker {
+	return &seriesTracker{current: map[string]int64{}, previous: map[string]int64{}}
+}
+
+// check returns true if the timestamp is newer than the last one seen for the series (recording it if so), and
+// otherwise counts it as a duplicate or out-of-order sample
+func (self *seriesTracker) check(key string, timestamp int64) bool {
+	last, ok := self.current[key]
+	if !ok {
+		last, ok = self.previous[key]
+	}
+
+	if ok && timestamp == last {
+		self.duplicates++
+		return false
+	} else if ok && timestamp < last {
+		self.outOfOrder++
+		return false
+	}
+
+	self.current[key] = timestamp
+	return true
+}
+
+// rotate forgets all of the series that haven't been seen since the previous rotation, and returns (and resets) the
+// duplicate and out-of-order counts
+func (self *seriesTracker) rotate() (int, int) {
+	duplicates, outOfOrder := self.duplicates, self.outOfOrder
+	self.previous = self.current
+	self.current = map[string]int64{}
+	self.duplicates, self.outOfOrder = 0, 0
+	return duplicates, outOfOrder
+}
+
+func seriesKey(lbls []prompb.Label) string {
+	var b strings.Builder
+	for _, l := range lbls {
+		b.WriteString(l.Name)
+		b.WriteByte(0xff)
+		b.WriteString(l.Value)
+		b.WriteByte(0xff)
+	}
+	return b.String()
+}
@@ -0,0 +1,93 @@
+package parquet
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/xitongsys/parquet-go-source/mem"
+
+	"github.com/acrlabs/prom2parquet/pkg/backends"
+)
+
+func TestSeriesTracker(t *testing.T) {
+	tracker := newSeriesTracker()
+
+	assert.True(t, tracker.check("a", 1000))
+	assert.True(t, tracker.check("a", 2000))
+	assert.False(t, tracker.check("a", 2000))
+	assert.False(t, tracker.check("a", 1000))
+	assert.True(t, tracker.check("b", 1000))
+
+	duplicates, outOfOrder := tracker.rotate()
+	assert.Equal(t, 1, duplicates)
+	assert.Equal(t, 1, outOfOrder)
+
+	// Series from the previous interval are still remembered
+	assert.False(t, tracker.check("a", 2000))
+	assert.True(t, tracker.check("a", 3000))
+
+	// ...but are forgotten after two rotations without data
+	tracker.rotate()
+	tracker.rotate()
+	assert.True(t, tracker.check("b", 1000))
+}
+
+func TestWriteSampleDuplicates(t *testing.T) {
+	cases := map[string]struct {
+		policy             DuplicatePolicy
+		expectedSamples    []prompb.Sample
+		expectedDuplicates []prompb.Sample
+	}{
+		"keep": {
+			policy:          KeepDuplicates,
+			expectedSamples: []prompb.Sample{{Value: 1.0, Timestamp: 1000}, {Value: 1.0, Timestamp: 1000}},
+		},
+		"drop": {
+			policy:          DropDuplicates,
+			expectedSamples: []prompb.Sample{{Value: 1.0, Timestamp: 1000}},
+		},
+		"separate file": {
+			policy:             SeparateDuplicates,
+			expectedSamples:    []prompb.Sample{{Value: 1.0, Timestamp: 1000}},
+			expectedDuplicates: []prompb.Sample{{Value: 1.0, Timestamp: 1000}},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			fs := afero.NewMemMapFs()
+			mem.SetInMemFileFs(&fs)
+
+			w := newTestProm2ParquetWriter(clockwork.NewFakeClockAt(time.Time{}))
+			w.duplicates = tc.policy
+			assert.Nil(t, w.createBackendWriter())
+
+			dp := DataPoint{Timestamp: 1000, Value: 1.0, LabelColumns: []string{"the-pod", "", "", ""}}
+			assert.Nil(t, w.writeSample("series", dp))
+			assert.Nil(t, w.writeSample("series", dp))
+			_, err := w.closeFiles(w.filesID, w.currentFile, w.pw, w.hpw, w.epw, w.dpw, w.dhpw)
+			assert.Nil(t, err)
+
+			res, err := ReadSeries(context.TODO(), "/test", w.currentFile, backends.Memory)
+			assert.Nil(t, err)
+			assert.Len(t, res, 1)
+			assert.Equal(t, tc.expectedSamples, res[0].Samples)
+
+			duplicatesFile := "prefix/kube_node_stuff/00010101000000.duplicates.parquet"
+			exists, err := afero.Exists(fs, "/test/"+duplicatesFile)
+			assert.Nil(t, err)
+			assert.Equal(t, tc.expectedDuplicates != nil, exists)
+			if exists {
+				res, err := ReadSeries(context.TODO(), "/test", duplicatesFile, backends.Memory)
+				assert.Nil(t, err)
+				assert.Len(t, res, 1)
+				assert.Equal(t, tc.expectedDuplicates, res[0].Samples)
+			}
+		})
+	}
+}
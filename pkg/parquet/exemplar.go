@@ -0,0 +1,29 @@
+package parquet
+
+import (
+	"github.com/prometheus/prometheus/prompb"
+)
+
+const exemplarsSuffix = "exemplars"
+
+// ExemplarDataPoint stores a single exemplar (e.g., a trace ID attached to a sample), along with the labels of the
+// series it was attached to, so that exemplars can be joined back to the samples in the main data file.
+type ExemplarDataPoint struct {
+	Timestamp      int64   `parquet:"name=timestamp,type=INT64,convertedtype=TIMESTAMP"`
+	Value          float64 `parquet:"name=value,type=DOUBLE"`
+	ExemplarLabels string  `parquet:"name=exemplar_labels,type=BYTE_ARRAY,convertedtype=UTF8,encoding=PLAIN"`
+
+	LabelColumns []string
+	Labels       string `parquet:"name=labels,type=BYTE_ARRAY,convertedtype=UTF8,encoding=PLAIN"`
+}
+
+func createExemplarDataPoint(dp DataPoint, e prompb.Exemplar) ExemplarDataPoint {
+	return ExemplarDataPoint{
+		Timestamp:      e.Timestamp,
+		Value:          e.Value,
+		ExemplarLabels: formatLabels(e.Labels),
+
+		LabelColumns: dp.LabelColumns,
+		Labels:       dp.Labels,
+	}
+}
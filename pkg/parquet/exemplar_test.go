@@ -0,0 +1,28 @@
+package parquet
+
+import (
+	"testing"
+
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCreateExemplarDataPoint(t *testing.T) {
+	dp := DataPoint{LabelColumns: []string{podLabel, "", "", nodeLabel}, Labels: "a-label=baz-buz"}
+	e := prompb.Exemplar{
+		Labels: []prompb.Label{
+			{Name: "trace_id", Value: "abcd1234"},
+			{Name: "span_id", Value: "5678"},
+		},
+		Value:     0.25,
+		Timestamp: 1000,
+	}
+
+	assert.Equal(t, ExemplarDataPoint{
+		Timestamp:      1000,
+		Value:          0.25,
+		ExemplarLabels: "span_id=5678,trace_id=abcd1234",
+		LabelColumns:   []string{podLabel, "", "", nodeLabel},
+		Labels:         "a-label=baz-buz",
+	}, createExemplarDataPoint(dp, e))
+}
@@ -0,0 +1,73 @@
+package parquet
+
+import (
+	"github.com/prometheus/prometheus/prompb"
+)
+
+const histogramsDir = "histograms"
+
+// HistogramDataPoint stores a single native histogram sample.  Integer histograms populate the `*_int` and `*_deltas`
+// columns, float histograms populate the `*_float` and `*_counts` columns.  Bucket spans are stored as parallel
+// offset/length lists, since that's what most query engines handle best.
+type HistogramDataPoint struct {
+	Timestamp int64 `parquet:"name=timestamp,type=INT64,convertedtype=TIMESTAMP"`
+
+	CountInt       int64   `parquet:"name=count_int,type=INT64"`
+	CountFloat     float64 `parquet:"name=count_float,type=DOUBLE"`
+	Sum            float64 `parquet:"name=sum,type=DOUBLE"`
+	Schema         int32   `parquet:"name=schema,type=INT32"`
+	ZeroThreshold  float64 `parquet:"name=zero_threshold,type=DOUBLE"`
+	ZeroCountInt   int64   `parquet:"name=zero_count_int,type=INT64"`
+	ZeroCountFloat float64 `parquet:"name=zero_count_float,type=DOUBLE"`
+	ResetHint      string  `parquet:"name=reset_hint,type=BYTE_ARRAY,convertedtype=UTF8,encoding=PLAIN"`
+
+	NegativeSpanOffsets []int32   `parquet:"name=negative_span_offsets,type=INT32,repetitiontype=REPEATED"`
+	NegativeSpanLengths []int32   `parquet:"name=negative_span_lengths,type=INT32,repetitiontype=REPEATED"`
+	NegativeDeltas      []int64   `parquet:"name=negative_deltas,type=INT64,repetitiontype=REPEATED"`
+	NegativeCounts      []float64 `parquet:"name=negative_counts,type=DOUBLE,repetitiontype=REPEATED"`
+	PositiveSpanOffsets []int32   `parquet:"name=positive_span_offsets,type=INT32,repetitiontype=REPEATED"`
+	PositiveSpanLengths []int32   `parquet:"name=positive_span_lengths,type=INT32,repetitiontype=REPEATED"`
+	PositiveDeltas      []int64   `parquet:"name=positive_deltas,type=INT64,repetitiontype=REPEATED"`
+	PositiveCounts      []float64 `parquet:"name=positive_counts,type=DOUBLE,repetitiontype=REPEATED"`
+
+	LabelColumns []string
+	Labels       string `parquet:"name=labels,type=BYTE_ARRAY,convertedtype=UTF8,encoding=PLAIN"`
+}
+
+func createHistogramDataPoint(dp DataPoint, h prompb.Histogram) HistogramDataPoint {
+	hdp := HistogramDataPoint{
+		Timestamp: h.Timestamp,
+
+		CountInt:       int64(h.GetCountInt()), //nolint:gosec // counts are never going to overflow an int64
+		CountFloat:     h.GetCountFloat(),
+		Sum:            h.Sum,
+		Schema:         h.Schema,
+		ZeroThreshold:  h.ZeroThreshold,
+		ZeroCountInt:   int64(h.GetZeroCountInt()), //nolint:gosec // counts are never going to overflow an int64
+		ZeroCountFloat: h.GetZeroCountFloat(),
+		ResetHint:      h.ResetHint.String(),
+
+		NegativeDeltas: h.NegativeDeltas,
+		NegativeCounts: h.NegativeCounts,
+		PositiveDeltas: h.PositiveDeltas,
+		PositiveCounts: h.PositiveCounts,
+
+		LabelColumns: dp.LabelColumns,
+		Labels:       dp.Labels,
+	}
+
+	hdp.NegativeSpanOffsets, hdp.NegativeSpanLengths = splitSpans(h.NegativeSpans)
+	hdp.PositiveSpanOffsets, hdp.PositiveSpanLengths = splitSpans(h.PositiveSpans)
+
+	return hdp
+}
+
+func splitSpans(spans []prompb.BucketSpan) ([]int32, []int32) {
+	offsets := make([]int32, 0, len(spans))
+	lengths := make([]int32, 0, len(spans))
+	for _, s := range spans {
+		offsets = append(offsets, s.Offset)
+		lengths = append(lengths, int32(s.Length)) //nolint:gosec // span lengths are small
+	}
+	return offsets, lengths
+}
@@ -0,0 +1,81 @@
+package parquet
+
+import (
+	"testing"
+
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCreateHistogramDataPoint(t *testing.T) {
+	dp := DataPoint{LabelColumns: []string{podLabel, "", namespaceLabel, ""}, Labels: "a-label=baz-buz"}
+
+	cases := map[string]struct {
+		histogram prompb.Histogram
+		expected  HistogramDataPoint
+	}{
+		"int histogram": {
+			histogram: prompb.Histogram{
+				Count:          &prompb.Histogram_CountInt{CountInt: 5},
+				Sum:            12.5,
+				Schema:         1,
+				ZeroThreshold:  0.001,
+				ZeroCount:      &prompb.Histogram_ZeroCountInt{ZeroCountInt: 1},
+				NegativeSpans:  []prompb.BucketSpan{{Offset: 0, Length: 1}},
+				NegativeDeltas: []int64{1},
+				PositiveSpans:  []prompb.BucketSpan{{Offset: 1, Length: 2}, {Offset: 3, Length: 1}},
+				PositiveDeltas: []int64{1, 0, 1},
+				ResetHint:      prompb.Histogram_NO,
+				Timestamp:      1000,
+			},
+			expected: HistogramDataPoint{
+				Timestamp:           1000,
+				CountInt:            5,
+				Sum:                 12.5,
+				Schema:              1,
+				ZeroThreshold:       0.001,
+				ZeroCountInt:        1,
+				ResetHint:           "NO",
+				NegativeSpanOffsets: []int32{0},
+				NegativeSpanLengths: []int32{1},
+				NegativeDeltas:      []int64{1},
+				PositiveSpanOffsets: []int32{1, 3},
+				PositiveSpanLengths: []int32{2, 1},
+				PositiveDeltas:      []int64{1, 0, 1},
+				LabelColumns:        []string{podLabel, "", namespaceLabel, ""},
+				Labels:              "a-label=baz-buz",
+			},
+		},
+		"float histogram": {
+			histogram: prompb.Histogram{
+				Count:          &prompb.Histogram_CountFloat{CountFloat: 2.5},
+				Sum:            3.0,
+				ZeroCount:      &prompb.Histogram_ZeroCountFloat{ZeroCountFloat: 0.5},
+				PositiveSpans:  []prompb.BucketSpan{{Offset: 0, Length: 1}},
+				PositiveCounts: []float64{2.0},
+				ResetHint:      prompb.Histogram_GAUGE,
+				Timestamp:      2000,
+			},
+			expected: HistogramDataPoint{
+				Timestamp:           2000,
+				CountFloat:          2.5,
+				Sum:                 3.0,
+				ZeroCountFloat:      0.5,
+				ResetHint:           "GAUGE",
+				NegativeSpanOffsets: []int32{},
+				NegativeSpanLengths: []int32{},
+				PositiveSpanOffsets: []int32{0},
+				PositiveSpanLengths: []int32{1},
+				PositiveCounts:      []float64{2.0},
+				LabelColumns:        []string{podLabel, "", namespaceLabel, ""},
+				Labels:              "a-label=baz-buz",
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, createHistogramDataPoint(dp, tc.histogram))
+		})
+	}
+}
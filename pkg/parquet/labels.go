@@ -2,6 +2,7 @@ package parquet
 
 import (
 	"fmt"
+	"slices"
 	"sort"
 	"strings"
 
@@ -9,35 +10,56 @@ import (
 	"github.com/prometheus/prometheus/prompb"
 )
 
-const (
-	podNameKey   = "pod"
-	namespaceKey = "namespace"
-	containerKey = "container"
-	nodeKey      = "node"
-)
-
-func createDataPointForLabels(labels []prompb.Label) DataPoint {
-	dp := DataPoint{}
+// createDataPointForLabels stores the value of each of the label columns in its own column, and all of the other
+// (non-name) labels in the labels column
+func createDataPointForLabels(labels []prompb.Label, labelColumns []string) DataPoint {
+	dp := DataPoint{LabelColumns: make([]string, len(labelColumns))}
 
 	label_strs := []string{}
 	for _, l := range labels {
-		switch l.Name {
-		case model.MetricNameLabel:
+		if l.Name == model.MetricNameLabel {
 			continue
-		case podNameKey:
-			dp.Pod = l.Value
-		case namespaceKey:
-			dp.Namespace = l.Value
-		case containerKey:
-			dp.Container = l.Value
-		case nodeKey:
-			dp.Node = l.Value
-		default:
+		} else if i := slices.Index(labelColumns, l.Name); i >= 0 {
+			dp.LabelColumns[i] = l.Value
+		} else {
 			label_strs = append(label_strs, fmt.Sprintf("%s=%s", l.Name, l.Value))
 		}
 	}
-	sort.Strings(label_strs)
-	dp.Labels = strings.Join(label_strs, ",")
+	dp.Labels = joinLabelStrs(label_strs)
 
 	return dp
 }
+
+func formatLabels(labels []prompb.Label) string {
+	label_strs := make([]string, 0, len(labels))
+	for _, l := range labels {
+		label_strs = append(label_strs, fmt.Sprintf("%s=%s", l.Name, l.Value))
+	}
+	return joinLabelStrs(label_strs)
+}
+
+func joinLabelStrs(label_strs []string) string {
+	sort.Strings(label_strs)
+	return strings.Join(label_strs, ",")
+}
+
+// labelsFromDataPoint reconstructs the (non-name) Prometheus labels for a datapoint; this is the inverse of
+// createDataPointForLabels.  Note that because labels are stored as a comma-separated string, label values containing
+// commas can't be recovered exactly.
+func labelsFromDataPoint(labelColumns []string, dp DataPoint) []prompb.Label {
+	labels := []prompb.Label{}
+	for i, value := range dp.LabelColumns {
+		if value != "" {
+			labels = append(labels, prompb.Label{Name: labelColumns[i], Value: value})
+		}
+	}
+
+	if dp.Labels != "" {
+		for _, label_str := range strings.Split(dp.Labels, ",") {
+			name, value, _ := strings.Cut(label_str, "=")
+			labels = append(labels, prompb.Label{Name: name, Value: value})
+		}
+	}
+
+	return labels
+}
@@ -1,6 +1,7 @@
 package parquet
 
 import (
+	"fmt"
 	"testing"
 
 	"github.com/prometheus/common/model"
@@ -47,10 +48,31 @@ func TestCreateDataPointForLabels(t *testing.T) {
 		},
 	}
 
-	dp := createDataPointForLabels(labels)
-	assert.Equal(t, podLabel, dp.Pod)
-	assert.Equal(t, containerLabel, dp.Container)
-	assert.Equal(t, namespaceLabel, dp.Namespace)
-	assert.Equal(t, nodeLabel, dp.Node)
+	dp := createDataPointForLabels(labels, DefaultLabelColumns())
+	assert.Equal(t, []string{podLabel, containerLabel, namespaceLabel, nodeLabel}, dp.LabelColumns)
 	assert.Equal(t, "a-label=baz-buz,other-label=foo-bar", dp.Labels)
+
+	dp = createDataPointForLabels(labels, []string{"other-label", "missing"})
+	assert.Equal(t, []string{"foo-bar", ""}, dp.LabelColumns)
+	assert.Equal(t, fmt.Sprintf(
+		"a-label=baz-buz,%s=%s,%s=%s,%s=%s,%s=%s",
+		containerKey, containerLabel,
+		namespaceKey, namespaceLabel,
+		nodeKey, nodeLabel,
+		podNameKey, podLabel,
+	), dp.Labels)
+}
+
+func TestLabelsFromDataPoint(t *testing.T) {
+	dp := DataPoint{
+		LabelColumns: []string{podLabel, "", namespaceLabel, ""},
+		Labels:       "a-label=baz-buz,other-label=foo=bar",
+	}
+
+	assert.Equal(t, []prompb.Label{
+		{Name: podNameKey, Value: podLabel},
+		{Name: namespaceKey, Value: namespaceLabel},
+		{Name: "a-label", Value: "baz-buz"},
+		{Name: "other-label", Value: "foo=bar"},
+	}, labelsFromDataPoint(DefaultLabelColumns(), dp))
 }
@@ -0,0 +1,214 @@
+package parquet
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"time"
+)
+
+// DefaultPathTemplate lays out files as <prefix>/<metric name>/<YYYYMMDDhhmmss>.parquet
+const DefaultPathTemplate = "{{.Prefix}}/{{.Metric}}/{{.Timestamp}}.parquet"
+
+const parquetExt = ".parquet"
+
+//nolint:gochecknoglobals
+var defaultPathTemplate = MustNewPathTemplate(DefaultPathTemplate)
+
+// PathFields are the values that a path template can refer to (other than the time, which is supplied separately);
+// Labels only needs to contain the labels returned by PathTemplate.Labels.
+type PathFields struct {
+	Tenant string
+	Prefix string
+	Metric string
+	Labels map[string]string
+}
+
+// Dir returns the directory that the metadata for these fields is stored under
+func (self PathFields) Dir() string {
+	return path.Join(self.Tenant, CleanPrefix(self.Prefix))
+}
+
+// CleanPrefix turns a client-supplied prefix into a relative path that can't escape the directory it's joined to
+func CleanPrefix(prefix string) string {
+	return strings.TrimPrefix(path.Clean("/"+prefix), "/")
+}
+
+// PathTemplate is a Go text/template that determines where data files are written, e.g.
+//
+//	metric={{.Metric}}/date={{.Date}}/hour={{.Hour}}/part-{{.Hostname}}-{{.Timestamp}}.parquet
+//
+// The template has to render a different path for every file start time, down to the second.  Histogram, exemplar, and
+// duplicate files are placed relative to the rendered data file path, in the same way as they are for the default
+// template.  In multi-tenant mode, the rendered path is always placed under the tenant directory.
+type PathTemplate struct {
+	text   string
+	tmpl   *template.Template
+	labels []string
+}
+
+func NewPathTemplate(text string) (*PathTemplate, error) {
+	tmpl, err := template.New("path").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse path template: %w", err)
+	}
+
+	labels := []string{}
+	for _, t := range tmpl.Templates() {
+		if t.Tree == nil {
+			continue
+		}
+		if err := collectLabels(t.Tree.Root, &labels); err != nil {
+			return nil, err
+		}
+	}
+	slices.Sort(labels)
+
+	self := &PathTemplate{text: text, tmpl: tmpl, labels: slices.Compact(labels)}
+
+	// Render the template up front, so that typos in field names are caught at startup instead of the first time we try
+	// to write a file
+	fields := PathFields{Prefix: "prefix", Metric: "metric"}
+	now := time.Now()
+	file, err := self.Render(fields, now)
+	if err != nil {
+		return nil, err
+	}
+
+	// A writer can start a new set of files as soon as a second after its last set (e.g., if it's rotated early), so
+	// every start time needs its own path; otherwise, the new files would overwrite the old ones
+	for _, d := range []time.Duration{time.Second, time.Minute, time.Hour, 24 * time.Hour, 366 * 24 * time.Hour} {
+		if other, err := self.Render(fields, now.Add(d)); err != nil {
+			return nil, err
+		} else if other == file {
+			return nil, fmt.Errorf("path template %q must give files that start at different times different paths "+
+				"(e.g., by using {{.Timestamp}})", text)
+		}
+	}
+	return self, nil
+}
+
+func MustNewPathTemplate(text string) *PathTemplate {
+	t, err := NewPathTemplate(text)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func (self *PathTemplate) String() string {
+	return self.text
+}
+
+// Labels returns the names of all the labels whose values are used in the template; data from series with different
+// values for these labels ends up in different files.
+func (self *PathTemplate) Labels() []string {
+	return self.labels
+}
+
+// Render returns the path (relative to the backend root) of the data file for the given fields and time
+func (self *PathTemplate) Render(fields PathFields, t time.Time) (string, error) {
+	var b strings.Builder
+	if err := self.tmpl.Execute(&b, pathData{fields: fields, Time: t.UTC()}); err != nil {
+		return "", fmt.Errorf("can't render path template: %w", err)
+	}
+
+	rendered := strings.TrimSuffix(strings.TrimPrefix(path.Clean("/"+b.String()), "/"), parquetExt)
+	if rendered == "" || strings.HasSuffix(rendered, "/") {
+		return "", fmt.Errorf("path template rendered an empty file name: %q", b.String())
+	}
+	return path.Join(fields.Tenant, rendered) + parquetExt, nil
+}
+
+// pathData is what the template is executed against; all of the exported fields and methods are available in the
+// template
+type pathData struct {
+	fields PathFields
+	Time   time.Time
+}
+
+func (self pathData) Tenant() string { return self.fields.Tenant }
+func (self pathData) Prefix() string { return self.fields.Prefix }
+func (self pathData) Metric() string { return self.fields.Metric }
+
+// Label returns the value of the label, with any slashes replaced so that it can't add extra directories to the path
+func (self pathData) Label(name string) string {
+	return strings.ReplaceAll(self.fields.Labels[name], "/", "_")
+}
+
+func (self pathData) Hostname() (string, error) {
+	return os.Hostname()
+}
+
+func (self pathData) Timestamp() string { return self.Time.Format(basenameFormat) }
+func (self pathData) Date() string      { return self.Time.Format("2006-01-02") }
+func (self pathData) Year() string      { return self.Time.Format("2006") }
+func (self pathData) Month() string     { return self.Time.Format("01") }
+func (self pathData) Day() string       { return self.Time.Format("02") }
+func (self pathData) Hour() string      { return self.Time.Format("15") }
+func (self pathData) Minute() string    { return self.Time.Format("04") }
+
+// collectLabels finds all of the {{.Label "name"}} calls in the template; the label names have to be constants so that
+// we know up front how to split series between files.
+func collectLabels(node parse.Node, labels *[]string) error {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return nil
+		}
+		for _, child := range n.Nodes {
+			if err := collectLabels(child, labels); err != nil {
+				return err
+			}
+		}
+	case *parse.ActionNode:
+		return collectLabels(n.Pipe, labels)
+	case *parse.IfNode:
+		return collectBranchLabels(&n.BranchNode, labels)
+	case *parse.RangeNode:
+		return collectBranchLabels(&n.BranchNode, labels)
+	case *parse.WithNode:
+		return collectBranchLabels(&n.BranchNode, labels)
+	case *parse.TemplateNode:
+		return collectLabels(n.Pipe, labels)
+	case *parse.PipeNode:
+		if n == nil {
+			return nil
+		}
+		for _, cmd := range n.Cmds {
+			if err := collectLabels(cmd, labels); err != nil {
+				return err
+			}
+		}
+	case *parse.CommandNode:
+		for i, arg := range n.Args {
+			if field, ok := arg.(*parse.FieldNode); ok && field.Ident[len(field.Ident)-1] == "Label" {
+				if i != 0 || len(n.Args) != 2 {
+					return errors.New("path template must call .Label with exactly one argument")
+				}
+				name, ok := n.Args[1].(*parse.StringNode)
+				if !ok {
+					return errors.New("path template must call .Label with a constant label name")
+				}
+				*labels = append(*labels, name.Text)
+			} else if err := collectLabels(arg, labels); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func collectBranchLabels(n *parse.BranchNode, labels *[]string) error {
+	for _, child := range []parse.Node{n.Pipe, n.List, n.ElseList} {
+		if err := collectLabels(child, labels); err != nil {
+			return err
+		}
+	}
+	return nil
+}
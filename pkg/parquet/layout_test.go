@@ -0,0 +1,130 @@
+package parquet
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPathTemplateRender(t *testing.T) {
+	hostname, err := os.Hostname()
+	assert.Nil(t, err)
+
+	start := time.Date(2024, 3, 7, 10, 12, 50, 0, time.UTC)
+	fields := PathFields{
+		Prefix: "prefix",
+		Metric: "kube_node_stuff",
+		Labels: map[string]string{"job": "kube/state"},
+	}
+
+	cases := map[string]struct {
+		template     string
+		tenant       string
+		expectedFile string
+	}{
+		"default": {
+			template:     DefaultPathTemplate,
+			expectedFile: "prefix/kube_node_stuff/20240307101250.parquet",
+		},
+		"default with tenant": {
+			template:     DefaultPathTemplate,
+			tenant:       "tenant-a",
+			expectedFile: "tenant-a/prefix/kube_node_stuff/20240307101250.parquet",
+		},
+		"hive partitioning": {
+			template:     "metric={{.Metric}}/date={{.Date}}/hour={{.Hour}}/part-{{.Hostname}}-{{.Timestamp}}.parquet",
+			expectedFile: "metric=kube_node_stuff/date=2024-03-07/hour=10/part-" + hostname + "-20240307101250.parquet",
+		},
+		"labels and time components": {
+			template:     `{{.Label "job"}}/{{.Year}}/{{.Month}}/{{.Day}}/{{.Metric}}-{{.Hour}}{{.Minute}}{{.Time.Second}}`,
+			expectedFile: "kube_state/2024/03/07/kube_node_stuff-101250.parquet",
+		},
+		"time format": {
+			template:     `{{.Metric}}/{{.Time.Format "2006-01-02T15:04:05"}}.parquet`,
+			expectedFile: "kube_node_stuff/2024-03-07T10:12:50.parquet",
+		},
+		"can't escape the root": {
+			template:     "../../{{.Metric}}/{{.Timestamp}}.parquet",
+			tenant:       "tenant-a",
+			expectedFile: "tenant-a/kube_node_stuff/20240307101250.parquet",
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			layout, err := NewPathTemplate(tc.template)
+			assert.Nil(t, err)
+
+			f := fields
+			f.Tenant = tc.tenant
+			file, err := layout.Render(f, start)
+			assert.Nil(t, err)
+			assert.Equal(t, tc.expectedFile, file)
+		})
+	}
+}
+
+func TestNewPathTemplate(t *testing.T) {
+	cases := map[string]struct {
+		template       string
+		expectedLabels []string
+		expectedErr    bool
+	}{
+		"no labels": {
+			template:       DefaultPathTemplate,
+			expectedLabels: []string{},
+		},
+		"nested labels": {
+			template:       `{{if .Label "env"}}{{.Label "env"}}{{else}}{{.Label "cluster"}}{{end}}/{{.Timestamp}}`,
+			expectedLabels: []string{"cluster", "env"},
+		},
+		"unknown field": {
+			template:    "{{.Metrc}}/{{.Timestamp}}",
+			expectedErr: true,
+		},
+		"non-constant label": {
+			template:    "{{.Label .Metric}}/{{.Timestamp}}",
+			expectedErr: true,
+		},
+		"parse error": {
+			template:    "{{.Metric",
+			expectedErr: true,
+		},
+		"empty file name": {
+			template:    "{{.Metric}}/.parquet",
+			expectedErr: true,
+		},
+		"empty path": {
+			template:    "{{.Tenant}}",
+			expectedErr: true,
+		},
+		"same path for every file": {
+			template:    "metric={{.Metric}}/date={{.Date}}/hour={{.Hour}}/part-{{.Hostname}}.parquet",
+			expectedErr: true,
+		},
+		"same path every minute": {
+			template:    "{{.Metric}}/{{.Time.Second}}.parquet",
+			expectedErr: true,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			layout, err := NewPathTemplate(tc.template)
+			if tc.expectedErr {
+				assert.NotNil(t, err)
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, tc.expectedLabels, layout.Labels())
+			}
+		})
+	}
+}
+
+func TestCompanionFiles(t *testing.T) {
+	dataFile := "metric=foo/date=2024-03-07/part-0.parquet"
+	assert.Equal(t, "metric=foo/date=2024-03-07/part-0.exemplars.parquet", siblingFile(dataFile, exemplarsSuffix))
+	assert.Equal(t, "metric=foo/date=2024-03-07/histograms/part-0.parquet", histogramFile(dataFile))
+}
@@ -0,0 +1,165 @@
+package parquet
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/prometheus/prompb"
+	log "github.com/sirupsen/logrus"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/writer"
+
+	"github.com/acrlabs/prom2parquet/pkg/backends"
+)
+
+const (
+	metadataFile = "metadata.parquet"
+
+	footerKeyMetricFamily = "prometheus.metric_family"
+	footerKeyType         = "prometheus.type"
+	footerKeyHelp         = "prometheus.help"
+	footerKeyUnit         = "prometheus.unit"
+)
+
+// MetricMetadata is the TYPE/HELP/UNIT information that Prometheus sends for each metric family; it's written to a
+// sidecar file for each prefix, and is also embedded in the key-value footer of each data file.
+type MetricMetadata struct {
+	MetricFamily string `parquet:"name=metric_family,type=BYTE_ARRAY,convertedtype=UTF8,encoding=PLAIN"`
+	Type         string `parquet:"name=type,type=BYTE_ARRAY,convertedtype=UTF8,encoding=PLAIN"`
+	Help         string `parquet:"name=help,type=BYTE_ARRAY,convertedtype=UTF8,encoding=PLAIN"`
+	Unit         string `parquet:"name=unit,type=BYTE_ARRAY,convertedtype=UTF8,encoding=PLAIN"`
+}
+
+func MetricMetadataFromProto(md prompb.MetricMetadata) MetricMetadata {
+	return MetricMetadata{
+		MetricFamily: md.MetricFamilyName,
+		Type:         strings.ToLower(md.Type.String()),
+		Help:         md.Help,
+		Unit:         md.Unit,
+	}
+}
+
+type MetadataStore struct {
+	root    string
+	backend backends.StorageBackend
+
+	metadata map[string]map[string]MetricMetadata
+
+	m      sync.RWMutex
+	writeM sync.Mutex
+}
+
+func NewMetadataStore(root string, backend backends.StorageBackend) *MetadataStore {
+	return &MetadataStore{
+		root:     root,
+		backend:  backend,
+		metadata: map[string]map[string]MetricMetadata{},
+	}
+}
+
+// Update records the metadata for a metric family in the given prefix, and returns true if anything changed
+func (self *MetadataStore) Update(prefix string, md MetricMetadata) bool {
+	self.m.Lock()
+	defer self.m.Unlock()
+
+	if _, ok := self.metadata[prefix]; !ok {
+		self.metadata[prefix] = map[string]MetricMetadata{}
+	}
+
+	if existing, ok := self.metadata[prefix][md.MetricFamily]; ok && existing == md {
+		return false
+	}
+
+	self.metadata[prefix][md.MetricFamily] = md
+	return true
+}
+
+// Get looks up the metadata for a metric name in the given prefix.  Histograms and summaries are reported as multiple
+// series (e.g., `foo_bucket`, `foo_count`, and `foo_sum`) which all share the metadata for the `foo` family.
+func (self *MetadataStore) Get(prefix, metricName string) (MetricMetadata, bool) {
+	self.m.RLock()
+	defer self.m.RUnlock()
+
+	for _, family := range metricFamilyCandidates(metricName) {
+		if md, ok := self.metadata[prefix][family]; ok {
+			return md, true
+		}
+	}
+	return MetricMetadata{}, false
+}
+
+// WriteSidecar (re-)writes the metadata file for the given prefix, containing all the known metric families
+func (self *MetadataStore) WriteSidecar(prefix string) error {
+	// Parquet files can't be appended to, so we rewrite the whole thing each time; make sure that two
+	// writes to the same file can't interleave
+	self.writeM.Lock()
+	defer self.writeM.Unlock()
+
+	self.m.RLock()
+	rows := make([]MetricMetadata, 0, len(self.metadata[prefix]))
+	for _, md := range self.metadata[prefix] {
+		rows = append(rows, md)
+	}
+	self.m.RUnlock()
+	sort.Slice(rows, func(i, j int) bool { return rows[i].MetricFamily < rows[j].MetricFamily })
+
+	// The prefix comes from the client, so make sure that it can't put the file outside of the backend root
+	file := path.Join(CleanPrefix(prefix), metadataFile)
+	fw, err := backends.ConstructBackendForFile(self.root, file, self.backend)
+	if err != nil {
+		return fmt.Errorf("can't create storage backend: %w", err)
+	}
+
+	pw, err := writer.NewParquetWriter(fw, new(MetricMetadata), 1)
+	if err != nil {
+		return fmt.Errorf("can't create parquet writer: %w", err)
+	}
+	pw.CompressionType = parquet.CompressionCodec_SNAPPY
+
+	for _, md := range rows {
+		if err := pw.Write(md); err != nil {
+			return fmt.Errorf("can't write metadata for %s: %w", md.MetricFamily, err)
+		}
+	}
+
+	if err := pw.WriteStop(); err != nil {
+		return fmt.Errorf("can't close metadata writer: %w", err)
+	}
+
+	log.Infof("wrote metadata for %d metric families to %s", len(rows), file)
+	return nil
+}
+
+// MetricFamilyMatches returns true if the given metric name is part of the given metric family
+func MetricFamilyMatches(metricName, family string) bool {
+	for _, candidate := range metricFamilyCandidates(metricName) {
+		if candidate == family {
+			return true
+		}
+	}
+	return false
+}
+
+func metricFamilyCandidates(metricName string) []string {
+	candidates := []string{metricName}
+	for _, suffix := range []string{"_bucket", "_count", "_sum"} {
+		if family, ok := strings.CutSuffix(metricName, suffix); ok {
+			candidates = append(candidates, family)
+		}
+	}
+	return candidates
+}
+
+func setFooterMetadata(pw *writer.ParquetWriter, md MetricMetadata) {
+	for _, kv := range [][2]string{
+		{footerKeyMetricFamily, md.MetricFamily},
+		{footerKeyType, md.Type},
+		{footerKeyHelp, md.Help},
+		{footerKeyUnit, md.Unit},
+	} {
+		pw.Footer.KeyValueMetadata = append(pw.Footer.KeyValueMetadata, &parquet.KeyValue{Key: kv[0], Value: &kv[1]})
+	}
+}
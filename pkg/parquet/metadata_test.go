@@ -0,0 +1,108 @@
+package parquet
+
+import (
+	"testing"
+
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/xitongsys/parquet-go-source/mem"
+	"github.com/xitongsys/parquet-go/writer"
+
+	"github.com/acrlabs/prom2parquet/pkg/backends"
+)
+
+func TestMetadataStore(t *testing.T) {
+	store := NewMetadataStore("/test", backends.Memory)
+	md := MetricMetadataFromProto(prompb.MetricMetadata{
+		Type:             prompb.MetricMetadata_HISTOGRAM,
+		MetricFamilyName: "http_request_duration_seconds",
+		Help:             "request latency",
+		Unit:             "seconds",
+	})
+	assert.Equal(t, "histogram", md.Type)
+
+	assert.True(t, store.Update("prefix", md))
+	assert.False(t, store.Update("prefix", md))
+
+	res, ok := store.Get("prefix", "http_request_duration_seconds_bucket")
+	assert.True(t, ok)
+	assert.Equal(t, md, res)
+
+	_, ok = store.Get("other-prefix", "http_request_duration_seconds_bucket")
+	assert.False(t, ok)
+}
+
+func TestMetricFamilyMatches(t *testing.T) {
+	cases := map[string]struct {
+		metricName string
+		family     string
+		expected   bool
+	}{
+		"exact":        {"foo_total", "foo_total", true},
+		"bucket":       {"foo_bucket", "foo", true},
+		"sum":          {"foo_sum", "foo", true},
+		"count":        {"foo_count", "foo", true},
+		"no match":     {"foo_bar", "foo", false},
+		"other family": {"bar_bucket", "foo", false},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, MetricFamilyMatches(tc.metricName, tc.family))
+		})
+	}
+}
+
+func TestWriteSidecar(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	mem.SetInMemFileFs(&fs)
+
+	store := NewMetadataStore("/test", backends.Memory)
+	store.Update("prefix", MetricMetadata{MetricFamily: "foo", Type: "gauge"})
+	assert.Nil(t, store.WriteSidecar("prefix"))
+
+	exists, err := afero.Exists(fs, "/test/prefix/metadata.parquet")
+	assert.Nil(t, err)
+	assert.True(t, exists)
+}
+
+func TestWriteSidecarPathTraversal(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	mem.SetInMemFileFs(&fs)
+
+	store := NewMetadataStore("/test", backends.Memory)
+	store.Update("../escape", MetricMetadata{MetricFamily: "foo", Type: "gauge"})
+	assert.Nil(t, store.WriteSidecar("../escape"))
+
+	exists, err := afero.Exists(fs, "/escape/metadata.parquet")
+	assert.Nil(t, err)
+	assert.False(t, exists)
+
+	exists, err = afero.Exists(fs, "/test/escape/metadata.parquet")
+	assert.Nil(t, err)
+	assert.True(t, exists)
+}
+
+func TestSetFooterMetadata(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	mem.SetInMemFileFs(&fs)
+
+	fw, err := mem.NewMemFileWriter("/test.parquet", nil)
+	assert.Nil(t, err)
+	pw, err := writer.NewParquetWriter(fw, new(DataPoint), pageNum)
+	assert.Nil(t, err)
+
+	setFooterMetadata(pw, MetricMetadata{MetricFamily: "foo", Type: "counter", Help: "the help", Unit: "bytes"})
+
+	footer := map[string]string{}
+	for _, kv := range pw.Footer.KeyValueMetadata {
+		footer[kv.Key] = *kv.Value
+	}
+	assert.Equal(t, map[string]string{
+		footerKeyMetricFamily: "foo",
+		footerKeyType:         "counter",
+		footerKeyHelp:         "the help",
+		footerKeyUnit:         "bytes",
+	}, footer)
+}
@@ -0,0 +1,169 @@
+package parquet
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	rowKindSample             = "sample"
+	rowKindHistogram          = "histogram"
+	rowKindExemplar           = "exemplar"
+	rowKindDuplicateSample    = "duplicate_sample"
+	rowKindDuplicateHistogram = "duplicate_histogram"
+)
+
+// Metrics holds the Prometheus metrics that the writers report about themselves.  A nil *Metrics is valid and doesn't
+// report anything.
+type Metrics struct {
+	rowsWritten       *prometheus.CounterVec
+	duplicatesDropped *prometheus.CounterVec
+	writeErrors       *prometheus.CounterVec
+	schemaWidenings   *prometheus.CounterVec
+	filesClosed       *prometheus.CounterVec
+	closeDuration     prometheus.Histogram
+	fileSize          prometheus.Histogram
+
+	// More than one writer can report under the same writer label (e.g., if the path template partitions the data by
+	// label values, or if a writer is replaced while the old one is still closing its files), so we only delete a
+	// writer's series once all of them have stopped
+	m       sync.Mutex
+	writers map[string]int
+}
+
+func NewMetrics(reg prometheus.Registerer) *Metrics {
+	factory := promauto.With(reg)
+	return &Metrics{
+		rowsWritten: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "prom2parquet_writer_rows_written_total",
+			Help: "Number of rows written to parquet files, by writer and kind of row",
+		}, []string{"writer", "kind"}),
+		duplicatesDropped: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "prom2parquet_writer_duplicates_dropped_total",
+			Help: "Number of duplicate or out-of-order samples that were dropped, by writer",
+		}, []string{"writer"}),
+		writeErrors: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "prom2parquet_writer_write_errors_total",
+			Help: "Number of rows that couldn't be written, by writer",
+		}, []string{"writer"}),
+		schemaWidenings: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "prom2parquet_writer_schema_widenings_total",
+			Help: "Number of times a writer added label columns to its schema (dynamic schemas only), by writer",
+		}, []string{"writer"}),
+		filesClosed: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "prom2parquet_files_closed_total",
+			Help: "Number of parquet files that were finalized (and uploaded, for remote backends), by result",
+		}, []string{"result"}),
+		closeDuration: factory.NewHistogram(prometheus.HistogramOpts{
+			Name:    "prom2parquet_file_close_duration_seconds",
+			Help:    "Time taken to finalize (and upload, for remote backends) a set of parquet files",
+			Buckets: prometheus.ExponentialBuckets(0.01, 4, 8),
+		}),
+		fileSize: factory.NewHistogram(prometheus.HistogramOpts{
+			Name:    "prom2parquet_file_size_bytes",
+			Help:    "Size of the parquet files that were finalized, not including the footer",
+			Buckets: prometheus.ExponentialBuckets(1024, 4, 10),
+		}),
+		writers: map[string]int{},
+	}
+}
+
+// forWriter returns the metrics for a single writer; the writer must call release when it stops, so that the series
+// for writers that have gone away don't pile up.
+func (self *Metrics) forWriter(writer string) *writerMetrics {
+	if self == nil {
+		return nil
+	}
+
+	self.m.Lock()
+	defer self.m.Unlock()
+	self.writers[writer]++
+
+	return &writerMetrics{
+		Metrics:           self,
+		writer:            writer,
+		rowsWritten:       self.rowsWritten.MustCurryWith(prometheus.Labels{"writer": writer}),
+		duplicatesDropped: self.duplicatesDropped.WithLabelValues(writer),
+		writeErrors:       self.writeErrors.WithLabelValues(writer),
+		schemaWidenings:   self.schemaWidenings.WithLabelValues(writer),
+	}
+}
+
+// writerMetrics are the metrics for a single writer, with the writer label already filled in; like Metrics, a nil
+// *writerMetrics doesn't report anything.
+type writerMetrics struct {
+	*Metrics
+
+	writer            string
+	rowsWritten       *prometheus.CounterVec
+	duplicatesDropped prometheus.Counter
+	writeErrors       prometheus.Counter
+	schemaWidenings   prometheus.Counter
+}
+
+func (self *writerMetrics) release() {
+	if self == nil {
+		return
+	}
+
+	self.m.Lock()
+	defer self.m.Unlock()
+
+	self.writers[self.writer]--
+	if self.writers[self.writer] > 0 {
+		return
+	}
+	delete(self.writers, self.writer)
+
+	lbls := prometheus.Labels{"writer": self.writer}
+	self.Metrics.rowsWritten.DeletePartialMatch(lbls)
+	self.Metrics.duplicatesDropped.Delete(lbls)
+	self.Metrics.writeErrors.Delete(lbls)
+	self.Metrics.schemaWidenings.Delete(lbls)
+}
+
+func (self *writerMetrics) rowWritten(kind string) {
+	if self != nil {
+		self.rowsWritten.WithLabelValues(kind).Inc()
+	}
+}
+
+func (self *writerMetrics) duplicateDropped() {
+	if self != nil {
+		self.duplicatesDropped.Inc()
+	}
+}
+
+func (self *writerMetrics) writeFailed() {
+	if self != nil {
+		self.writeErrors.Inc()
+	}
+}
+
+func (self *writerMetrics) schemaWidened() {
+	if self != nil {
+		self.schemaWidenings.Inc()
+	}
+}
+
+func (self *writerMetrics) fileClosed(size int64, err error) {
+	if self == nil {
+		return
+	}
+
+	if err != nil {
+		self.filesClosed.WithLabelValues("failure").Inc()
+	} else {
+		self.filesClosed.WithLabelValues("success").Inc()
+		self.fileSize.Observe(float64(size))
+	}
+}
+
+func (self *writerMetrics) filesClosedSince(start time.Time) {
+	if self != nil {
+		self.closeDuration.Observe(time.Since(start).Seconds())
+	}
+}
@@ -0,0 +1,92 @@
+package parquet
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+	log "github.com/sirupsen/logrus"
+	"github.com/xitongsys/parquet-go/reader"
+
+	"github.com/acrlabs/prom2parquet/pkg/backends"
+)
+
+// ParseDataFilePath splits the path to a data file (relative to the backend root) into its prefix, metric name, and the
+// start time of the file.  Paths that don't correspond to a data file (e.g., histogram, exemplar, or metadata files)
+// return false.
+func ParseDataFilePath(file string) (string, string, time.Time, bool) {
+	dir, filename := path.Split(file)
+	basename, ok := strings.CutSuffix(filename, ".parquet")
+	if !ok {
+		return "", "", time.Time{}, false
+	}
+
+	start, err := time.Parse(basenameFormat, basename)
+	if err != nil {
+		return "", "", time.Time{}, false
+	}
+
+	prefix, metricName := path.Split(strings.TrimSuffix(dir, "/"))
+	if metricName == "" || metricName == histogramsDir {
+		return "", "", time.Time{}, false
+	}
+
+	return strings.Trim(prefix, "/"), metricName, start, true
+}
+
+// ReadSeries reads all of the datapoints in a data file and groups them into timeseries.  The returned timeseries do
+// not include the metric name or prefix labels, since those aren't stored in the file.
+func ReadSeries(
+	ctx context.Context,
+	root, file string,
+	backend backends.StorageBackend,
+) ([]prompb.TimeSeries, error) {
+	fr, err := backends.ConstructReaderForFile(ctx, root, file, backend)
+	if err != nil {
+		return nil, fmt.Errorf("can't open %s: %w", file, err)
+	}
+	defer func() {
+		if err := fr.Close(); err != nil {
+			log.Warnf("can't close %s: %v", file, err)
+		}
+	}()
+
+	// Different files can have different label columns, so we use whatever columns this file was written with
+	labelColumns, err := fileLabelColumns(fr)
+	if err != nil {
+		return nil, fmt.Errorf("can't read schema for %s: %w", file, err)
+	}
+	schema := newRowSchema(DataPoint{}, labelColumns)
+
+	pr, err := reader.NewParquetReader(fr, schema.new(), pageNum)
+	if err != nil {
+		return nil, fmt.Errorf("can't create parquet reader for %s: %w", file, err)
+	}
+	defer pr.ReadStop()
+
+	rows := reflect.New(reflect.SliceOf(schema.typ))
+	rows.Elem().Set(reflect.MakeSlice(reflect.SliceOf(schema.typ), int(pr.GetNumRows()), int(pr.GetNumRows())))
+	if err := pr.Read(rows.Interface()); err != nil {
+		return nil, fmt.Errorf("can't read %s: %w", file, err)
+	}
+
+	seriesIndex := map[string]int{}
+	timeserieses := []prompb.TimeSeries{}
+	for j := range rows.Elem().Len() {
+		dp := schema.dataPoint(rows.Elem().Index(j))
+		key := strings.Join(append(dp.LabelColumns, dp.Labels), "\xff")
+		i, ok := seriesIndex[key]
+		if !ok {
+			i = len(timeserieses)
+			seriesIndex[key] = i
+			timeserieses = append(timeserieses, prompb.TimeSeries{Labels: labelsFromDataPoint(labelColumns, dp)})
+		}
+		timeserieses[i].Samples = append(timeserieses[i].Samples, prompb.Sample{Value: dp.Value, Timestamp: dp.Timestamp})
+	}
+
+	return timeserieses, nil
+}
@@ -0,0 +1,99 @@
+package parquet
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/xitongsys/parquet-go-source/mem"
+
+	"github.com/acrlabs/prom2parquet/pkg/backends"
+)
+
+func TestParseDataFilePath(t *testing.T) {
+	cases := map[string]struct {
+		file           string
+		expectedPrefix string
+		expectedMetric string
+		expectedOk     bool
+	}{
+		"data file": {
+			file:           "prefix/kube_node_stuff/20240307101250.parquet",
+			expectedPrefix: "prefix",
+			expectedMetric: "kube_node_stuff",
+			expectedOk:     true,
+		},
+		"nested prefix": {
+			file:           "a/b/kube_node_stuff/20240307101250.parquet",
+			expectedPrefix: "a/b",
+			expectedMetric: "kube_node_stuff",
+			expectedOk:     true,
+		},
+		"no prefix": {
+			file:           "kube_node_stuff/20240307101250.parquet",
+			expectedPrefix: "",
+			expectedMetric: "kube_node_stuff",
+			expectedOk:     true,
+		},
+		"histogram file": {
+			file: "prefix/kube_node_stuff/histograms/20240307101250.parquet",
+		},
+		"exemplar file": {
+			file: "prefix/kube_node_stuff/20240307101250.exemplars.parquet",
+		},
+		"metadata file": {
+			file: "prefix/metadata.parquet",
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			prefix, metricName, start, ok := ParseDataFilePath(tc.file)
+			assert.Equal(t, tc.expectedOk, ok)
+			if tc.expectedOk {
+				assert.Equal(t, tc.expectedPrefix, prefix)
+				assert.Equal(t, tc.expectedMetric, metricName)
+				assert.Equal(t, time.Date(2024, 3, 7, 10, 12, 50, 0, time.UTC), start)
+			}
+		})
+	}
+}
+
+func TestReadSeries(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	mem.SetInMemFileFs(&fs)
+
+	w := newTestProm2ParquetWriter(nil)
+	pw, err := w.newParquetWriter("prefix/kube_node_stuff/20240307101250.parquet", w.sampleSchema.new())
+	assert.Nil(t, err)
+
+	for _, dp := range []DataPoint{
+		{Timestamp: 0, Value: 1.0, LabelColumns: []string{podLabel, "", "", ""}, Labels: "a-label=foo"},
+		{Timestamp: 0, Value: 2.0, LabelColumns: []string{podLabel, "", "", ""}, Labels: "a-label=bar"},
+		{Timestamp: 1, Value: 3.0, LabelColumns: []string{podLabel, "", "", ""}, Labels: "a-label=foo"},
+	} {
+		assert.Nil(t, pw.Write(w.sampleSchema.row(dp)))
+	}
+	assert.Nil(t, pw.WriteStop())
+
+	timeserieses, err := ReadSeries(
+		context.TODO(),
+		"/test",
+		"prefix/kube_node_stuff/20240307101250.parquet",
+		backends.Memory,
+	)
+	assert.Nil(t, err)
+	assert.Equal(t, []prompb.TimeSeries{
+		{
+			Labels:  []prompb.Label{{Name: podNameKey, Value: podLabel}, {Name: "a-label", Value: "foo"}},
+			Samples: []prompb.Sample{{Value: 1.0, Timestamp: 0}, {Value: 3.0, Timestamp: 1}},
+		},
+		{
+			Labels:  []prompb.Label{{Name: podNameKey, Value: podLabel}, {Name: "a-label", Value: "bar"}},
+			Samples: []prompb.Sample{{Value: 2.0, Timestamp: 0}},
+		},
+	}, timeserieses)
+}
@@ -0,0 +1,152 @@
+package parquet
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/reader"
+	"github.com/xitongsys/parquet-go/source"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+const (
+	labelColumnsField = "LabelColumns"
+	labelColumnTag    = `parquet:"name=%s,type=BYTE_ARRAY,convertedtype=UTF8,encoding=PLAIN"`
+
+	footerKeyLabelColumns = "prom2parquet.label_columns"
+)
+
+// rowSchema is a parquet schema that's generated at runtime from one of the datapoint structs (DataPoint,
+// HistogramDataPoint, or ExemplarDataPoint): the struct's LabelColumns field is replaced by a string column for each of
+// the label columns, and all of its other tagged fields are copied as-is.
+type rowSchema struct {
+	typ reflect.Type
+
+	// For each field in typ, the index of the datapoint field it comes from, and (for label columns) the index into the
+	// LabelColumns field
+	fields  []int
+	columns []int
+}
+
+func newRowSchema(datapoint interface{}, labelColumns []string) *rowSchema {
+	dpType := reflect.TypeOf(datapoint)
+	schema := &rowSchema{}
+	structFields := []reflect.StructField{}
+	for i := range dpType.NumField() {
+		f := dpType.Field(i)
+		if f.Name == labelColumnsField {
+			for j, l := range labelColumns {
+				structFields = append(structFields, reflect.StructField{
+					Name: fmt.Sprintf("%s%d", labelColumnsField, j),
+					Type: reflect.TypeOf(""),
+					Tag:  reflect.StructTag(fmt.Sprintf(labelColumnTag, l)),
+				})
+				schema.fields = append(schema.fields, i)
+				schema.columns = append(schema.columns, j)
+			}
+		} else if f.Tag.Get("parquet") != "" {
+			structFields = append(structFields, f)
+			schema.fields = append(schema.fields, i)
+			schema.columns = append(schema.columns, -1)
+		}
+	}
+
+	schema.typ = reflect.StructOf(structFields)
+	return schema
+}
+
+// new returns a pointer to an empty row, which is what the parquet library uses to determine the schema
+func (self *rowSchema) new() interface{} {
+	return reflect.New(self.typ).Interface()
+}
+
+// row converts a datapoint into a row for this schema
+func (self *rowSchema) row(datapoint interface{}) interface{} {
+	dp := reflect.ValueOf(datapoint)
+	row := reflect.New(self.typ).Elem()
+	for i, field := range self.fields {
+		if j := self.columns[i]; j >= 0 {
+			row.Field(i).SetString(dp.Field(field).Index(j).String())
+		} else {
+			row.Field(i).Set(dp.Field(field))
+		}
+	}
+	return row.Interface()
+}
+
+// dataPoint is the inverse of row, for rows of a DataPoint schema
+func (self *rowSchema) dataPoint(row reflect.Value) DataPoint {
+	dp := DataPoint{}
+	v := reflect.ValueOf(&dp).Elem()
+	for i, field := range self.fields {
+		if j := self.columns[i]; j >= 0 {
+			dp.LabelColumns = append(dp.LabelColumns, row.Field(i).String())
+		} else {
+			v.Field(field).Set(row.Field(i))
+		}
+	}
+	return dp
+}
+
+// fixedColumns returns the names of all the columns that aren't label columns, in any of the datapoint structs
+func fixedColumns() map[string]bool {
+	columns := map[string]bool{}
+	for _, dp := range []interface{}{DataPoint{}, HistogramDataPoint{}, ExemplarDataPoint{}} {
+		dpType := reflect.TypeOf(dp)
+		for i := range dpType.NumField() {
+			if name, ok := columnName(dpType.Field(i)); ok {
+				columns[name] = true
+			}
+		}
+	}
+	return columns
+}
+
+// fileLabelColumns returns the label columns in a data file, in the order they appear in the file's schema
+func fileLabelColumns(pf source.ParquetFile) ([]string, error) {
+	pr := reader.ParquetReader{PFile: pf}
+	if err := pr.ReadFooter(); err != nil {
+		return nil, fmt.Errorf("can't read footer: %w", err)
+	}
+
+	fixed := fixedColumns()
+	labelColumns := []string{}
+	// The first element of the schema is the root
+	for _, se := range pr.Footer.Schema[1:] {
+		if !fixed[se.Name] {
+			labelColumns = append(labelColumns, se.Name)
+		}
+	}
+	return labelColumns, nil
+}
+
+// setLabelColumnsMetadata records the file's label columns (as a comma-separated list) in its key-value footer, so that
+// readers can tell which columns are labels without knowing all of the built-in columns
+func setLabelColumnsMetadata(pw *writer.ParquetWriter) {
+	fixed := fixedColumns()
+	labelColumns := []string{}
+	// The first element of the schema is the root
+	for _, info := range pw.SchemaHandler.Infos[1:] {
+		if !fixed[info.ExName] {
+			labelColumns = append(labelColumns, info.ExName)
+		}
+	}
+
+	value := strings.Join(labelColumns, ",")
+	pw.Footer.KeyValueMetadata = append(
+		pw.Footer.KeyValueMetadata,
+		&parquet.KeyValue{Key: footerKeyLabelColumns, Value: &value},
+	)
+}
+
+// columnName returns the name of the column in a parquet tag, if the field has one
+func columnName(f reflect.StructField) (string, bool) {
+	for _, kv := range strings.Split(f.Tag.Get("parquet"), ",") {
+		if name, ok := strings.CutPrefix(kv, "name="); ok {
+			return name, true
+		}
+	}
+	return "", false
+}
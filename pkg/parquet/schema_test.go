@@ -0,0 +1,232 @@
+package parquet
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/samber/lo"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/xitongsys/parquet-go-source/mem"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/reader"
+
+	"github.com/acrlabs/prom2parquet/pkg/backends"
+)
+
+// legacyDataPoint is the fixed schema that was used for all data files before the label columns were configurable
+type legacyDataPoint struct {
+	Timestamp int64   `parquet:"name=timestamp,type=INT64,convertedtype=TIMESTAMP"`
+	Value     float64 `parquet:"name=value,type=DOUBLE"`
+
+	Pod       string `parquet:"name=pod,type=BYTE_ARRAY,convertedtype=UTF8,encoding=PLAIN"`
+	Container string `parquet:"name=container,type=BYTE_ARRAY,convertedtype=UTF8,encoding=PLAIN"`
+	Namespace string `parquet:"name=namespace,type=BYTE_ARRAY,convertedtype=UTF8,encoding=PLAIN"`
+	Node      string `parquet:"name=node,type=BYTE_ARRAY,convertedtype=UTF8,encoding=PLAIN"`
+	Labels    string `parquet:"name=labels,type=BYTE_ARRAY,convertedtype=UTF8,encoding=PLAIN"`
+}
+
+func TestDefaultSchemaMatchesLegacy(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	mem.SetInMemFileFs(&fs)
+
+	legacy, err := newParquetWriter("/test", "legacy.parquet", backends.Memory, new(legacyDataPoint))
+	assert.Nil(t, err)
+	generated, err := newParquetWriter(
+		"/test",
+		"generated.parquet",
+		backends.Memory,
+		newRowSchema(DataPoint{}, DefaultLabelColumns()).new(),
+	)
+	assert.Nil(t, err)
+
+	// The in-memory schema uses the Go field names, so we compare the column names and tags that end up in the file
+	assert.Equal(t, len(legacy.SchemaHandler.Infos), len(generated.SchemaHandler.Infos))
+	for i, info := range legacy.SchemaHandler.Infos {
+		info.InName = generated.SchemaHandler.Infos[i].InName
+		assert.Equal(t, info, generated.SchemaHandler.Infos[i])
+	}
+}
+
+func TestReadSeriesLegacySchema(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	mem.SetInMemFileFs(&fs)
+
+	file := "prefix/kube_node_stuff/20240307101250.parquet"
+	pw, err := newParquetWriter("/test", file, backends.Memory, new(legacyDataPoint))
+	assert.Nil(t, err)
+	assert.Nil(t, pw.Write(legacyDataPoint{Timestamp: 1, Value: 1.0, Node: nodeLabel, Labels: "a-label=foo"}))
+	assert.Nil(t, pw.WriteStop())
+
+	timeserieses, err := ReadSeries(context.TODO(), "/test", file, backends.Memory)
+	assert.Nil(t, err)
+	assert.Equal(t, []prompb.TimeSeries{{
+		Labels:  []prompb.Label{{Name: nodeKey, Value: nodeLabel}, {Name: "a-label", Value: "foo"}},
+		Samples: []prompb.Sample{{Value: 1.0, Timestamp: 1}},
+	}}, timeserieses)
+}
+
+func TestListenLabelColumns(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	mem.SetInMemFileFs(&fs)
+
+	columns, err := NewLabelColumns(
+		FixedSchema,
+		[]string{"job"},
+		[]LabelColumnRule{{Match: "kube_.*", Labels: []string{"le"}}},
+	)
+	assert.Nil(t, err)
+
+	w, err := NewProm2ParquetWriter(
+		context.TODO(),
+		"/test",
+		PathFields{Prefix: "prefix", Metric: "kube_node_stuff"},
+		nil,
+		columns,
+		backends.Memory,
+		time.Minute,
+		nil,
+		nil,
+		KeepDuplicates,
+		nil,
+		nil,
+	)
+	assert.Nil(t, err)
+	w.clock = clockwork.NewFakeClockAt(time.Time{})
+
+	stream := make(chan prompb.TimeSeries)
+	running := make(chan bool, 1)
+	go func() { assert.Nil(t, w.listen(stream, nil, running)) }()
+	<-running
+
+	stream <- prompb.TimeSeries{
+		Labels: []prompb.Label{
+			{Name: model.MetricNameLabel, Value: "kube_node_stuff"},
+			{Name: "job", Value: "the-job"},
+			{Name: "le", Value: "0.5"},
+			{Name: podNameKey, Value: podLabel},
+		},
+		Samples:    []prompb.Sample{{Value: 1.0, Timestamp: 1000}},
+		Histograms: []prompb.Histogram{{Count: &prompb.Histogram_CountInt{CountInt: 1}, Timestamp: 1000}},
+	}
+	close(stream)
+	<-running
+
+	dataFile := "prefix/kube_node_stuff/00010101000000.parquet"
+	timeserieses, err := ReadSeries(context.TODO(), "/test", dataFile, backends.Memory)
+	assert.Nil(t, err)
+	assert.Equal(t, []prompb.TimeSeries{{
+		Labels: []prompb.Label{
+			{Name: "job", Value: "the-job"},
+			{Name: "le", Value: "0.5"},
+			{Name: podNameKey, Value: podLabel},
+		},
+		Samples: []prompb.Sample{{Value: 1.0, Timestamp: 1000}},
+	}}, timeserieses)
+
+	fr, err := backends.ConstructReaderForFile(context.TODO(), "/test", histogramFile(dataFile), backends.Memory)
+	assert.Nil(t, err)
+	labelColumns, err := fileLabelColumns(fr)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"job", "le"}, labelColumns)
+}
+
+func TestListenDynamicSchema(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	mem.SetInMemFileFs(&fs)
+
+	columns, err := NewLabelColumns(DynamicSchema, []string{"job"}, nil)
+	assert.Nil(t, err)
+
+	tracker := &testFileTracker{}
+	w, err := NewProm2ParquetWriter(
+		context.TODO(),
+		"/test",
+		PathFields{Prefix: "prefix", Metric: "kube_node_stuff"},
+		nil,
+		columns,
+		backends.Memory,
+		time.Minute,
+		nil,
+		tracker,
+		KeepDuplicates,
+		nil,
+		nil,
+	)
+	assert.Nil(t, err)
+	w.clock = clockwork.NewFakeClockAt(time.Time{})
+
+	stream := make(chan prompb.TimeSeries)
+	running := make(chan bool, 1)
+	go func() { assert.Nil(t, w.listen(stream, nil, running)) }()
+	<-running
+
+	for _, labels := range [][]prompb.Label{
+		{{Name: "job", Value: "the-job"}, {Name: "instance", Value: "a"}, {Name: "value", Value: "reserved"}},
+		{{Name: "job", Value: "the-job"}, {Name: "instance", Value: "b"}},
+		{{Name: "job", Value: "the-job"}, {Name: "instance", Value: "a"}, {Name: "device", Value: "sda"}},
+	} {
+		stream <- prompb.TimeSeries{
+			Labels:  append([]prompb.Label{{Name: model.MetricNameLabel, Value: "kube_node_stuff"}}, labels...),
+			Samples: []prompb.Sample{{Value: 1.0, Timestamp: 1000}},
+		}
+	}
+	close(stream)
+	<-running
+
+	// The first set of files is closed asynchronously when the schema is widened
+	assert.Eventually(t, func() bool { return tracker.numClosed() == 2 }, time.Second, 10*time.Millisecond)
+
+	cases := map[string]struct {
+		file                 string
+		expectedLabelColumns []string
+		expectedSeries       int
+	}{
+		"initial schema": {
+			file:                 "prefix/kube_node_stuff/00010101000000.parquet",
+			expectedLabelColumns: []string{"job", "instance"},
+			expectedSeries:       2,
+		},
+		"widened schema": {
+			file:                 "prefix/kube_node_stuff/00010101000001.parquet",
+			expectedLabelColumns: []string{"job", "instance", "device"},
+			expectedSeries:       1,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			fr, err := backends.ConstructReaderForFile(context.TODO(), "/test", tc.file, backends.Memory)
+			assert.Nil(t, err)
+			labelColumns, err := fileLabelColumns(fr)
+			assert.Nil(t, err)
+			assert.Equal(t, tc.expectedLabelColumns, labelColumns)
+
+			pr, err := reader.NewParquetReader(fr, nil, pageNum)
+			assert.Nil(t, err)
+			assert.Contains(t, pr.Footer.KeyValueMetadata, &parquet.KeyValue{
+				Key:   footerKeyLabelColumns,
+				Value: lo.ToPtr(strings.Join(tc.expectedLabelColumns, ",")),
+			})
+			pr.ReadStop()
+
+			timeserieses, err := ReadSeries(context.TODO(), "/test", tc.file, backends.Memory)
+			assert.Nil(t, err)
+			assert.Len(t, timeserieses, tc.expectedSeries)
+		})
+	}
+
+	// Labels that conflict with the built-in columns stay in the labels column
+	timeserieses, err := ReadSeries(context.TODO(), "/test", cases["initial schema"].file, backends.Memory)
+	assert.Nil(t, err)
+	assert.Equal(t, []prompb.Label{
+		{Name: "job", Value: "the-job"},
+		{Name: "instance", Value: "a"},
+		{Name: "value", Value: "reserved"},
+	}, timeserieses[0].Labels)
+}
@@ -0,0 +1,109 @@
+package parquet
+
+import (
+	"sync"
+	"time"
+
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+const maxRecentFiles = 10
+
+// WriterStatus is a snapshot of what a writer is currently doing, for debugging
+type WriterStatus struct {
+	CurrentFile    string       `json:"currentFile"`
+	RowsBuffered   int64        `json:"rowsBuffered"`
+	BytesWritten   int64        `json:"bytesWritten"`
+	BytesBuffered  int64        `json:"bytesBuffered"`
+	LastSampleTime *time.Time   `json:"lastSampleTime,omitempty"`
+	NextFlushTime  time.Time    `json:"nextFlushTime"`
+	LastError      string       `json:"lastError,omitempty"`
+	LastErrorTime  *time.Time   `json:"lastErrorTime,omitempty"`
+	RecentFiles    []FileStatus `json:"recentFiles,omitempty"`
+}
+
+// FileStatus describes a file that a writer finalized
+type FileStatus struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	ClosedAt time.Time `json:"closedAt"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// writerStatus is updated by the writer's goroutine (and by the goroutines that close its files), and read by Status;
+// RowsBuffered, BytesWritten, and BytesBuffered only cover the current set of files.
+type writerStatus struct {
+	m sync.Mutex
+	WriterStatus
+}
+
+// Status returns a snapshot of the writer's current state, including the files it has finalized recently
+func (self *Prom2ParquetWriter) Status() WriterStatus {
+	self.status.m.Lock()
+	defer self.status.m.Unlock()
+
+	status := self.status.WriterStatus
+	status.RecentFiles = append([]FileStatus{}, self.status.RecentFiles...)
+	return status
+}
+
+func (self *writerStatus) filesOpened(dataFile string) {
+	self.m.Lock()
+	defer self.m.Unlock()
+
+	self.CurrentFile = dataFile
+	self.RowsBuffered = 0
+	self.BytesWritten = 0
+	self.BytesBuffered = 0
+}
+
+func (self *writerStatus) rowsWritten(rows int, lastSample int64, pws ...*writer.ParquetWriter) {
+	self.m.Lock()
+	defer self.m.Unlock()
+
+	self.RowsBuffered += int64(rows)
+	if rows > 0 {
+		t := time.UnixMilli(lastSample).UTC()
+		if self.LastSampleTime == nil || t.After(*self.LastSampleTime) {
+			self.LastSampleTime = &t
+		}
+	}
+
+	self.BytesWritten, self.BytesBuffered = 0, 0
+	for _, pw := range pws {
+		if pw != nil {
+			self.BytesWritten += pw.Offset
+			self.BytesBuffered += pw.Size + pw.ObjsSize
+		}
+	}
+}
+
+func (self *writerStatus) flushScheduled(t time.Time) {
+	self.m.Lock()
+	defer self.m.Unlock()
+	self.NextFlushTime = t
+}
+
+func (self *writerStatus) failed(err error) {
+	self.m.Lock()
+	defer self.m.Unlock()
+
+	now := time.Now().UTC()
+	self.LastError = err.Error()
+	self.LastErrorTime = &now
+}
+
+func (self *writerStatus) fileClosed(name string, size int64, err error) {
+	self.m.Lock()
+	defer self.m.Unlock()
+
+	file := FileStatus{Name: name, Size: size, ClosedAt: time.Now().UTC()}
+	if err != nil {
+		file.Error = err.Error()
+	}
+
+	self.RecentFiles = append(self.RecentFiles, file)
+	if len(self.RecentFiles) > maxRecentFiles {
+		self.RecentFiles = self.RecentFiles[len(self.RecentFiles)-maxRecentFiles:]
+	}
+}
@@ -2,7 +2,14 @@ package parquet
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/jonboulle/clockwork"
@@ -14,59 +21,200 @@ import (
 	"github.com/acrlabs/prom2parquet/pkg/backends"
 )
 
-const pageNum = 4
+const (
+	pageNum        = 4
+	basenameFormat = "20060102150405"
+)
+
+// FileTracker is notified whenever a writer opens a new set of files and when it's finished closing them, so that the
+// caller can tell when the data it has handed to the writer is durably stored.  The tracker is given the name of the
+// data file for each set of files, for reporting.
+type FileTracker interface {
+	FilesOpened(dataFile string) uint64
+	FilesClosed(id uint64, ok bool)
+}
+
+// FileStarts hands out the start times that sets of files are named after.  Normally each set of files starts at the
+// beginning of a flush interval, but if a metric's files are closed early (e.g., because its writer was idle) and then
+// a new writer is created for the same metric in the same interval, the new files would overwrite the old ones; if all
+// of the writers for a metric share a FileStarts, they're guaranteed to get different start times.
+type FileStarts struct {
+	m       sync.Mutex
+	last    time.Time
+	hasLast bool
+}
+
+func (self *FileStarts) next(now time.Time, flushInterval time.Duration) time.Time {
+	self.m.Lock()
+	defer self.m.Unlock()
+
+	start := now.Truncate(flushInterval)
+	if self.hasLast && !start.After(self.last) {
+		// File names have a resolution of one second, so in the (unlikely) event that we've already used the current
+		// second, we use the next one instead
+		start = now.Truncate(time.Second)
+		if !start.After(self.last) {
+			start = self.last.Add(time.Second)
+		}
+	}
+	self.last, self.hasLast = start, true
+	return start
+}
+
+// Last returns the most recent start time that was handed out
+func (self *FileStarts) Last() time.Time {
+	self.m.Lock()
+	defer self.m.Unlock()
+	return self.last
+}
 
 type Prom2ParquetWriter struct {
 	backend       backends.StorageBackend
 	root          string
-	prefix        string
+	fields        PathFields
+	layout        *PathTemplate
+	labelColumns  []string
+	dynamic       bool
 	flushInterval time.Duration
+	metadata      *MetadataStore
+	tracker       FileTracker
+	duplicates    DuplicatePolicy
+	starts        *FileStarts
+	metrics       *writerMetrics
+	status        writerStatus
 
+	sampleSchema    *rowSchema
+	histogramSchema *rowSchema
+	exemplarSchema  *rowSchema
+
+	filesID     uint64
 	currentFile string
 	pw          *writer.ParquetWriter
+	hpw         *writer.ParquetWriter
+	epw         *writer.ParquetWriter
+	dpw         *writer.ParquetWriter
+	dhpw        *writer.ParquetWriter
+
+	samples       *seriesTracker
+	histograms    *seriesTracker
+	pendingRows   int
+	seriesWritten atomic.Uint64
+
+	rotations chan chan<- rotateResult
 
 	clock clockwork.Clock
 }
 
+type rotateResult struct {
+	files []string
+	err   error
+}
+
+// DataPoint stores a single sample.  The values of the label columns are stored in LabelColumns, in the same order as
+// the writer's label columns; since the label columns differ between metrics, the actual parquet schema for each writer
+// is generated at runtime, with a string column for each label column in place of the LabelColumns field.
 type DataPoint struct {
 	Timestamp int64   `parquet:"name=timestamp,type=INT64,convertedtype=TIMESTAMP"`
 	Value     float64 `parquet:"name=value,type=DOUBLE"`
 
-	Pod       string `parquet:"name=pod,type=BYTE_ARRAY,convertedtype=UTF8,encoding=PLAIN"`
-	Container string `parquet:"name=container,type=BYTE_ARRAY,convertedtype=UTF8,encoding=PLAIN"`
-	Namespace string `parquet:"name=namespace,type=BYTE_ARRAY,convertedtype=UTF8,encoding=PLAIN"`
-	Node      string `parquet:"name=node,type=BYTE_ARRAY,convertedtype=UTF8,encoding=PLAIN"`
-	Labels    string `parquet:"name=labels,type=BYTE_ARRAY,convertedtype=UTF8,encoding=PLAIN"`
+	LabelColumns []string
+	Labels       string `parquet:"name=labels,type=BYTE_ARRAY,convertedtype=UTF8,encoding=PLAIN"`
 }
 
+// NewProm2ParquetWriter creates a writer for all of the series that share the given path fields; if layout is nil, the
+// default path template is used, if columns is nil, the default label columns are used, if starts is nil, the writer
+// doesn't share its file start times with any other writer, and if metrics is nil, the writer doesn't report any
+// metrics.
 func NewProm2ParquetWriter(
 	ctx context.Context,
-	root, prefix string,
+	root string,
+	fields PathFields,
+	layout *PathTemplate,
+	columns *LabelColumns,
 	backend backends.StorageBackend,
 	flushInterval time.Duration,
+	metadata *MetadataStore,
+	tracker FileTracker,
+	duplicates DuplicatePolicy,
+	starts *FileStarts,
+	metrics *Metrics,
 ) (*Prom2ParquetWriter, error) {
-	return &Prom2ParquetWriter{
+	if layout == nil {
+		layout = defaultPathTemplate
+	}
+	if starts == nil {
+		starts = &FileStarts{}
+	}
+	labelColumns := columns.For(fields.Metric)
+
+	w := &Prom2ParquetWriter{
 		backend:       backend,
 		root:          root,
-		prefix:        prefix,
+		fields:        fields,
+		layout:        layout,
+		labelColumns:  labelColumns,
+		dynamic:       columns.Dynamic(),
 		flushInterval: flushInterval,
+		metadata:      metadata,
+		tracker:       tracker,
+		duplicates:    duplicates,
+		starts:        starts,
+		metrics:       metrics.forWriter(path.Join(fields.Dir(), fields.Metric)),
+
+		samples:    newSeriesTracker(),
+		histograms: newSeriesTracker(),
+
+		rotations: make(chan chan<- rotateResult),
 
 		clock: clockwork.NewRealClock(),
-	}, nil
+	}
+	w.setLabelColumns(labelColumns)
+	return w, nil
 }
 
-func (self *Prom2ParquetWriter) Listen(stream <-chan prompb.TimeSeries) {
-	self.listen(stream, self.getFlushTimer(), nil)
+// Listen writes all of the timeseries from the stream to parquet files until the stream is closed; it returns an error
+// if it had to stop early because it couldn't create a new set of files.
+func (self *Prom2ParquetWriter) Listen(stream <-chan prompb.TimeSeries) error {
+	defer self.metrics.release()
+
+	err := self.listen(stream, self.getFlushTimer(), nil)
+	if err != nil {
+		self.status.failed(err)
+	}
+	return err
+}
+
+// Rotate finalizes the writer's current files and starts new ones; it returns the files that were finalized once
+// they've all been closed.  The caller must make sure that the writer is still listening.
+func (self *Prom2ParquetWriter) Rotate(ctx context.Context) ([]string, error) {
+	done := make(chan rotateResult, 1)
+	select {
+	case self.rotations <- done:
+	case <-ctx.Done():
+		return nil, fmt.Errorf("can't rotate files for %s: %w", self.metricDir(), ctx.Err())
+	}
+
+	select {
+	case res := <-done:
+		return res.files, res.err
+	case <-ctx.Done():
+		return nil, fmt.Errorf("can't wait for files for %s to close: %w", self.metricDir(), ctx.Err())
+	}
+}
+
+// SeriesWritten returns the number of timeseries from the stream that the writer has finished with; all of their data
+// is in sets of files that have already been reported to the FileTracker (unless it couldn't be written at all).
+func (self *Prom2ParquetWriter) SeriesWritten() uint64 {
+	return self.seriesWritten.Load()
 }
 
 func (self *Prom2ParquetWriter) listen(
 	stream <-chan prompb.TimeSeries,
 	flushTimer <-chan time.Time,
 	running chan<- bool, // used for testing
-) {
+) error {
 	if err := self.createBackendWriter(); err != nil {
-		log.Errorf("could not create backend writer: %v", err)
-		return
+		return fmt.Errorf("can't create backend writer for %s: %w", self.metricDir(), err)
 	}
 
 	// self.pw is a pointer to the writer instance, but it can get switched
@@ -74,10 +222,13 @@ func (self *Prom2ParquetWriter) listen(
 	// args when the defer call happens, not when the deferred function actually
 	// executes, so here we need to use a double pointer so that we can make
 	// sure we're closing the actual correct writer instance
-	defer func(pw **writer.ParquetWriter) {
-		closeFile(*pw)
-		close(running)
-	}(&self.pw)
+	defer func(filesID *uint64, dataFile *string, pw, hpw, epw, dpw, dhpw **writer.ParquetWriter) {
+		//nolint:errcheck // errors are logged by closeFiles, and there's nobody else to report them to
+		self.closeFiles(*filesID, *dataFile, *pw, *hpw, *epw, *dpw, *dhpw)
+		if running != nil {
+			close(running)
+		}
+	}(&self.filesID, &self.currentFile, &self.pw, &self.hpw, &self.epw, &self.dpw, &self.dhpw)
 
 	if running != nil {
 		running <- true
@@ -87,57 +238,315 @@ func (self *Prom2ParquetWriter) listen(
 		select {
 		case ts, ok := <-stream:
 			if !ok {
-				return
+				return nil
 			}
-
-			dp := createDataPointForLabels(ts.Labels)
-			for _, s := range ts.Samples {
-				dp.Value = s.Value
-				dp.Timestamp = s.Timestamp
-
-				if err := self.pw.Write(dp); err != nil {
-					log.Errorf("could not write datapoint: %v", err)
-				}
+			if err := self.writeTimeseries(ts); err != nil {
+				return err
 			}
 		case <-flushTimer:
 			flushTimer = self.getFlushTimer()
 			log.Infof("flush triggered for %v", self.currentFile)
+			self.rotateSeriesTrackers()
 
-			// Run this in a separate goroutine so that writing the data
-			// to S3 (with throttling or whatever) doesn't block the new incoming
-			// datapoints
-			go closeFile(self.pw)
-			if err := self.createBackendWriter(); err != nil {
-				log.Errorf("could not create backend writer: %v", err)
-				return
+			if err := self.rotate(nil); err != nil {
+				return fmt.Errorf("can't create backend writer for %s: %w", self.metricDir(), err)
 			}
+		case done := <-self.rotations:
+			// Anything that's already in the queue was accepted before the rotation was requested, so it belongs in the
+			// files that are being finalized; the caller holds off on closing the stream until the rotation is done, so
+			// the queue can't be closed out from under us
+			for range len(stream) {
+				if err := self.writeTimeseries(<-stream); err != nil {
+					return err
+				}
+			}
+
+			log.Infof("rotation requested for %v", self.currentFile)
+			if err := self.rotate(done); err != nil {
+				return fmt.Errorf("can't create backend writer for %s: %w", self.metricDir(), err)
+			}
+		}
+	}
+}
+
+func (self *Prom2ParquetWriter) writeTimeseries(ts prompb.TimeSeries) error {
+	if self.dynamic {
+		if err := self.widenSchema(ts.Labels); err != nil {
+			return fmt.Errorf("can't create backend writer for %s: %w", self.metricDir(), err)
+		}
+	}
+
+	key := seriesKey(ts.Labels)
+	dp := createDataPointForLabels(ts.Labels, self.labelColumns)
+	for _, s := range ts.Samples {
+		dp.Value = s.Value
+		dp.Timestamp = s.Timestamp
+
+		if err := self.writeSample(key, dp); err != nil {
+			self.writeFailed("datapoint", err)
+		}
+	}
+
+	for _, h := range ts.Histograms {
+		if err := self.writeHistogram(key, createHistogramDataPoint(dp, h)); err != nil {
+			self.writeFailed("histogram datapoint", err)
 		}
 	}
+
+	for _, e := range ts.Exemplars {
+		if err := self.writeExemplar(createExemplarDataPoint(dp, e)); err != nil {
+			self.writeFailed("exemplar", err)
+		}
+	}
+
+	self.status.rowsWritten(self.pendingRows, lastTimestamp(ts), self.pw, self.hpw, self.epw, self.dpw, self.dhpw)
+	self.pendingRows = 0
+	self.seriesWritten.Add(1)
+	return nil
+}
+
+// rotate closes the current files and opens new ones; the result of closing the files is sent to done (if non-nil).
+func (self *Prom2ParquetWriter) rotate(done chan<- rotateResult) error {
+	// Run this in a separate goroutine so that writing the data
+	// to S3 (with throttling or whatever) doesn't block the new incoming
+	// datapoints
+	go func(filesID uint64, dataFile string, pws ...*writer.ParquetWriter) {
+		files, err := self.closeFiles(filesID, dataFile, pws...)
+		if done != nil {
+			done <- rotateResult{files, err}
+		}
+	}(self.filesID, self.currentFile, self.pw, self.hpw, self.epw, self.dpw, self.dhpw)
+
+	// These are being closed in the background now, so make sure we don't close them again if we can't create the new
+	// writers
+	self.pw, self.hpw, self.epw, self.dpw, self.dhpw = nil, nil, nil, nil, nil
+	return self.createBackendWriter()
 }
 
 func (self *Prom2ParquetWriter) createBackendWriter() error {
-	basename := self.now().Truncate(self.flushInterval).Format("20060102150405")
-	self.currentFile = fmt.Sprintf("%s/%s.parquet", self.prefix, basename)
+	file, err := self.layout.Render(self.fields, self.starts.next(self.now(), self.flushInterval))
+	if err != nil {
+		return err
+	}
+
+	// With a dynamic schema, we don't know what the data file's columns should be until we see some data, so it's
+	// created lazily just like the other files
+	var pw *writer.ParquetWriter
+	if !self.dynamic {
+		pw, err = self.newParquetWriter(file, self.sampleSchema.new())
+		if err != nil {
+			return err
+		}
+	}
+
+	self.currentFile = file
+	self.pw = pw
+	self.status.filesOpened(file)
+	if self.tracker != nil {
+		self.filesID = self.tracker.FilesOpened(file)
+	}
+	// Most metrics don't have any histogram, exemplar, or duplicate data, so we only create those files once we
+	// actually see some
+	self.hpw = nil
+	self.epw = nil
+	self.dpw = nil
+	self.dhpw = nil
 
-	fw, err := backends.ConstructBackendForFile(self.root, self.currentFile, self.backend)
+	return nil
+}
+
+// writeSample writes a datapoint to the data file, unless it's a duplicate (or out-of-order) sample, in which case
+// the duplicate policy determines what happens to it
+func (self *Prom2ParquetWriter) writeSample(key string, dp DataPoint) error {
+	if self.samples.check(key, dp.Timestamp) || self.duplicates == KeepDuplicates {
+		return self.writeLazily(&self.pw, self.currentFile, self.sampleSchema, dp, rowKindSample)
+	} else if self.duplicates == SeparateDuplicates {
+		file := siblingFile(self.currentFile, duplicatesSuffix)
+		return self.writeLazily(&self.dpw, file, self.sampleSchema, dp, rowKindDuplicateSample)
+	} else {
+		self.metrics.duplicateDropped()
+	}
+	return nil
+}
+
+// widenSchema adds a label column for each of the series' labels that doesn't have one yet.  A file's schema can't
+// change once it's been created, so if any files are open, they're rotated so that the new files get the wider schema.
+func (self *Prom2ParquetWriter) widenSchema(labels []prompb.Label) error {
+	reserved := fixedColumns()
+	added := []string{}
+	for _, l := range labels {
+		if canBeColumn(l.Name, reserved) && !slices.Contains(self.labelColumns, l.Name) {
+			added = append(added, l.Name)
+		}
+	}
+	if len(added) == 0 {
+		return nil
+	}
+
+	sort.Strings(added)
+	log.Infof("adding label columns %v for %s", added, self.metricDir())
+	self.setLabelColumns(slices.Concat(self.labelColumns, added))
+	self.metrics.schemaWidened()
+
+	if self.pw == nil && self.hpw == nil && self.epw == nil && self.dpw == nil && self.dhpw == nil {
+		return nil
+	}
+	return self.rotate(nil)
+}
+
+func (self *Prom2ParquetWriter) setLabelColumns(labelColumns []string) {
+	self.labelColumns = labelColumns
+	self.sampleSchema = newRowSchema(DataPoint{}, labelColumns)
+	self.histogramSchema = newRowSchema(HistogramDataPoint{}, labelColumns)
+	self.exemplarSchema = newRowSchema(ExemplarDataPoint{}, labelColumns)
+}
+
+func (self *Prom2ParquetWriter) writeHistogram(key string, hdp HistogramDataPoint) error {
+	if self.histograms.check(key, hdp.Timestamp) || self.duplicates == KeepDuplicates {
+		file := histogramFile(self.currentFile)
+		return self.writeLazily(&self.hpw, file, self.histogramSchema, hdp, rowKindHistogram)
+	} else if self.duplicates == SeparateDuplicates {
+		file := siblingFile(histogramFile(self.currentFile), duplicatesSuffix)
+		return self.writeLazily(&self.dhpw, file, self.histogramSchema, hdp, rowKindDuplicateHistogram)
+	}
+	self.metrics.duplicateDropped()
+	return nil
+}
+
+func (self *Prom2ParquetWriter) rowWritten(kind string) {
+	self.metrics.rowWritten(kind)
+	self.pendingRows++
+}
+
+func (self *Prom2ParquetWriter) writeFailed(what string, err error) {
+	log.Errorf("could not write %s: %v", what, err)
+	self.metrics.writeFailed()
+	self.status.failed(err)
+}
+
+func (self *Prom2ParquetWriter) rotateSeriesTrackers() {
+	for _, t := range []*seriesTracker{self.samples, self.histograms} {
+		if duplicates, outOfOrder := t.rotate(); duplicates > 0 || outOfOrder > 0 {
+			log.Infof(
+				"saw %d duplicate and %d out-of-order samples for %s since the last flush",
+				duplicates,
+				outOfOrder,
+				self.metricDir(),
+			)
+		}
+	}
+}
+
+func (self *Prom2ParquetWriter) writeExemplar(edp ExemplarDataPoint) error {
+	file := siblingFile(self.currentFile, exemplarsSuffix)
+	return self.writeLazily(&self.epw, file, self.exemplarSchema, edp, rowKindExemplar)
+}
+
+// writeLazily writes a datapoint to the given writer, creating the writer (and the underlying file) first if it doesn't
+// already exist
+func (self *Prom2ParquetWriter) writeLazily(
+	pw **writer.ParquetWriter,
+	file string,
+	schema *rowSchema,
+	datapoint interface{},
+	kind string,
+) error {
+	if *pw == nil {
+		newPw, err := self.newParquetWriter(file, schema.new())
+		if err != nil {
+			return err
+		}
+		*pw = newPw
+	}
+
+	if err := (*pw).Write(schema.row(datapoint)); err != nil {
+		return fmt.Errorf("can't write to %s: %w", file, err)
+	}
+	self.rowWritten(kind)
+	return nil
+}
+
+func (self *Prom2ParquetWriter) newParquetWriter(file string, schema interface{}) (*writer.ParquetWriter, error) {
+	return newParquetWriter(self.root, file, self.backend, schema)
+}
+
+func newParquetWriter(
+	root, file string,
+	backend backends.StorageBackend,
+	schema interface{},
+) (*writer.ParquetWriter, error) {
+	fw, err := backends.ConstructBackendForFile(root, file, backend)
 	if err != nil {
-		return fmt.Errorf("can't create storage backend: %w", err)
+		return nil, fmt.Errorf("can't create storage backend: %w", err)
 	}
 
-	pw, err := writer.NewParquetWriter(fw, new(DataPoint), pageNum)
+	pw, err := writer.NewParquetWriter(fw, schema, pageNum)
 	if err != nil {
-		return fmt.Errorf("can't create parquet writer: %w", err)
+		return nil, fmt.Errorf("can't create parquet writer: %w", err)
 	}
 	pw.CompressionType = parquet.CompressionCodec_SNAPPY
 
-	self.pw = pw
+	return pw, nil
+}
 
-	return nil
+// closeFiles finalizes all of the given writers, embedding any metric metadata we know about into each file's footer;
+// once they're all closed, the tracker (if any) is told whether they were written successfully.  The writers must be
+// given in the same order as the names returned by fileNames; the names of the files that were successfully closed are
+// returned.
+func (self *Prom2ParquetWriter) closeFiles(
+	filesID uint64,
+	dataFile string,
+	pws ...*writer.ParquetWriter,
+) ([]string, error) {
+	var md MetricMetadata
+	var hasMetadata bool
+	if self.metadata != nil {
+		md, hasMetadata = self.metadata.Get(self.fields.Dir(), self.fields.Metric)
+	}
+
+	start := time.Now()
+	defer self.metrics.filesClosedSince(start)
+
+	names := fileNames(dataFile)
+	closed := []string{}
+	var errs []error
+	for i, pw := range pws {
+		if pw == nil {
+			continue
+		}
+
+		if hasMetadata {
+			setFooterMetadata(pw, md)
+		}
+		setLabelColumnsMetadata(pw)
+		err := closeFile(pw)
+		self.metrics.fileClosed(pw.Offset, err)
+		self.status.fileClosed(names[i], pw.Offset, err)
+		if err != nil {
+			log.Errorf("can't close parquet writer for %s: %v", names[i], err)
+			err = fmt.Errorf("can't close %s: %w", names[i], err)
+			self.status.failed(err)
+			errs = append(errs, err)
+		} else {
+			closed = append(closed, names[i])
+		}
+	}
+
+	err := errors.Join(errs...)
+	if self.tracker != nil {
+		self.tracker.FilesClosed(filesID, err == nil)
+	}
+	return closed, err
+}
+
+func (self *Prom2ParquetWriter) metricDir() string {
+	return path.Join(self.fields.Dir(), self.fields.Metric)
 }
 
 func (self *Prom2ParquetWriter) getFlushTimer() <-chan time.Time {
 	now := self.now()
 	nextFlushTime := now.Truncate(self.flushInterval).Add(self.flushInterval)
+	self.status.flushScheduled(nextFlushTime)
 	return time.After(nextFlushTime.Sub(now))
 }
 
@@ -145,10 +554,45 @@ func (self *Prom2ParquetWriter) now() time.Time {
 	return self.clock.Now().UTC()
 }
 
-func closeFile(pw *writer.ParquetWriter) {
-	if pw != nil {
-		if err := pw.WriteStop(); err != nil {
-			log.Errorf("can't close parquet writer: %v", err)
-		}
+// lastTimestamp returns the timestamp of the latest sample or histogram in the timeseries
+func lastTimestamp(ts prompb.TimeSeries) int64 {
+	var last int64
+	for _, s := range ts.Samples {
+		last = max(last, s.Timestamp)
 	}
+	for _, h := range ts.Histograms {
+		last = max(last, h.Timestamp)
+	}
+	return last
+}
+
+// siblingFile returns the path of a companion file (e.g., for exemplars) that sits next to the given data file
+func siblingFile(dataFile, suffix string) string {
+	return fmt.Sprintf("%s.%s%s", strings.TrimSuffix(dataFile, parquetExt), suffix, parquetExt)
+}
+
+// histogramFile returns the path of the native histogram file that goes with the given data file
+func histogramFile(dataFile string) string {
+	dir, filename := path.Split(dataFile)
+	return path.Join(dir, histogramsDir, filename)
+}
+
+// fileNames returns the names of the data file and all of the companion files that can go with it, in the order pw,
+// hpw, epw, dpw, dhpw
+func fileNames(dataFile string) []string {
+	hFile := histogramFile(dataFile)
+	return []string{
+		dataFile,
+		hFile,
+		siblingFile(dataFile, exemplarsSuffix),
+		siblingFile(dataFile, duplicatesSuffix),
+		siblingFile(hFile, duplicatesSuffix),
+	}
+}
+
+func closeFile(pw *writer.ParquetWriter) error {
+	if err := pw.WriteStop(); err != nil {
+		return fmt.Errorf("can't close parquet writer: %w", err)
+	}
+	return nil
 }
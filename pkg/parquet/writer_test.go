@@ -1,11 +1,16 @@
 package parquet
 
 import (
+	"context"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/jonboulle/clockwork"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/prometheus/prometheus/prompb"
+	"github.com/samber/lo"
 	"github.com/spf13/afero"
 	"github.com/stretchr/testify/assert"
 	"github.com/xitongsys/parquet-go-source/mem"
@@ -17,9 +22,20 @@ func newTestProm2ParquetWriter(cl clockwork.Clock) *Prom2ParquetWriter {
 	return &Prom2ParquetWriter{
 		backend:       backends.Memory,
 		root:          "/test",
-		prefix:        "prefix/kube_node_stuff",
+		fields:        PathFields{Prefix: "prefix", Metric: "kube_node_stuff"},
+		layout:        defaultPathTemplate,
+		labelColumns:  DefaultLabelColumns(),
+		starts:        &FileStarts{},
+		rotations:     make(chan chan<- rotateResult),
 		flushInterval: 127 * time.Second,
 
+		sampleSchema:    newRowSchema(DataPoint{}, DefaultLabelColumns()),
+		histogramSchema: newRowSchema(HistogramDataPoint{}, DefaultLabelColumns()),
+		exemplarSchema:  newRowSchema(ExemplarDataPoint{}, DefaultLabelColumns()),
+
+		samples:    newSeriesTracker(),
+		histograms: newSeriesTracker(),
+
 		clock: cl,
 	}
 }
@@ -27,12 +43,37 @@ func newTestProm2ParquetWriter(cl clockwork.Clock) *Prom2ParquetWriter {
 func TestListen(t *testing.T) {
 	cases := map[string]struct {
 		flush         bool
+		timeseries    *prompb.TimeSeries
 		expectedFiles []string
+		missingFiles  []string
 	}{
 		"no flush": {
 			expectedFiles: []string{
 				"/test/prefix/kube_node_stuff/00010101000000.parquet",
 			},
+			missingFiles: []string{
+				"/test/prefix/kube_node_stuff/histograms/00010101000000.parquet",
+				"/test/prefix/kube_node_stuff/00010101000000.exemplars.parquet",
+			},
+		},
+		"exemplars": {
+			timeseries: &prompb.TimeSeries{
+				Samples:   []prompb.Sample{{Value: 1.0}},
+				Exemplars: []prompb.Exemplar{{Labels: []prompb.Label{{Name: "trace_id", Value: "abcd"}}, Value: 1.0}},
+			},
+			expectedFiles: []string{
+				"/test/prefix/kube_node_stuff/00010101000000.parquet",
+				"/test/prefix/kube_node_stuff/00010101000000.exemplars.parquet",
+			},
+		},
+		"histograms": {
+			timeseries: &prompb.TimeSeries{
+				Histograms: []prompb.Histogram{{Count: &prompb.Histogram_CountInt{CountInt: 1}, Sum: 1.0}},
+			},
+			expectedFiles: []string{
+				"/test/prefix/kube_node_stuff/00010101000000.parquet",
+				"/test/prefix/kube_node_stuff/histograms/00010101000000.parquet",
+			},
 		},
 		"flush": {
 			flush: true,
@@ -54,11 +95,15 @@ func TestListen(t *testing.T) {
 			flushTimer := make(chan time.Time, 1)
 			running := make(chan bool, 1)
 
-			go w.listen(stream, flushTimer, running)
+			go func() { assert.Nil(t, w.listen(stream, flushTimer, running)) }()
 
 			// First block to make sure that all the setup is done (writer created, defer created)
 			<-running
 
+			if tc.timeseries != nil {
+				stream <- *tc.timeseries
+			}
+
 			if tc.flush {
 				cl.Advance(w.flushInterval + time.Second)
 				flushTimer <- w.clock.Now()
@@ -76,6 +121,14 @@ func TestListen(t *testing.T) {
 				}
 				assert.True(t, exists)
 			}
+
+			for _, filename := range tc.missingFiles {
+				exists, err := afero.Exists(fs, filename)
+				if err != nil {
+					panic(err)
+				}
+				assert.False(t, exists)
+			}
 		})
 	}
 }
@@ -93,3 +146,221 @@ func TestCreateBackendWriter(t *testing.T) {
 	assert.Equal(t, w.currentFile, "prefix/kube_node_stuff/20240307101250.parquet")
 	assert.NotNil(t, w.pw)
 }
+
+type testFileTracker struct {
+	m      sync.Mutex
+	opened []uint64
+	closed []uint64
+}
+
+func (self *testFileTracker) FilesOpened(_ string) uint64 {
+	self.m.Lock()
+	defer self.m.Unlock()
+	self.opened = append(self.opened, uint64(len(self.opened)+1))
+	return uint64(len(self.opened))
+}
+
+func (self *testFileTracker) FilesClosed(id uint64, _ bool) {
+	self.m.Lock()
+	defer self.m.Unlock()
+	self.closed = append(self.closed, id)
+}
+
+func (self *testFileTracker) numClosed() int {
+	self.m.Lock()
+	defer self.m.Unlock()
+	return len(self.closed)
+}
+
+func TestListenFileTracker(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	mem.SetInMemFileFs(&fs)
+
+	cl := clockwork.NewFakeClockAt(time.Time{})
+	tracker := &testFileTracker{}
+	w := newTestProm2ParquetWriter(cl)
+	w.tracker = tracker
+
+	stream := make(chan prompb.TimeSeries)
+	flushTimer := make(chan time.Time)
+	running := make(chan bool, 1)
+	go func() { assert.Nil(t, w.listen(stream, flushTimer, running)) }()
+	<-running
+
+	cl.Advance(w.flushInterval + time.Second)
+	flushTimer <- w.clock.Now()
+	close(stream)
+	<-running
+
+	// The first set of files is closed asynchronously when the flush happens, so we don't know what order they'll be
+	// closed in
+	assert.Equal(t, []uint64{1, 2}, tracker.opened)
+	assert.Eventually(t, func() bool { return tracker.numClosed() == 2 }, time.Second, 10*time.Millisecond)
+	assert.ElementsMatch(t, []uint64{1, 2}, tracker.closed)
+}
+
+func TestRotate(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	mem.SetInMemFileFs(&fs)
+
+	cl := clockwork.NewFakeClockAt(time.Time{})
+	w := newTestProm2ParquetWriter(cl)
+
+	stream := make(chan prompb.TimeSeries)
+	running := make(chan bool, 1)
+	go func() { assert.Nil(t, w.listen(stream, make(chan time.Time), running)) }()
+	<-running
+
+	stream <- prompb.TimeSeries{
+		Samples:   []prompb.Sample{{Value: 1.0}},
+		Exemplars: []prompb.Exemplar{{Value: 1.0}},
+	}
+
+	files, err := w.Rotate(context.TODO())
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), w.SeriesWritten())
+	assert.Equal(t, []string{
+		"prefix/kube_node_stuff/00010101000000.parquet",
+		"prefix/kube_node_stuff/00010101000000.exemplars.parquet",
+	}, files)
+
+	// The new files are in the same flush interval, so they can't have the same name as the old ones
+	close(stream)
+	<-running
+	exists, err := afero.Exists(fs, "/test/prefix/kube_node_stuff/00010101000001.parquet")
+	assert.Nil(t, err)
+	assert.True(t, exists)
+}
+
+func TestRotateQueuedData(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	mem.SetInMemFileFs(&fs)
+
+	w := newTestProm2ParquetWriter(clockwork.NewFakeClockAt(time.Time{}))
+
+	// The writer waits for us to receive from running before it starts reading the stream, so we can queue up the data
+	// and the rotation request first; the rotation shouldn't finalize the files until all of the data is in them
+	stream := make(chan prompb.TimeSeries, 10)
+	running := make(chan bool)
+	go func() { assert.Nil(t, w.listen(stream, make(chan time.Time), running)) }()
+
+	for i := range 10 {
+		stream <- prompb.TimeSeries{Samples: []prompb.Sample{{Value: float64(i), Timestamp: int64(i)}}}
+	}
+	rotated := make(chan []string)
+	go func() {
+		files, err := w.Rotate(context.TODO())
+		assert.Nil(t, err)
+		rotated <- files
+	}()
+	time.Sleep(10 * time.Millisecond)
+	<-running
+
+	files := <-rotated
+	assert.Equal(t, []string{"prefix/kube_node_stuff/00010101000000.parquet"}, files)
+	assert.Equal(t, uint64(10), w.SeriesWritten())
+
+	res, err := ReadSeries(context.Background(), "/test", files[0], backends.Memory)
+	assert.Nil(t, err)
+	assert.Len(t, res, 1)
+	assert.Len(t, res[0].Samples, 10)
+
+	close(stream)
+	<-running
+}
+
+func TestFileStartsNext(t *testing.T) {
+	interval := 10 * time.Minute
+	base := time.Date(2024, 3, 7, 10, 0, 0, 0, time.UTC)
+	starts := &FileStarts{}
+
+	// The first files start at the beginning of the interval
+	assert.Equal(t, base, starts.next(base.Add(3*time.Minute+500*time.Millisecond), interval))
+
+	// If a new writer opens files in the same interval, they start at the current time instead
+	assert.Equal(t, base.Add(5*time.Minute), starts.next(base.Add(5*time.Minute+200*time.Millisecond), interval))
+
+	// ...and never re-use a start time, even in the same second
+	now := base.Add(5*time.Minute + 700*time.Millisecond)
+	assert.Equal(t, base.Add(5*time.Minute+time.Second), starts.next(now, interval))
+
+	// Once we get to the next interval, everything is aligned again
+	assert.Equal(t, base.Add(interval), starts.next(base.Add(interval+time.Minute), interval))
+	assert.Equal(t, base.Add(interval), starts.Last())
+}
+
+func TestListenMetrics(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	mem.SetInMemFileFs(&fs)
+
+	metrics := NewMetrics(prometheus.NewRegistry())
+	w := newTestProm2ParquetWriter(clockwork.NewFakeClockAt(time.Time{}))
+	w.metrics = metrics.forWriter(w.metricDir())
+	w.duplicates = DropDuplicates
+
+	stream := make(chan prompb.TimeSeries)
+	running := make(chan bool, 1)
+	go func() { assert.Nil(t, w.listen(stream, make(chan time.Time), running)) }()
+	<-running
+
+	stream <- prompb.TimeSeries{
+		Samples:   []prompb.Sample{{Value: 1.0, Timestamp: 1}, {Value: 2.0, Timestamp: 1}},
+		Exemplars: []prompb.Exemplar{{Value: 1.0}},
+	}
+	close(stream)
+	<-running
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.rowsWritten.WithLabelValues(w.metricDir(), rowKindSample)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.rowsWritten.WithLabelValues(w.metricDir(), rowKindExemplar)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.duplicatesDropped.WithLabelValues(w.metricDir())))
+	assert.Equal(t, 2.0, testutil.ToFloat64(metrics.filesClosed.WithLabelValues("success")))
+	assert.Equal(t, 1, testutil.CollectAndCount(metrics.closeDuration))
+}
+
+func TestWriterMetricsRelease(t *testing.T) {
+	metrics := NewMetrics(prometheus.NewRegistry())
+	first := metrics.forWriter("prefix/kube_node_stuff")
+	second := metrics.forWriter("prefix/kube_node_stuff")
+	first.rowWritten(rowKindSample)
+
+	// The series are shared by both writers, so they stick around until the second one is released
+	first.release()
+	assert.Equal(t, 1, testutil.CollectAndCount(metrics.rowsWritten))
+	assert.Equal(t, 1, testutil.CollectAndCount(metrics.writeErrors))
+
+	second.release()
+	assert.Equal(t, 0, testutil.CollectAndCount(metrics.rowsWritten))
+	assert.Equal(t, 0, testutil.CollectAndCount(metrics.writeErrors))
+}
+
+func TestWriterStatus(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	mem.SetInMemFileFs(&fs)
+
+	w := newTestProm2ParquetWriter(clockwork.NewFakeClockAt(time.Time{}))
+	stream := make(chan prompb.TimeSeries)
+	running := make(chan bool, 1)
+	go func() { assert.Nil(t, w.listen(stream, make(chan time.Time), running)) }()
+	<-running
+
+	stream <- prompb.TimeSeries{Samples: []prompb.Sample{{Value: 1.0, Timestamp: 1000}, {Value: 2.0, Timestamp: 2000}}}
+	assert.Eventually(t, func() bool { return w.Status().RowsBuffered == 2 }, time.Second, 10*time.Millisecond)
+
+	status := w.Status()
+	assert.Equal(t, "prefix/kube_node_stuff/00010101000000.parquet", status.CurrentFile)
+	assert.Equal(t, time.UnixMilli(2000).UTC(), *status.LastSampleTime)
+	assert.Empty(t, status.RecentFiles)
+
+	_, err := w.Rotate(context.TODO())
+	assert.Nil(t, err)
+	close(stream)
+	<-running
+
+	status = w.Status()
+	assert.Equal(t, int64(0), status.RowsBuffered)
+	assert.Empty(t, status.LastError)
+	assert.Equal(t, []string{
+		"prefix/kube_node_stuff/00010101000000.parquet",
+		"prefix/kube_node_stuff/00010101000001.parquet",
+	}, lo.Map(status.RecentFiles, func(f FileStatus, _ int) string { return f.Name }))
+}
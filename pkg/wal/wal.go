@@ -0,0 +1,256 @@
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/prometheus/prometheus/prompb"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	segmentNameFormat = "%08d"
+	recordHeaderSize  = 8
+
+	// Guard against allocating huge buffers if a length field is corrupted
+	maxRecordSize = 256 * 1024 * 1024
+)
+
+//nolint:gochecknoglobals
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// ReplayFunc is called once for every record in the WAL, in the order they were written
+type ReplayFunc func(tenant string, timeserieses []prompb.TimeSeries) error
+
+// WAL is a segmented write-ahead log of incoming timeseries data.  Every call to Log appends a single record to the
+// current segment and fsyncs it before returning, so once Log returns the data will survive a crash.  Segments are
+// only ever appended to; callers decide when to Cut a new segment and when old segments can be Removed.
+//
+// Each record is stored as a 4-byte big-endian payload length, a 4-byte CRC32 (Castagnoli) of the payload, and the
+// payload itself, which is the (uvarint-length-prefixed) tenant followed by a marshalled prompb.WriteRequest.
+type WAL struct {
+	dir string
+
+	m           sync.Mutex
+	segment     *os.File
+	segmentNum  int
+	segmentSize int64
+	oldSegments []int
+}
+
+// Open creates the WAL directory if necessary and starts a new segment; any segments that were left over from a
+// previous run are available through Replay.
+func Open(dir string) (*WAL, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("can't create WAL directory %s: %w", dir, err)
+	}
+
+	segments, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &WAL{dir: dir, oldSegments: segments}
+	next := 0
+	if len(segments) > 0 {
+		next = segments[len(segments)-1] + 1
+	}
+	if err := w.openSegment(next); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Log appends the timeseries to the WAL and returns the number of the segment they were written to
+func (self *WAL) Log(tenant string, timeserieses []prompb.TimeSeries) (int, error) {
+	data, err := (&prompb.WriteRequest{Timeseries: timeserieses}).Marshal()
+	if err != nil {
+		return 0, fmt.Errorf("can't marshal WAL record: %w", err)
+	}
+
+	payload := binary.AppendUvarint(nil, uint64(len(tenant)))
+	payload = append(payload, tenant...)
+	payload = append(payload, data...)
+
+	record := make([]byte, recordHeaderSize, recordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload))) //nolint:gosec // records are much smaller than 4GB
+	binary.BigEndian.PutUint32(record[4:8], crc32.Checksum(payload, castagnoli))
+	record = append(record, payload...)
+
+	self.m.Lock()
+	defer self.m.Unlock()
+
+	if _, err := self.segment.Write(record); err != nil {
+		return 0, fmt.Errorf("can't write WAL record: %w", err)
+	}
+	if err := self.segment.Sync(); err != nil {
+		return 0, fmt.Errorf("can't sync WAL segment: %w", err)
+	}
+	self.segmentSize += int64(len(record))
+
+	return self.segmentNum, nil
+}
+
+// Cut closes the current segment and starts a new one, returning the number of the segment that was closed.  If the
+// current segment is empty, nothing happens and Cut returns false.
+func (self *WAL) Cut() (int, bool, error) {
+	self.m.Lock()
+	defer self.m.Unlock()
+
+	if self.segmentSize == 0 {
+		return 0, false, nil
+	}
+
+	closed := self.segmentNum
+	if err := self.segment.Close(); err != nil {
+		return 0, false, fmt.Errorf("can't close WAL segment %d: %w", closed, err)
+	}
+	if err := self.openSegment(closed + 1); err != nil {
+		return 0, false, err
+	}
+	return closed, true, nil
+}
+
+// Replay reads all of the segments that were left over from a previous run and calls fn for each record; it returns
+// the numbers of the replayed segments, which the caller should Remove once the replayed data is durably stored
+// elsewhere.  A corrupted or truncated record (e.g., from a crash in the middle of a write) ends the replay of that
+// segment, since nothing after it can be trusted.
+func (self *WAL) Replay(fn ReplayFunc) ([]int, error) {
+	for _, num := range self.oldSegments {
+		if err := self.replaySegment(num, fn); err != nil {
+			return nil, err
+		}
+	}
+
+	replayed := self.oldSegments
+	self.oldSegments = nil
+	return replayed, nil
+}
+
+// Remove deletes the given segment from disk; the current segment can't be removed
+func (self *WAL) Remove(num int) error {
+	self.m.Lock()
+	defer self.m.Unlock()
+
+	if num == self.segmentNum {
+		return fmt.Errorf("can't remove the current WAL segment %d", num)
+	}
+
+	if err := os.Remove(self.segmentPath(num)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("can't remove WAL segment %d: %w", num, err)
+	}
+	return nil
+}
+
+func (self *WAL) Close() error {
+	self.m.Lock()
+	defer self.m.Unlock()
+
+	if err := self.segment.Close(); err != nil {
+		return fmt.Errorf("can't close WAL segment %d: %w", self.segmentNum, err)
+	}
+	return nil
+}
+
+func (self *WAL) openSegment(num int) error {
+	f, err := os.OpenFile(self.segmentPath(num), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("can't create WAL segment %d: %w", num, err)
+	}
+
+	self.segment = f
+	self.segmentNum = num
+	self.segmentSize = 0
+	return nil
+}
+
+func (self *WAL) replaySegment(num int, fn ReplayFunc) error {
+	f, err := os.Open(self.segmentPath(num))
+	if err != nil {
+		return fmt.Errorf("can't open WAL segment %d: %w", num, err)
+	}
+	defer f.Close()
+
+	log.Infof("replaying WAL segment %d", num)
+	r := bufio.NewReader(f)
+	for i := 0; ; i++ {
+		tenant, timeserieses, err := readRecord(r)
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			log.Warnf("WAL segment %d is corrupted at record %d, skipping the rest of it: %v", num, i, err)
+			return nil
+		}
+
+		if err := fn(tenant, timeserieses); err != nil {
+			return fmt.Errorf("can't replay record %d of WAL segment %d: %w", i, num, err)
+		}
+	}
+}
+
+func (self *WAL) segmentPath(num int) string {
+	return filepath.Join(self.dir, fmt.Sprintf(segmentNameFormat, num))
+}
+
+func readRecord(r io.Reader) (string, []prompb.TimeSeries, error) {
+	header := make([]byte, recordHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return "", nil, errors.New("truncated record header")
+		}
+		return "", nil, err //nolint:wrapcheck // EOF is checked by the caller
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	if length > maxRecordSize {
+		return "", nil, fmt.Errorf("record length %d is too large", length)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return "", nil, fmt.Errorf("truncated record: %w", err)
+	}
+	if crc32.Checksum(payload, castagnoli) != binary.BigEndian.Uint32(header[4:8]) {
+		return "", nil, errors.New("checksum mismatch")
+	}
+
+	tenantLen, n := binary.Uvarint(payload)
+	if n <= 0 || uint64(len(payload)-n) < tenantLen {
+		return "", nil, errors.New("invalid tenant length")
+	}
+	tenant := string(payload[n : n+int(tenantLen)]) //nolint:gosec // bounds-checked above
+
+	req := prompb.WriteRequest{}
+	if err := req.Unmarshal(payload[n+int(tenantLen):]); err != nil { //nolint:gosec // bounds-checked above
+		return "", nil, fmt.Errorf("can't unmarshal record: %w", err)
+	}
+	return tenant, req.Timeseries, nil
+}
+
+func listSegments(dir string) ([]int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("can't read WAL directory %s: %w", dir, err)
+	}
+
+	segments := []int{}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		if num, err := strconv.Atoi(e.Name()); err == nil {
+			segments = append(segments, num)
+		}
+	}
+	sort.Ints(segments)
+	return segments, nil
+}
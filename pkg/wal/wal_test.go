@@ -0,0 +1,114 @@
+package wal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+)
+
+type record struct {
+	tenant       string
+	timeserieses []prompb.TimeSeries
+}
+
+func testTimeseries(value float64) []prompb.TimeSeries {
+	return []prompb.TimeSeries{{
+		Labels:  []prompb.Label{{Name: "__name__", Value: "kube_node_stuff"}},
+		Samples: []prompb.Sample{{Value: value, Timestamp: 1000}},
+	}}
+}
+
+func replayAll(t *testing.T, w *WAL) ([]record, []int) {
+	records := []record{}
+	replayed, err := w.Replay(func(tenant string, timeserieses []prompb.TimeSeries) error {
+		records = append(records, record{tenant, timeserieses})
+		return nil
+	})
+	assert.Nil(t, err)
+	return records, replayed
+}
+
+func TestLogAndReplay(t *testing.T) {
+	dir := t.TempDir()
+	w, err := Open(dir)
+	assert.Nil(t, err)
+
+	seg, err := w.Log("", testTimeseries(1.0))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, seg)
+
+	closed, ok, err := w.Cut()
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, 0, closed)
+
+	seg, err = w.Log("tenant-a", testTimeseries(2.0))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, seg)
+
+	assert.Nil(t, w.Close())
+
+	w, err = Open(dir)
+	assert.Nil(t, err)
+	records, replayed := replayAll(t, w)
+	assert.Equal(t, []int{0, 1}, replayed)
+	assert.Equal(t, []record{
+		{"", testTimeseries(1.0)},
+		{"tenant-a", testTimeseries(2.0)},
+	}, records)
+
+	// Segments are only replayed once
+	records, replayed = replayAll(t, w)
+	assert.Empty(t, records)
+	assert.Empty(t, replayed)
+}
+
+func TestCutEmptySegment(t *testing.T) {
+	w, err := Open(t.TempDir())
+	assert.Nil(t, err)
+
+	_, ok, err := w.Cut()
+	assert.Nil(t, err)
+	assert.False(t, ok)
+}
+
+func TestRemove(t *testing.T) {
+	dir := t.TempDir()
+	w, err := Open(dir)
+	assert.Nil(t, err)
+
+	_, err = w.Log("", testTimeseries(1.0))
+	assert.Nil(t, err)
+	closed, _, err := w.Cut()
+	assert.Nil(t, err)
+
+	assert.NotNil(t, w.Remove(closed+1))
+	assert.Nil(t, w.Remove(closed))
+	assert.NoFileExists(t, filepath.Join(dir, "00000000"))
+	assert.FileExists(t, filepath.Join(dir, "00000001"))
+}
+
+func TestReplayTornWrite(t *testing.T) {
+	dir := t.TempDir()
+	w, err := Open(dir)
+	assert.Nil(t, err)
+	_, err = w.Log("", testTimeseries(1.0))
+	assert.Nil(t, err)
+	_, err = w.Log("", testTimeseries(2.0))
+	assert.Nil(t, err)
+	assert.Nil(t, w.Close())
+
+	// Simulate a crash in the middle of writing the second record
+	path := filepath.Join(dir, "00000000")
+	info, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Nil(t, os.Truncate(path, info.Size()-3))
+
+	w, err = Open(dir)
+	assert.Nil(t, err)
+	records, _ := replayAll(t, w)
+	assert.Equal(t, []record{{"", testTimeseries(1.0)}}, records)
+}